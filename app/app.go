@@ -12,13 +12,17 @@
 package app
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	translate "github.com/slidebolt/plugin-zigbee2mqtt/internal/translate"
@@ -56,15 +60,132 @@ func Encode(cmd any, internal json.RawMessage) (json.RawMessage, error) {
 //	Z2M_MQTT_PASSWORD - MQTT password (optional)
 //	Z2M_DISCOVERY_PREFIX - HA discovery prefix (default: homeassistant)
 //	Z2M_BASE_TOPIC - Z2M base topic (default: zigbee2mqtt)
+//	Z2M_MQTT_CA_CERT - PEM CA bundle used to verify the broker (optional)
+//	Z2M_MQTT_CLIENT_CERT - PEM client certificate for mutual TLS (optional)
+//	Z2M_MQTT_CLIENT_KEY - PEM client key for mutual TLS (optional)
+//	Z2M_MQTT_SERVER_NAME - TLS server name override (optional)
+//	Z2M_MQTT_INSECURE_SKIP_VERIFY - skip broker certificate verification (default: false)
+//	Z2M_MQTT_WS_PATH - WebSocket path for ws:// and wss:// brokers (optional)
+//	Z2M_MQTT_HTTP_HEADERS - JSON object of WebSocket handshake headers (optional)
+//	Z2M_MQTT_PROXY - HTTP or SOCKS5 proxy for WebSocket brokers (optional)
+//	Z2M_MQTT_PROTOCOL_VERSION - MQTT protocol version: 3.1, 3.1.1 or 5 (default: negotiate 3.1.1)
+//	Z2M_MQTT_SESSION_EXPIRY - MQTT 5 session expiry interval in seconds (default: 3600)
+//	Z2M_MQTT_USER_PROPERTIES - JSON object of MQTT 5 user properties (optional)
+//	Z2M_MQTT_RESPONSE_TOPIC - MQTT 5 response topic set on command publishes (optional)
+//	Z2M_STATUS_TOPIC - plugin availability topic (default: slidebolt/plugin-zigbee2mqtt/status)
+//	Z2M_MQTT_CLEAN_SESSION - start a fresh broker session on every connect (default: false)
+//	Z2M_DISCOVERY_QOS - QoS for discovery subscriptions (default: 1)
+//	Z2M_STATE_QOS - QoS for state subscriptions (default: 1)
+//	Z2M_COMMAND_QOS - QoS for command publishes (default: 1)
+//	Z2M_COMMAND_QUEUE_SIZE - commands held while the broker is down (default: 100)
+//	Z2M_COMMAND_TTL_SECONDS - how long a held command stays valid (default: 30)
+//	Z2M_RECONCILE_AFTER_SECONDS - discovery settle window before orphan reconciliation (default: 30)
+//	Z2M_ORPHAN_ACTION - what to do with orphaned entities: mark or delete (default: mark)
+//	Z2M_DISCOVERY_MODE - homeassistant, native or both (default: homeassistant)
+//	Z2M_DISCOVERY_FILTERS - JSON array of include/exclude rules (default: none)
 type MQTTConfig struct {
+	// Name namespaces the device IDs of this instance. Optional with a
+	// single instance, required and unique with several.
+	Name string `json:"name"`
+
 	Broker          string `json:"broker"`
 	Username        string `json:"username"`
 	Password        string `json:"password"`
 	DiscoveryPrefix string `json:"discovery_prefix"`
 	BaseTopic       string `json:"base_topic"`
 	ClientID        string `json:"client_id"`
+
+	// TLS settings, used for ssl://, tls://, mqtts:// and wss:// brokers.
+	// Certificate and key fields are file paths.
+	CACert             string `json:"ca_cert"`
+	ClientCert         string `json:"client_cert"`
+	ClientKey          string `json:"client_key"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+
+	// WebSocket settings, used for ws:// and wss:// brokers. WebsocketPath
+	// replaces the broker URL path (e.g. "/mqtt"); HTTPHeaders are sent with
+	// the handshake; ProxyURL overrides the HTTP(S)_PROXY environment.
+	WebsocketPath string            `json:"websocket_path"`
+	HTTPHeaders   map[string]string `json:"http_headers"`
+	ProxyURL      string            `json:"proxy_url"`
+
+	// ProtocolVersion selects the MQTT protocol spoken to the broker. "5"
+	// connects through paho.golang, see mqtt5.go.
+	ProtocolVersion string `json:"protocol_version"`
+
+	// MQTT 5 settings. SessionExpiryInterval is how long, in seconds, the
+	// broker keeps a persistent session after the connection drops.
+	// UserProperties are sent with the CONNECT and every PUBLISH;
+	// ResponseTopic is set on command publishes.
+	SessionExpiryInterval uint32            `json:"session_expiry_interval"`
+	UserProperties        map[string]string `json:"user_properties"`
+	ResponseTopic         string            `json:"response_topic"`
+
+	// StatusTopic carries the plugin's retained availability: "online" as a
+	// birth message on connect, "offline" as Last Will and on shutdown.
+	// Empty disables availability publishing.
+	StatusTopic string `json:"status_topic"`
+
+	// CleanSession false keeps the broker-side session (subscriptions and
+	// queued QoS 1/2 messages) across reconnects. Requires a stable ClientID.
+	CleanSession bool `json:"clean_session"`
+	DiscoveryQoS byte `json:"discovery_qos"`
+	StateQoS     byte `json:"state_qos"`
+	CommandQoS   byte `json:"command_qos"`
+
+	// CommandQueueSize bounds the commands held while the broker is
+	// unreachable; 0 fails them straight away. A queued command that waits
+	// longer than CommandTTLSeconds fails and its optimistic state is undone.
+	CommandQueueSize  int `json:"command_queue_size"`
+	CommandTTLSeconds int `json:"command_ttl_seconds"`
+
+	// ReconcileAfterSeconds is how long discovery may settle after a
+	// connect before stored entities that were not rediscovered count as
+	// orphans; 0 disables reconciliation. OrphanAction is "mark" (flag the
+	// topic info) or "delete".
+	ReconcileAfterSeconds int    `json:"reconcile_after_seconds"`
+	OrphanAction          string `json:"orphan_action"`
+
+	// DiscoveryMode picks where entities come from: "homeassistant" (the
+	// HA discovery configs), "native" (the retained <base_topic>/bridge/devices
+	// list) or "both", where native entities take precedence.
+	DiscoveryMode string `json:"discovery_mode"`
+
+	// Filters decide which discovered entities are stored, see FilterRule.
+	Filters []FilterRule `json:"filters"`
+}
+
+func (c MQTTConfig) commandTTL() time.Duration {
+	return time.Duration(c.CommandTTLSeconds) * time.Second
+}
+
+// validateSession checks the QoS levels, the offline command queue limits and
+// that a persistent session has a client ID the broker can recognise on
+// reconnect.
+func (c MQTTConfig) validateSession() error {
+	for name, qos := range map[string]byte{"discovery_qos": c.DiscoveryQoS, "state_qos": c.StateQoS, "command_qos": c.CommandQoS} {
+		if qos > 2 {
+			return fmt.Errorf("%s %d out of range [0,2]", name, qos)
+		}
+	}
+	if c.CommandQueueSize < 0 {
+		return fmt.Errorf("command_queue_size %d must not be negative", c.CommandQueueSize)
+	}
+	if c.CommandQueueSize > 0 && c.CommandTTLSeconds <= 0 {
+		return fmt.Errorf("command_ttl_seconds must be positive when command_queue_size is set")
+	}
+	if !c.CleanSession && strings.TrimSpace(c.ClientID) == "" {
+		return fmt.Errorf("client_id is required when clean_session is false")
+	}
+	return nil
 }
 
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
 func loadMQTTConfig() MQTTConfig {
 	cfg := MQTTConfig{
 		Broker:          getEnv("Z2M_MQTT_BROKER", ""),
@@ -73,6 +194,37 @@ func loadMQTTConfig() MQTTConfig {
 		DiscoveryPrefix: getEnv("Z2M_DISCOVERY_PREFIX", "homeassistant"),
 		BaseTopic:       getEnv("Z2M_BASE_TOPIC", "zigbee2mqtt"),
 		ClientID:        getEnv("Z2M_CLIENT_ID", "slidebolt-z2m-plugin"),
+
+		CACert:             getEnv("Z2M_MQTT_CA_CERT", ""),
+		ClientCert:         getEnv("Z2M_MQTT_CLIENT_CERT", ""),
+		ClientKey:          getEnv("Z2M_MQTT_CLIENT_KEY", ""),
+		ServerName:         getEnv("Z2M_MQTT_SERVER_NAME", ""),
+		InsecureSkipVerify: getEnvBool("Z2M_MQTT_INSECURE_SKIP_VERIFY", false),
+
+		WebsocketPath: getEnv("Z2M_MQTT_WS_PATH", ""),
+		HTTPHeaders:   getEnvStringMap("Z2M_MQTT_HTTP_HEADERS"),
+		ProxyURL:      getEnv("Z2M_MQTT_PROXY", ""),
+
+		ProtocolVersion:       getEnv("Z2M_MQTT_PROTOCOL_VERSION", ""),
+		SessionExpiryInterval: uint32(max(getEnvInt("Z2M_MQTT_SESSION_EXPIRY", 3600), 0)),
+		UserProperties:        getEnvStringMap("Z2M_MQTT_USER_PROPERTIES"),
+		ResponseTopic:         getEnv("Z2M_MQTT_RESPONSE_TOPIC", ""),
+
+		StatusTopic: getEnv("Z2M_STATUS_TOPIC", "slidebolt/"+pluginID+"/status"),
+
+		CleanSession: getEnvBool("Z2M_MQTT_CLEAN_SESSION", false),
+		DiscoveryQoS: getEnvQoS("Z2M_DISCOVERY_QOS", 1),
+		StateQoS:     getEnvQoS("Z2M_STATE_QOS", 1),
+		CommandQoS:   getEnvQoS("Z2M_COMMAND_QOS", 1),
+
+		CommandQueueSize:  getEnvInt("Z2M_COMMAND_QUEUE_SIZE", 100),
+		CommandTTLSeconds: getEnvInt("Z2M_COMMAND_TTL_SECONDS", 30),
+
+		ReconcileAfterSeconds: getEnvInt("Z2M_RECONCILE_AFTER_SECONDS", 30),
+		OrphanAction:          getEnv("Z2M_ORPHAN_ACTION", orphanMark),
+
+		DiscoveryMode: getEnv("Z2M_DISCOVERY_MODE", discoveryHomeAssistant),
+		Filters:       getEnvFilters("Z2M_DISCOVERY_FILTERS"),
 	}
 	return cfg
 }
@@ -84,6 +236,98 @@ func getEnv(key, defaultVal string) string {
 	return defaultVal
 }
 
+func getEnvBool(key string, defaultVal bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultVal
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("plugin-zigbee2mqtt: ignoring invalid %s=%q: %v", key, v, err)
+		return defaultVal
+	}
+	return b
+}
+
+func getEnvInt(key string, defaultVal int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultVal
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("plugin-zigbee2mqtt: ignoring invalid %s=%q: %v", key, v, err)
+		return defaultVal
+	}
+	return n
+}
+
+func getEnvStringMap(key string) map[string]string {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	var m map[string]string
+	if err := json.Unmarshal([]byte(v), &m); err != nil {
+		log.Printf("plugin-zigbee2mqtt: ignoring invalid %s: %v", key, err)
+		return nil
+	}
+	return m
+}
+
+func getEnvFilters(key string) []FilterRule {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil
+	}
+	var rules []FilterRule
+	if err := json.Unmarshal([]byte(v), &rules); err != nil {
+		log.Printf("plugin-zigbee2mqtt: ignoring invalid %s: %v", key, err)
+		return nil
+	}
+	return rules
+}
+
+func getEnvQoS(key string, defaultVal byte) byte {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultVal
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > 2 {
+		log.Printf("plugin-zigbee2mqtt: ignoring invalid %s=%q: QoS must be 0, 1 or 2", key, v)
+		return defaultVal
+	}
+	return byte(n)
+}
+
+// protocolV5 is the protocol level of MQTT 5.
+const protocolV5 = 5
+
+// pahoProtocolVersion maps a configured MQTT protocol version onto its
+// numeric level. 0 means "negotiate" (3.1.1 with 3.1 fallback). 3 and 4 are
+// spoken by paho.mqtt.golang, 5 by the paho.golang client in mqtt5.go.
+func pahoProtocolVersion(version string) (uint, error) {
+	switch strings.TrimSpace(version) {
+	case "":
+		return 0, nil
+	case "3.1.1", "4":
+		return 4, nil
+	case "3.1", "3":
+		return 3, nil
+	case "5", "5.0":
+		return protocolV5, nil
+	default:
+		return 0, fmt.Errorf("unknown MQTT protocol version %q", version)
+	}
+}
+
+// mqtt5 reports whether the config connects with MQTT 5.
+func (c MQTTConfig) mqtt5() bool {
+	v, err := pahoProtocolVersion(c.ProtocolVersion)
+	return err == nil && v == protocolV5
+}
+
 // EntityTopicInfo stores MQTT topic mappings for an entity in internal storage
 type EntityTopicInfo struct {
 	StateTopic   string          `json:"state_topic"`
@@ -93,10 +337,36 @@ type EntityTopicInfo struct {
 	EntityType   string          `json:"entity_type"`
 	DeviceID     string          `json:"device_id"`
 	FriendlyName string          `json:"friendly_name"`
+	// Instance is the name of the Zigbee2MQTT instance that owns the entity.
+	Instance string `json:"instance,omitempty"`
 	// Sensor-specific: extracted from HA discovery value_template for field-accurate decoding
 	ValueField        string `json:"value_field,omitempty"`
 	UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
 	SensorDeviceClass string `json:"sensor_device_class,omitempty"`
+	// Native is set for entities built from <base_topic>/bridge/devices.
+	// Property is the Z2M state key (dotted inside composites) carried by a
+	// single-value entity; Endpoint is the suffix of multi-endpoint keys
+	// such as state_l1. Both are projected to the keys the codecs expect.
+	Native   bool   `json:"native,omitempty"`
+	Property string `json:"property,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	// AvailabilitySources and AvailabilityMode decide the entity's
+	// availability flag, see availability.go.
+	AvailabilitySources []AvailabilitySource `json:"availability,omitempty"`
+	AvailabilityMode    string               `json:"availability_mode,omitempty"`
+	// AttributesTopic and AttributesTemplate feed the entity's attributes,
+	// see attributes.go.
+	AttributesTopic    string `json:"json_attributes_topic,omitempty"`
+	AttributesTemplate string `json:"json_attributes_template,omitempty"`
+	// Templates maps the discovery template options the entity evaluates
+	// to their source, see templates.go.
+	Templates map[string]string `json:"templates,omitempty"`
+	// DeviceConfig is the ID of the device-based discovery config
+	// (<prefix>/device/<id>/config) the entity is a component of.
+	DeviceConfig string `json:"device_config,omitempty"`
+	// OrphanedAt is set when reconciliation found no discovery config for
+	// the entity; rediscovery clears it.
+	OrphanedAt *time.Time `json:"orphaned_at,omitempty"`
 }
 
 // ---------------------------------------------------------------------------
@@ -104,17 +374,22 @@ type EntityTopicInfo struct {
 // ---------------------------------------------------------------------------
 
 type plugin struct {
-	msg     messenger.Messenger
-	store   storage.Storage
-	cmds    *messenger.Commands
-	subs    []messenger.Subscription
-	mqtt    mqtt.Client
-	mqttCfg MQTTConfig
-
-	// stateTopicIndex maps MQTT state topics (e.g. "zigbee2mqtt/Main_LB_01")
-	// to the entity keys that share that topic. Built during discovery.
-	mu              sync.RWMutex
-	stateTopicIndex map[string][]domain.EntityKey
+	msg   messenger.Messenger
+	store storage.Storage
+	cmds  *messenger.Commands
+	subs  []messenger.Subscription
+
+	// mu guards cfg and instances, which config.set replaces at runtime.
+	mu        sync.RWMutex
+	cfg       Config
+	instances []*instance
+
+	// reloadMu serialises persisting and applying configs, so two
+	// config.set requests can't interleave on the same instances and the
+	// stored config is always the one running.
+	reloadMu sync.Mutex
+
+	templates templateCache
 }
 
 func (p *plugin) Hello() contract.HelloResponse {
@@ -127,10 +402,6 @@ func (p *plugin) Hello() contract.HelloResponse {
 }
 
 func (p *plugin) OnStart(deps map[string]json.RawMessage) (json.RawMessage, error) {
-	// Load MQTT configuration
-	p.mqttCfg = loadMQTTConfig()
-	p.stateTopicIndex = make(map[string][]domain.EntityKey)
-
 	// Connect to Messenger SDK
 	msg, err := messenger.Connect(deps)
 	if err != nil {
@@ -145,6 +416,12 @@ func (p *plugin) OnStart(deps map[string]json.RawMessage) (json.RawMessage, erro
 	}
 	p.store = store
 
+	// Load configuration: a stored config wins, env vars are the bootstrap default
+	cfg, err := p.startupConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	// Wire up typed command dispatch
 	p.cmds = messenger.NewCommands(msg, domain.LookupCommand)
 	sub, err := p.cmds.Receive(pluginID+".>", p.handleCommand)
@@ -153,55 +430,142 @@ func (p *plugin) OnStart(deps map[string]json.RawMessage) (json.RawMessage, erro
 	}
 	p.subs = append(p.subs, sub)
 
-	// Connect to MQTT broker
-	if err := p.connectMQTT(); err != nil {
-		log.Printf("plugin-zigbee2mqtt: MQTT connection failed: %v", err)
-		log.Println("plugin-zigbee2mqtt: continuing without MQTT - set Z2M_MQTT_BROKER to enable")
-	} else {
-		log.Println("plugin-zigbee2mqtt: MQTT connected successfully")
+	// Runtime reconfiguration
+	cfgSub, err := msg.Subscribe(subjectConfigSet, p.handleConfigSet)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe %s: %w", subjectConfigSet, err)
 	}
-
-	// Seed demo device (only if MQTT is not connected - real devices will come from Z2M)
-	if p.mqtt == nil || !p.mqtt.IsConnected() {
-		if err := p.seedDemo(); err != nil {
-			return nil, fmt.Errorf("seed demo: %w", err)
-		}
+	p.subs = append(p.subs, cfgSub)
+	dryRunSub, err := msg.Subscribe(subjectFiltersDryRun, p.handleFiltersDryRun)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe %s: %w", subjectFiltersDryRun, err)
 	}
+	p.subs = append(p.subs, dryRunSub)
+
+	// Connect to each instance's MQTT broker in the background and seed or
+	// clear the demo device. config.set is already subscribed, so take the
+	// reload lock like it does.
+	p.reloadMu.Lock()
+	p.applyConfig(cfg)
+	p.reloadMu.Unlock()
 
 	log.Println("plugin-zigbee2mqtt: started")
 	return nil, nil
 }
 
-// connectMQTT establishes connection to MQTT broker and subscribes to topics
-func (p *plugin) connectMQTT() error {
-	if strings.TrimSpace(p.mqttCfg.Broker) == "" {
-		return fmt.Errorf("Z2M_MQTT_BROKER is not set")
+// connect starts the instance's connection to its MQTT broker. It returns
+// once the client is configured; topics are subscribed from onMQTTConnect.
+func (in *instance) connect() error {
+	if strings.TrimSpace(in.cfg.Broker) == "" {
+		return fmt.Errorf("MQTT broker is not set")
+	}
+
+	// Publish the diagnostic entity before the first attempt, so a broker
+	// that never answers still shows up as disconnected, and keep the
+	// entities unavailable until it does answer.
+	var changed bool
+	in.updateBridge(func(s *bridgeStatus) {
+		s.state.Connected = false
+		changed = s.setDown(func() { s.brokerDown = true })
+	})
+	if changed {
+		in.applyBridgeAvailability()
+	}
+
+	client, err := in.newClient()
+	if err != nil {
+		return err
+	}
+
+	in.mqtt = client
+	in.stop = make(chan struct{})
+	go in.expireLoop(in.stop)
+
+	// Connect in the background: paho retries until the broker answers and
+	// onMQTTConnect takes over from there, so startup never waits on it.
+	token := in.mqtt.Connect()
+	go func(stop <-chan struct{}) {
+		select {
+		case <-token.Done():
+			if err := token.Error(); err != nil {
+				log.Printf("plugin-zigbee2mqtt: [%s] MQTT connect: %v", in.label(), err)
+				in.bridgeDisconnected(err)
+			}
+		case <-stop:
+		}
+	}(in.stop)
+
+	return nil
+}
+
+// newClient builds the client for the instance's broker: paho.golang for
+// MQTT 5, paho.mqtt.golang otherwise.
+func (in *instance) newClient() (mqtt.Client, error) {
+	if in.cfg.mqtt5() {
+		return in.newV5Client()
+	}
+	opts, err := in.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	return mqtt.NewClient(opts), nil
+}
+
+// clientOptions builds the paho options for the instance's MQTT 3.1.1 broker.
+func (in *instance) clientOptions() (*mqtt.ClientOptions, error) {
+	if err := in.cfg.validateProtocol(); err != nil {
+		return nil, fmt.Errorf("MQTT config: %w", err)
+	}
+	protocolVersion, _ := pahoProtocolVersion(in.cfg.ProtocolVersion)
+	if err := in.cfg.validateSession(); err != nil {
+		return nil, fmt.Errorf("MQTT config: %w", err)
+	}
+
+	broker, err := in.cfg.brokerURL()
+	if err != nil {
+		return nil, fmt.Errorf("MQTT config: %w", err)
 	}
 
 	opts := mqtt.NewClientOptions().
-		AddBroker(p.mqttCfg.Broker).
-		SetClientID(p.mqttCfg.ClientID).
+		AddBroker(broker).
+		SetClientID(in.cfg.ClientID).
+		SetCleanSession(in.cfg.CleanSession).
+		SetResumeSubs(!in.cfg.CleanSession).
 		SetAutoReconnect(true).
 		SetConnectRetry(true).
 		SetConnectRetryInterval(5 * time.Second).
-		SetOnConnectHandler(p.onMQTTConnect).
-		SetConnectionLostHandler(p.onMQTTDisconnect)
+		SetOnConnectHandler(in.onMQTTConnect).
+		SetConnectionLostHandler(in.onMQTTDisconnect).
+		SetConnectionNotificationHandler(in.onConnectionNotification)
 
-	if p.mqttCfg.Username != "" {
-		opts.SetUsername(p.mqttCfg.Username)
-		opts.SetPassword(p.mqttCfg.Password)
+	if protocolVersion != 0 {
+		opts.SetProtocolVersion(protocolVersion)
 	}
 
-	p.mqtt = mqtt.NewClient(opts)
+	if in.cfg.Username != "" {
+		opts.SetUsername(in.cfg.Username)
+		opts.SetPassword(in.cfg.Password)
+	}
 
-	// Connect with timeout
-	token := p.mqtt.Connect()
-	token.WaitTimeout(10 * time.Second)
-	if token.Error() != nil {
-		return fmt.Errorf("MQTT connect: %w", token.Error())
+	// The broker publishes this on our behalf if the connection drops
+	// without a clean disconnect.
+	if in.cfg.StatusTopic != "" {
+		opts.SetWill(in.cfg.StatusTopic, statusOffline, 1, true)
 	}
 
-	return nil
+	tlsCfg, err := buildTLSConfig(in.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("MQTT TLS: %w", err)
+	}
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
+
+	if err := applyWebsocketOptions(opts, in.cfg); err != nil {
+		return nil, fmt.Errorf("MQTT websocket: %w", err)
+	}
+
+	return opts, nil
 }
 
 func parseDiscoveryTopic(topic string) (entityType, deviceID, entityID string, ok bool) {
@@ -241,7 +605,8 @@ func resolveEntityName(discovery DiscoveryPayload, entityType, objectID string)
 }
 
 // extractValueField parses "{{ value_json.fieldname }}" → "fieldname".
-// Returns "" if the template doesn't match this pattern.
+// Returns "" if the template doesn't match this pattern; such templates are
+// evaluated by the template engine instead.
 func extractValueField(valueTemplate string) string {
 	t := strings.TrimSpace(valueTemplate)
 	t = strings.TrimPrefix(t, "{{")
@@ -251,51 +616,124 @@ func extractValueField(valueTemplate string) string {
 	if !strings.HasPrefix(t, "value_json.") {
 		return ""
 	}
-	return strings.TrimPrefix(t, "value_json.")
+	field := strings.TrimPrefix(t, "value_json.")
+	for _, r := range field {
+		if r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return ""
+		}
+	}
+	return field
 }
 
 // onMQTTConnect is called when MQTT connection is established (initial or reconnect)
-func (p *plugin) onMQTTConnect(client mqtt.Client) {
-	log.Println("plugin-zigbee2mqtt: MQTT connected, subscribing to topics...")
+func (in *instance) onMQTTConnect(client mqtt.Client) {
+	log.Printf("plugin-zigbee2mqtt: [%s] MQTT connected, subscribing to topics...", in.label())
+	in.bridgeConnected()
+
+	// Subscribing replays the retained discovery configs; reconcile once
+	// they have settled.
+	in.scheduleReconcile()
+
+	// Real devices come from Z2M now; the demo device would only shadow them.
+	in.p.removeDemo()
 
 	// Subscribe to HA discovery topic
-	discoveryTopic := p.mqttCfg.DiscoveryPrefix + "/#"
-	token := client.Subscribe(discoveryTopic, 0, p.handleDiscoveryMessage)
-	token.WaitTimeout(5 * time.Second)
-	if token.Error() != nil {
-		log.Printf("plugin-zigbee2mqtt: failed to subscribe to discovery: %v", token.Error())
-	} else {
-		log.Printf("plugin-zigbee2mqtt: subscribed to %s", discoveryTopic)
+	if in.cfg.haDiscovery() {
+		discoveryTopic := in.cfg.DiscoveryPrefix + "/#"
+		token := client.Subscribe(discoveryTopic, in.cfg.DiscoveryQoS, in.handleDiscoveryMessage)
+		token.WaitTimeout(5 * time.Second)
+		if token.Error() != nil {
+			log.Printf("plugin-zigbee2mqtt: failed to subscribe to discovery: %v", token.Error())
+		} else {
+			log.Printf("plugin-zigbee2mqtt: [%s] subscribed to %s", in.label(), discoveryTopic)
+		}
 	}
 
 	// Subscribe to all Z2M state topics via wildcard — avoids per-device subscriptions
 	// from within MQTT callbacks (which deadlocks the Paho inbound goroutine).
-	stateTopic := p.mqttCfg.BaseTopic + "/#"
-	token2 := client.Subscribe(stateTopic, 0, p.handleStateMessage)
+	// This also delivers the retained bridge/devices list for native discovery.
+	stateTopic := in.cfg.BaseTopic + "/#"
+	token2 := client.Subscribe(stateTopic, in.cfg.StateQoS, in.handleStateMessage)
 	token2.WaitTimeout(5 * time.Second)
 	if token2.Error() != nil {
 		log.Printf("plugin-zigbee2mqtt: failed to subscribe to state: %v", token2.Error())
 	} else {
-		log.Printf("plugin-zigbee2mqtt: subscribed to %s", stateTopic)
+		log.Printf("plugin-zigbee2mqtt: [%s] subscribed to %s", in.label(), stateTopic)
 	}
+	// Availability and attributes topics outside the base topic.
+	in.subscribeForeign(client, in.foreignTopics())
+
+	// Birth message — overrides the retained Last Will from a previous session.
+	in.publishStatus(client, statusOnline)
+
+	// Send whatever was commanded while the broker was unreachable.
+	in.drainQueue(client)
+}
+
+// publishStatus publishes the plugin availability as a retained message on
+// the configured status topic.
+func (in *instance) publishStatus(client mqtt.Client, status string) {
+	if in.cfg.StatusTopic == "" {
+		return
+	}
+	token := client.Publish(in.cfg.StatusTopic, 1, true, status)
+	token.WaitTimeout(5 * time.Second)
+	if token.Error() != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to publish %s to %s: %v", status, in.cfg.StatusTopic, token.Error())
+		return
+	}
+	log.Printf("plugin-zigbee2mqtt: published %s to %s", status, in.cfg.StatusTopic)
 }
 
 // onMQTTDisconnect is called when MQTT connection is lost
-func (p *plugin) onMQTTDisconnect(client mqtt.Client, err error) {
-	log.Printf("plugin-zigbee2mqtt: MQTT disconnected: %v", err)
-	log.Println("plugin-zigbee2mqtt: will auto-reconnect...")
+func (in *instance) onMQTTDisconnect(client mqtt.Client, err error) {
+	log.Printf("plugin-zigbee2mqtt: [%s] MQTT disconnected: %v", in.label(), err)
+	in.bridgeDisconnected(err)
+	in.cancelReconcile()
+	log.Printf("plugin-zigbee2mqtt: [%s] will auto-reconnect...", in.label())
+}
+
+// onConnectionNotification records failed connection attempts. With
+// connect retry on, paho keeps retrying without completing the Connect
+// token, so this is where a broker that can't be reached gets reported.
+func (in *instance) onConnectionNotification(_ mqtt.Client, n mqtt.ConnectionNotification) {
+	if failed, ok := n.(mqtt.ConnectionNotificationFailed); ok {
+		log.Printf("plugin-zigbee2mqtt: [%s] MQTT connect attempt: %v", in.label(), failed.Reason)
+		in.bridgeDisconnected(failed.Reason)
+	}
 }
 
 // handleDiscoveryMessage processes HA discovery messages
-func (p *plugin) handleDiscoveryMessage(client mqtt.Client, msg mqtt.Message) {
+func (in *instance) handleDiscoveryMessage(client mqtt.Client, msg mqtt.Message) {
+	p := in.p
 	topic := msg.Topic()
 	payload := msg.Payload()
 
-	// Parse discovery topic: homeassistant/<domain>/<deviceID>[/<subID>]/config
-	entityType, deviceID, entityID, ok := parseDiscoveryTopic(topic)
+	// Parse discovery topic: homeassistant/<domain>/<nodeID>[/<subID>]/config
+	entityType, nodeID, entityID, ok := parseDiscoveryTopic(topic)
 	if !ok {
 		return // Not a discovery message
 	}
+	if entityType == deviceDiscoveryType {
+		configID := nodeID
+		if entityID != entityType {
+			configID += "/" + entityID
+		}
+		in.handleDeviceDiscovery(configID, payload)
+		return
+	}
+
+	// Z2M removes an entity by clearing its retained discovery config.
+	if len(bytes.TrimSpace(payload)) == 0 {
+		deviceID := in.deviceID(in.nodeDevice(nodeID))
+		key := domain.EntityKey{Plugin: pluginID, DeviceID: deviceID, ID: entityID}
+		if info, err := p.getTopicInfo(key); err == nil && info.Native {
+			return
+		}
+		in.markSeen(key, false)
+		in.removeEntity(key, "discovery config cleared")
+		return
+	}
 
 	// Parse discovery payload to get topics
 	var discovery DiscoveryPayload
@@ -303,6 +741,24 @@ func (p *plugin) handleDiscoveryMessage(client mqtt.Client, msg mqtt.Message) {
 		log.Printf("plugin-zigbee2mqtt: failed to parse discovery for %s/%s: %v", entityType, entityID, err)
 		return
 	}
+	in.discoverEntity(nodeID, entityType, entityID, discovery, payload, "")
+}
+
+// discoverEntity stores the entity described by one discovery config.
+// deviceConfig is the ID of the device-based config it is a component of.
+func (in *instance) discoverEntity(nodeID, entityType, entityID string, discovery DiscoveryPayload, payload []byte, deviceConfig string) {
+	p := in.p
+
+	// Key devices on their IEEE address, which survives friendly-name
+	// renames; groups and other configs without one keep the node ID.
+	z2mDeviceID := nodeID
+	if deviceInfo, ok := discovery.DeviceInfo(); ok {
+		if ieee := ieeeAddress(deviceInfo); ieee != "" {
+			z2mDeviceID = ieee
+			in.rememberNode(nodeID, ieee)
+		}
+	}
+	deviceID := in.deviceID(z2mDeviceID)
 
 	// Log discovery with name for debugging
 	if discovery.Name != "" {
@@ -316,8 +772,54 @@ func (p *plugin) handleDiscoveryMessage(client mqtt.Client, msg mqtt.Message) {
 		DeviceID: deviceID,
 		ID:       entityID,
 	}
+	in.markSeen(entityKey, true)
+	if deviceID != in.deviceID(nodeID) {
+		in.migrateEntity(domain.EntityKey{Plugin: pluginID, DeviceID: in.deviceID(nodeID), ID: entityID}, entityKey)
+	}
+
+	// With discovery_mode "both", native discovery owns the entities it knows.
+	if info, err := p.getTopicInfo(entityKey); err == nil && info.Native {
+		return
+	}
 
 	entityName := resolveEntityName(discovery, entityType, entityID)
+	topicInfo := in.newTopicInfo(entityType, deviceID, entityName, discovery, payload)
+	topicInfo.DeviceConfig = deviceConfig
+	in.upsertEntity(entityKey, discovery, topicInfo)
+}
+
+// newTopicInfo builds the topic info of an entity from its discovery config.
+func (in *instance) newTopicInfo(entityType, deviceID, name string, discovery DiscoveryPayload, payload []byte) EntityTopicInfo {
+	valueField := extractValueField(discovery.ValueTemplate)
+	return EntityTopicInfo{
+		StateTopic:          discovery.StateTopic,
+		CommandTopic:        discovery.CommandTopic,
+		Availability:        discovery.AvailabilityTopic,
+		AvailabilitySources: availabilitySources(discovery),
+		AvailabilityMode:    discovery.AvailabilityMode,
+		AttributesTopic:     discovery.JSONAttributesTopic,
+		AttributesTemplate:  discovery.JSONAttributesTemplate,
+		Discovery:           json.RawMessage(payload),
+		EntityType:          entityType,
+		DeviceID:            deviceID,
+		FriendlyName:        name,
+		ValueField:          valueField,
+		Templates:           discoveryTemplates(entityType, discovery, valueField),
+		UnitOfMeasurement:   discovery.UnitOfMeasurement,
+		SensorDeviceClass:   discovery.DeviceClass,
+		Instance:            in.cfg.Name,
+	}
+}
+
+// upsertEntity creates the entity described by topicInfo, or refreshes its
+// type, name and commands, then stores the topic info and device record. A
+// name the user changed is kept; an entity the filters reject is removed.
+func (in *instance) upsertEntity(entityKey domain.EntityKey, discovery DiscoveryPayload, topicInfo EntityTopicInfo) {
+	p := in.p
+	if !in.admit(entityKey, discovery, topicInfo) {
+		return
+	}
+	entityType, entityName := topicInfo.EntityType, topicInfo.FriendlyName
 
 	// Check if entity already exists
 	existingRaw, err := p.store.Get(entityKey)
@@ -326,24 +828,30 @@ func (p *plugin) handleDiscoveryMessage(client mqtt.Client, msg mqtt.Message) {
 		var existingEntity domain.Entity
 		if err := json.Unmarshal(existingRaw, &existingEntity); err == nil {
 			existingEntity.Type = entityType
-			existingEntity.Name = entityName
+			if !in.customName(entityKey, existingEntity.Name) {
+				existingEntity.Name = entityName
+			}
 			existingEntity.Commands = p.getCommandsForType(entityType)
-			p.store.Save(existingEntity)
+			// Refresh metadata from discovery but keep the enabled state
+			// and the last known availability.
+			existingMeta := readEntityMeta(existingRaw)
+			meta := discoveryMeta(discovery)
+			meta.Disabled = existingMeta.Disabled
+			if topicInfo.AttributesTopic != "" {
+				meta.Attributes = existingMeta.Attributes
+			}
+			if len(topicInfo.AvailabilitySources) > 0 {
+				meta.Available = existingMeta.Available
+				if meta.Available == nil {
+					meta.Available = new(bool)
+				}
+			}
+			p.saveEntity(existingEntity, meta)
 		}
 
-		topicInfo := EntityTopicInfo{
-			StateTopic:        discovery.StateTopic,
-			CommandTopic:      discovery.CommandTopic,
-			Availability:      discovery.AvailabilityTopic,
-			Discovery:         json.RawMessage(payload),
-			EntityType:        entityType,
-			DeviceID:          deviceID,
-			FriendlyName:      entityName,
-			ValueField:        extractValueField(discovery.ValueTemplate),
-			UnitOfMeasurement: discovery.UnitOfMeasurement,
-			SensorDeviceClass: discovery.DeviceClass,
-		}
-		p.saveTopicInfo(entityKey, topicInfo)
+		in.saveTopicInfo(entityKey, topicInfo)
+		deviceInfo, _ := discovery.DeviceInfo()
+		in.saveDevice(entityKey.DeviceID, deviceInfo, entityKey.ID)
 
 		log.Printf("plugin-zigbee2mqtt: updated entity %s (%s)", entityKey.Key(), entityName)
 		return
@@ -351,33 +859,26 @@ func (p *plugin) handleDiscoveryMessage(client mqtt.Client, msg mqtt.Message) {
 
 	// Create new entity from discovery
 	entity := domain.Entity{
-		ID:       entityID,
+		ID:       entityKey.ID,
 		Plugin:   pluginID,
-		DeviceID: deviceID,
+		DeviceID: entityKey.DeviceID,
 		Type:     entityType,
 		Name:     entityName,
 		Commands: p.getCommandsForType(entityType),
 		State:    nil, // Will be populated when state message arrives
 	}
 
-	if err := p.store.Save(entity); err != nil {
+	// Entities with an availability config are unavailable until it reports.
+	meta := discoveryMeta(discovery)
+	meta.Available = in.effectiveAvailability(entityKey, topicInfo)
+	if err := p.saveEntity(entity, meta); err != nil {
 		log.Printf("plugin-zigbee2mqtt: failed to save entity %s: %v", entityKey.Key(), err)
 		return
 	}
 
-	topicInfo := EntityTopicInfo{
-		StateTopic:        discovery.StateTopic,
-		CommandTopic:      discovery.CommandTopic,
-		Availability:      discovery.AvailabilityTopic,
-		Discovery:         json.RawMessage(payload),
-		EntityType:        entityType,
-		DeviceID:          deviceID,
-		FriendlyName:      entityName,
-		ValueField:        extractValueField(discovery.ValueTemplate),
-		UnitOfMeasurement: discovery.UnitOfMeasurement,
-		SensorDeviceClass: discovery.DeviceClass,
-	}
-	p.saveTopicInfo(entityKey, topicInfo)
+	in.saveTopicInfo(entityKey, topicInfo)
+	deviceInfo, _ := discovery.DeviceInfo()
+	in.saveDevice(entityKey.DeviceID, deviceInfo, entityKey.ID)
 
 	log.Printf("plugin-zigbee2mqtt: created entity %s (%s)", entityKey.Key(), entityName)
 }
@@ -386,25 +887,50 @@ func (p *plugin) handleDiscoveryMessage(client mqtt.Client, msg mqtt.Message) {
 // Multiple entities can share the same Z2M state topic (e.g. a light and its
 // update_available sensor both subscribe to zigbee2mqtt/<device>). We find all
 // matching entities via the in-memory stateTopicIndex built during discovery.
-func (p *plugin) handleStateMessage(client mqtt.Client, msg mqtt.Message) {
+func (in *instance) handleStateMessage(client mqtt.Client, msg mqtt.Message) {
+	p := in.p
 	topic := msg.Topic()
 	payload := msg.Payload()
 
+	in.handleAvailability(topic, payload)
+	in.handleAttributes(topic, payload)
+
+	if topic == in.cfg.BaseTopic+"/bridge/state" {
+		in.handleBridgeState(payload)
+		return
+	}
+	if topic == in.cfg.BaseTopic+"/bridge/event" {
+		in.handleBridgeEvent(payload)
+		return
+	}
+	if topic == in.cfg.BaseTopic+"/bridge/devices" {
+		in.handleBridgeDevices(payload)
+		return
+	}
+	if topic == in.cfg.BaseTopic+"/bridge/response/device/rename" {
+		in.handleRenameResponse(payload)
+		return
+	}
+
 	// Skip bridge system messages (not device state updates)
 	if strings.Contains(topic, "/bridge/") {
 		return
 	}
 
-	p.mu.RLock()
-	keys := p.stateTopicIndex[topic]
-	p.mu.RUnlock()
+	in.mu.RLock()
+	keys := slices.Clone(in.stateTopicIndex[topic])
+	in.mu.RUnlock()
 
 	if len(keys) == 0 {
 		return
 	}
 
 	updated := 0
+	var devices []string
 	for _, key := range keys {
+		if !slices.Contains(devices, key.DeviceID) {
+			devices = append(devices, key.DeviceID)
+		}
 		topicInfo, err := p.getTopicInfo(key)
 		if err != nil {
 			continue
@@ -417,17 +943,31 @@ func (p *plugin) handleStateMessage(client mqtt.Client, msg mqtt.Message) {
 		if err := json.Unmarshal(raw, &entity); err != nil {
 			continue
 		}
-		state, ok := DecodeWithMeta(entity.Type, payload, topicInfo.ValueField, topicInfo.UnitOfMeasurement, topicInfo.SensorDeviceClass)
-		if !ok {
+		// Z2M points json_attributes_topic at the state topic; store both
+		// in one write.
+		meta := readEntityMeta(raw)
+		attrsChanged := p.applyAttributes(key, &meta, topicInfo, topic, payload)
+		var state any
+		data, ok := nativeState(topicInfo, payload)
+		if ok {
+			data, ok = p.templateState(key, topicInfo, data)
+		}
+		if ok {
+			state, ok = DecodeWithMeta(entity.Type, data, topicInfo.stateField(), topicInfo.UnitOfMeasurement, topicInfo.SensorDeviceClass)
+		}
+		if !ok && !attrsChanged {
 			continue
 		}
-		entity.State = state
-		if err := p.store.Save(entity); err != nil {
+		if ok {
+			entity.State = state
+		}
+		if err := p.saveEntity(entity, meta); err != nil {
 			log.Printf("plugin-zigbee2mqtt: failed to update entity %s: %v", key.Key(), err)
 			continue
 		}
 		updated++
 	}
+	p.updateHealth(devices, payload)
 	if updated > 0 {
 		log.Printf("plugin-zigbee2mqtt: state update on %s — updated %d entities", topic, updated)
 	}
@@ -447,23 +987,116 @@ func (p *plugin) getTopicInfo(key domain.EntityKey) (EntityTopicInfo, error) {
 }
 
 // saveTopicInfo stores topic mappings in internal storage
-func (p *plugin) saveTopicInfo(key domain.EntityKey, info EntityTopicInfo) error {
+func (in *instance) saveTopicInfo(key domain.EntityKey, info EntityTopicInfo) error {
 	data, err := json.Marshal(info)
 	if err != nil {
 		return err
 	}
-	if err := p.store.WriteFile(storage.Internal, key, data); err != nil {
+	if err := in.p.store.WriteFile(storage.Internal, key, data); err != nil {
 		return err
 	}
-	// Index the state topic for fast lookup in handleStateMessage.
-	if info.StateTopic != "" {
-		p.mu.Lock()
-		p.stateTopicIndex[info.StateTopic] = appendUniqueKey(p.stateTopicIndex[info.StateTopic], key)
-		p.mu.Unlock()
+	in.p.templates.forget(key)
+	// Index the state topic for fast lookup in handleStateMessage. A renamed
+	// device moves to a new topic, so drop the key from the old one.
+	in.mu.Lock()
+	subscribe := in.indexLocked(key, info)
+	in.mu.Unlock()
+	if len(subscribe) > 0 {
+		// Discovery runs on the paho inbound goroutine; don't block it.
+		slices.Sort(subscribe)
+		go in.subscribeForeign(in.mqtt, slices.Compact(subscribe))
 	}
 	return nil
 }
 
+// indexLocked points the state, availability and attributes topics of info
+// at key, dropping it from the topics it was indexed under before. It
+// returns the topics outside the base topic that need a subscription.
+// Callers hold mu.
+func (in *instance) indexLocked(key domain.EntityKey, info EntityTopicInfo) []string {
+	in.unindexLocked(key, info.StateTopic)
+	if info.StateTopic != "" {
+		in.stateTopicIndex[info.StateTopic] = appendUniqueKey(in.stateTopicIndex[info.StateTopic], key)
+	}
+	subscribe := in.indexAvailabilityLocked(key, info)
+	subscribe = append(subscribe, in.indexAttributesLocked(key, info)...)
+	in.indexed[key] = info
+	return subscribe
+}
+
+// unindexLocked removes key from its state topic unless that is keep.
+// Callers hold mu.
+func (in *instance) unindexLocked(key domain.EntityKey, keep string) {
+	if topic := in.indexed[key].StateTopic; topic != keep {
+		dropKey(in.stateTopicIndex, topic, key)
+	}
+}
+
+// deleteTopicInfo removes an entity's topic mappings from internal storage
+// and from the state topic index.
+func (in *instance) deleteTopicInfo(key domain.EntityKey) error {
+	in.mu.Lock()
+	in.unindexLocked(key, "")
+	in.unindexAvailabilityLocked(key)
+	in.unindexAttributesLocked(key)
+	delete(in.indexed, key)
+	delete(in.availability, key)
+	delete(in.available, key)
+	in.mu.Unlock()
+	in.p.templates.forget(key)
+	return in.p.store.DeleteFile(storage.Internal, key)
+}
+
+// removeEntity deletes an entity together with its topic mappings and
+// publishes an entity_removed event. Unknown entities are ignored.
+func (in *instance) removeEntity(key domain.EntityKey, reason string) {
+	p := in.p
+	in.forgetCandidate(key)
+	_, entityErr := p.store.Get(key)
+	_, infoErr := p.getTopicInfo(key)
+	if entityErr != nil && infoErr != nil {
+		return
+	}
+
+	if entityErr == nil {
+		if err := p.store.Delete(key); err != nil {
+			log.Printf("plugin-zigbee2mqtt: failed to delete entity %s: %v", key.Key(), err)
+			return
+		}
+	}
+	if err := in.deleteTopicInfo(key); err != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to delete topic info %s: %v", key.Key(), err)
+	}
+	p.unlinkDevice(key)
+
+	log.Printf("plugin-zigbee2mqtt: removed entity %s (%s)", key.Key(), reason)
+	p.publishEvent(eventEntityRemoved, EntityRemovedEvent{
+		Entity:   key.Key(),
+		Instance: in.cfg.Name,
+		Reason:   reason,
+	})
+}
+
+// dropKey removes key from the entities of topic in index. It builds a new
+// slice, so readers still holding the old one are unaffected.
+func dropKey(index map[string][]domain.EntityKey, topic string, key domain.EntityKey) {
+	keys := index[topic]
+	if !slices.Contains(keys, key) {
+		return
+	}
+	kept := make([]domain.EntityKey, 0, len(keys)-1)
+	for _, k := range keys {
+		if k != key {
+			kept = append(kept, k)
+		}
+	}
+	if len(kept) == 0 {
+		delete(index, topic)
+	} else {
+		index[topic] = kept
+	}
+}
+
 func appendUniqueKey(keys []domain.EntityKey, key domain.EntityKey) []domain.EntityKey {
 	for _, k := range keys {
 		if k == key {
@@ -502,9 +1135,10 @@ func (p *plugin) getCommandsForType(entityType string) []string {
 }
 
 func (p *plugin) OnShutdown() error {
-	// Disconnect MQTT
-	if p.mqtt != nil && p.mqtt.IsConnected() {
-		p.mqtt.Disconnect(250)
+	// Announce a clean shutdown and disconnect MQTT
+	for _, in := range p.runningInstances() {
+		in.disconnect()
+		in.failQueued("plugin shutting down")
 	}
 
 	// Unsubscribe from messenger
@@ -552,12 +1186,13 @@ func (p *plugin) handleCommand(addr messenger.Address, cmd any) {
 		log.Printf("plugin-zigbee2mqtt: failed to parse entity %s: %v", addr.Key(), err)
 		return
 	}
+	meta := readEntityMeta(raw)
 
 	// Get topic info for command publishing
 	topicInfo, err := p.getTopicInfo(entityKey)
 	if err != nil {
 		log.Printf("plugin-zigbee2mqtt: no topic info for %s: %v", addr.Key(), err)
-		// Continue to log commands even if we can't publish (for testing)
+		// Without a command topic the command is reported as failed below.
 	}
 
 	// Encode command to Z2M JSON
@@ -571,23 +1206,70 @@ func (p *plugin) handleCommand(addr messenger.Address, cmd any) {
 		log.Printf("plugin-zigbee2mqtt: failed to encode command %T: %v", cmd, err)
 		return
 	}
+	payload = nativeCommand(topicInfo, payload)
+	payload, err = p.commandTemplate(entityKey, topicInfo, cmd, payload)
+	if err != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to render command_template for %s: %v", addr.Key(), err)
+		return
+	}
 
 	// Publish to MQTT if connected
 	cmdType := fmt.Sprintf("%T", cmd)
 	log.Printf("plugin-zigbee2mqtt: [CMD] entity=%s type=%s payload=%s", addr.Key(), cmdType, string(payload))
-	if p.mqtt != nil && p.mqtt.IsConnected() && topicInfo.CommandTopic != "" {
+	in := p.instance(topicInfo.Instance)
+	var pending *queuedCommand
+	if in != nil && in.mqtt != nil && in.mqtt.IsConnected() && topicInfo.CommandTopic != "" {
 		payloadBytes := []byte(string(payload))
 		publishStart := time.Now()
-		token := p.mqtt.Publish(topicInfo.CommandTopic, 0, false, payloadBytes)
+		token := publishCommand(in.mqtt, topicInfo.CommandTopic, in.cfg.CommandQoS, payloadBytes)
 		acked := token.WaitTimeout(5 * time.Second)
 		elapsed := time.Since(publishStart)
-		if token.Error() != nil {
-			log.Printf("plugin-zigbee2mqtt: [CMD] FAIL topic=%s elapsed=%s ack=%v err=%v", topicInfo.CommandTopic, elapsed.Round(time.Millisecond), acked, token.Error())
-		} else {
-			log.Printf("plugin-zigbee2mqtt: [CMD] OK   topic=%s elapsed=%s ack=%v", topicInfo.CommandTopic, elapsed.Round(time.Millisecond), acked)
+		// MQTT 5 brokers say why they refused a publish in its reason code.
+		reason := publishReason(token)
+		failure := ""
+		switch {
+		case token.Error() != nil:
+			failure = token.Error().Error()
+		case !acked:
+			failure = "publish not acknowledged"
+		}
+		if failure != "" {
+			// The device never got the command, so don't pretend it did:
+			// skip the optimistic update and report it like a queued failure.
+			log.Printf("plugin-zigbee2mqtt: [CMD] FAIL topic=%s elapsed=%s ack=%v%s err=%s", topicInfo.CommandTopic, elapsed.Round(time.Millisecond), acked, reason, failure)
+			p.failCommand(queuedCommand{
+				key:      entityKey,
+				cmdType:  cmdType,
+				topic:    topicInfo.CommandTopic,
+				payload:  payloadBytes,
+				queuedAt: recvAt,
+			}, failure)
+			return
 		}
+		log.Printf("plugin-zigbee2mqtt: [CMD] OK   topic=%s elapsed=%s ack=%v%s", topicInfo.CommandTopic, elapsed.Round(time.Millisecond), acked, reason)
+	} else if in != nil && in.mqtt != nil && topicInfo.CommandTopic != "" {
+		// Broker configured but unreachable: hold the command until paho
+		// reconnects. The optimistic update below is rolled back if it expires.
+		pending = &queuedCommand{
+			key:       entityKey,
+			cmdType:   cmdType,
+			topic:     topicInfo.CommandTopic,
+			payload:   []byte(payload),
+			queuedAt:  recvAt,
+			expiresAt: recvAt.Add(in.cfg.commandTTL()),
+			prevState: entity.State,
+		}
+		log.Printf("plugin-zigbee2mqtt: [CMD] QUEUE entity=%s (MQTT not connected)", addr.Key())
 	} else {
-		log.Printf("plugin-zigbee2mqtt: [CMD] SKIP entity=%s (MQTT not connected)", addr.Key())
+		// Nothing will ever carry this command to the device, so leave the
+		// stored state alone and report the failure.
+		failure := "MQTT not connected"
+		if topicInfo.CommandTopic == "" {
+			failure = "no command topic"
+		}
+		log.Printf("plugin-zigbee2mqtt: [CMD] SKIP entity=%s (%s)", addr.Key(), failure)
+		p.failCommand(queuedCommand{key: entityKey, cmdType: cmdType, payload: []byte(payload), queuedAt: recvAt}, failure)
+		return
 	}
 
 	// Update local entity state optimistically (optional)
@@ -598,14 +1280,14 @@ func (p *plugin) handleCommand(addr messenger.Address, cmd any) {
 		if light, ok := entity.State.(domain.Light); ok {
 			light.Power = true
 			entity.State = light
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.LightTurnOff:
 		log.Printf("plugin-zigbee2mqtt: light %s turn_off", addr.Key())
 		if light, ok := entity.State.(domain.Light); ok {
 			light.Power = false
 			entity.State = light
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.LightSetBrightness:
 		log.Printf("plugin-zigbee2mqtt: light %s set_brightness brightness=%d", addr.Key(), c.Brightness)
@@ -613,7 +1295,7 @@ func (p *plugin) handleCommand(addr messenger.Address, cmd any) {
 			light.Power = true
 			light.Brightness = c.Brightness
 			entity.State = light
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.LightSetColorTemp:
 		log.Printf("plugin-zigbee2mqtt: light %s set_color_temp mireds=%d", addr.Key(), c.Mireds)
@@ -623,7 +1305,7 @@ func (p *plugin) handleCommand(addr messenger.Address, cmd any) {
 				light.Brightness = c.Brightness
 			}
 			entity.State = light
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.LightSetRGB:
 		log.Printf("plugin-zigbee2mqtt: light %s set_rgb r=%d g=%d b=%d", addr.Key(), c.R, c.G, c.B)
@@ -634,7 +1316,7 @@ func (p *plugin) handleCommand(addr messenger.Address, cmd any) {
 				light.Brightness = c.Brightness
 			}
 			entity.State = light
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.LightSetRGBW:
 		log.Printf("plugin-zigbee2mqtt: light %s set_rgbw r=%d g=%d b=%d w=%d", addr.Key(), c.R, c.G, c.B, c.W)
@@ -645,7 +1327,7 @@ func (p *plugin) handleCommand(addr messenger.Address, cmd any) {
 				light.Brightness = c.Brightness
 			}
 			entity.State = light
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.LightSetRGBWW:
 		log.Printf("plugin-zigbee2mqtt: light %s set_rgbww r=%d g=%d b=%d cw=%d ww=%d", addr.Key(), c.R, c.G, c.B, c.CW, c.WW)
@@ -656,7 +1338,7 @@ func (p *plugin) handleCommand(addr messenger.Address, cmd any) {
 				light.Brightness = c.Brightness
 			}
 			entity.State = light
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.LightSetHS:
 		log.Printf("plugin-zigbee2mqtt: light %s set_hs hue=%.1f sat=%.1f", addr.Key(), c.Hue, c.Saturation)
@@ -671,77 +1353,77 @@ func (p *plugin) handleCommand(addr messenger.Address, cmd any) {
 		if sw, ok := entity.State.(domain.Switch); ok {
 			sw.Power = true
 			entity.State = sw
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.SwitchTurnOff:
 		log.Printf("plugin-zigbee2mqtt: switch %s turn_off", addr.Key())
 		if sw, ok := entity.State.(domain.Switch); ok {
 			sw.Power = false
 			entity.State = sw
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.SwitchToggle:
 		log.Printf("plugin-zigbee2mqtt: switch %s toggle", addr.Key())
 		if sw, ok := entity.State.(domain.Switch); ok {
 			sw.Power = !sw.Power
 			entity.State = sw
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.FanTurnOn:
 		log.Printf("plugin-zigbee2mqtt: fan %s turn_on", addr.Key())
 		if fan, ok := entity.State.(domain.Fan); ok {
 			fan.Power = true
 			entity.State = fan
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.FanTurnOff:
 		log.Printf("plugin-zigbee2mqtt: fan %s turn_off", addr.Key())
 		if fan, ok := entity.State.(domain.Fan); ok {
 			fan.Power = false
 			entity.State = fan
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.FanSetSpeed:
 		log.Printf("plugin-zigbee2mqtt: fan %s set_speed percentage=%d", addr.Key(), c.Percentage)
 		if fan, ok := entity.State.(domain.Fan); ok {
 			fan.Percentage = c.Percentage
 			entity.State = fan
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.CoverOpen:
 		log.Printf("plugin-zigbee2mqtt: cover %s open", addr.Key())
 		if cover, ok := entity.State.(domain.Cover); ok {
 			cover.Position = 100
 			entity.State = cover
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.CoverClose:
 		log.Printf("plugin-zigbee2mqtt: cover %s close", addr.Key())
 		if cover, ok := entity.State.(domain.Cover); ok {
 			cover.Position = 0
 			entity.State = cover
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.CoverSetPosition:
 		log.Printf("plugin-zigbee2mqtt: cover %s set_position pos=%d", addr.Key(), c.Position)
 		if cover, ok := entity.State.(domain.Cover); ok {
 			cover.Position = c.Position
 			entity.State = cover
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.LockLock:
 		log.Printf("plugin-zigbee2mqtt: lock %s lock", addr.Key())
 		if lock, ok := entity.State.(domain.Lock); ok {
 			lock.Locked = true
 			entity.State = lock
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.LockUnlock:
 		log.Printf("plugin-zigbee2mqtt: lock %s unlock", addr.Key())
 		if lock, ok := entity.State.(domain.Lock); ok {
 			lock.Locked = false
 			entity.State = lock
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.ButtonPress:
 		log.Printf("plugin-zigbee2mqtt: button %s press", addr.Key())
@@ -750,40 +1432,45 @@ func (p *plugin) handleCommand(addr messenger.Address, cmd any) {
 		if num, ok := entity.State.(domain.Number); ok {
 			num.Value = c.Value
 			entity.State = num
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.SelectOption:
 		log.Printf("plugin-zigbee2mqtt: select %s set_option option=%s", addr.Key(), c.Option)
 		if sel, ok := entity.State.(domain.Select); ok {
 			sel.Option = c.Option
 			entity.State = sel
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.TextSetValue:
 		log.Printf("plugin-zigbee2mqtt: text %s set_value value=%s", addr.Key(), c.Value)
 		if txt, ok := entity.State.(domain.Text); ok {
 			txt.Value = c.Value
 			entity.State = txt
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.ClimateSetMode:
 		log.Printf("plugin-zigbee2mqtt: climate %s set_mode mode=%s", addr.Key(), c.HVACMode)
 		if climate, ok := entity.State.(domain.Climate); ok {
 			climate.HVACMode = c.HVACMode
 			entity.State = climate
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	case domain.ClimateSetTemperature:
 		log.Printf("plugin-zigbee2mqtt: climate %s set_temperature temp=%v", addr.Key(), c.Temperature)
 		if climate, ok := entity.State.(domain.Climate); ok {
 			climate.Temperature = c.Temperature
 			entity.State = climate
-			p.store.Save(entity)
+			p.saveEntity(entity, meta)
 		}
 	default:
 		log.Printf("plugin-zigbee2mqtt: unknown command %T for %s", cmd, addr.Key())
 	}
 
+	// Queue only once the optimistic state is saved, so a failure rolls it back.
+	if pending != nil {
+		in.enqueueCommand(*pending)
+	}
+
 	log.Printf("plugin-zigbee2mqtt: [CMD] DONE entity=%s type=%T total=%s", addr.Key(), cmd, time.Since(recvAt).Round(time.Millisecond))
 }
 
@@ -791,27 +1478,33 @@ func (p *plugin) handleCommand(addr messenger.Address, cmd any) {
 // Demo device — a sample device registered at startup
 // ---------------------------------------------------------------------------
 
-func (p *plugin) seedDemo() error {
-	entities := []domain.Entity{
+// demoEntities is the fake device seeded in demo mode.
+func demoEntities() []domain.Entity {
+	return []domain.Entity{
 		{
-			ID: "demo_light", Plugin: pluginID, DeviceID: "demo_device",
+			ID: "demo_light", Plugin: pluginID, DeviceID: demoDeviceID,
 			Type: "light", Name: "Demo Light",
 			Commands: []string{"light_turn_on", "light_turn_off", "light_set_brightness", "light_set_color_temp"},
 			State:    domain.Light{Power: false, Brightness: 128},
 		},
 		{
-			ID: "demo_switch", Plugin: pluginID, DeviceID: "demo_device",
+			ID: "demo_switch", Plugin: pluginID, DeviceID: demoDeviceID,
 			Type: "switch", Name: "Demo Switch",
 			Commands: []string{"switch_turn_on", "switch_turn_off", "switch_toggle"},
 			State:    domain.Switch{Power: false},
 		},
 		{
-			ID: "demo_sensor", Plugin: pluginID, DeviceID: "demo_device",
+			ID: "demo_sensor", Plugin: pluginID, DeviceID: demoDeviceID,
 			Type: "sensor", Name: "Demo Temperature",
 			State: domain.Sensor{Value: 21.0, Unit: "°C"},
 		},
 	}
-	for _, e := range entities {
+}
+
+const demoDeviceID = "demo_device"
+
+func (p *plugin) seedDemo() error {
+	for _, e := range demoEntities() {
 		if err := p.store.Save(e); err != nil {
 			return fmt.Errorf("save %s: %w", e.ID, err)
 		}
@@ -819,6 +1512,23 @@ func (p *plugin) seedDemo() error {
 	return nil
 }
 
+// removeDemo deletes the demo device, if present.
+func (p *plugin) removeDemo() {
+	if p.store == nil {
+		return
+	}
+	for _, e := range demoEntities() {
+		if _, err := p.store.Get(e); err != nil {
+			continue
+		}
+		if err := p.store.Delete(e); err != nil {
+			log.Printf("plugin-zigbee2mqtt: failed to remove demo entity %s: %v", e.Key(), err)
+			continue
+		}
+		log.Printf("plugin-zigbee2mqtt: removed demo entity %s", e.Key())
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Entrypoint
 // ---------------------------------------------------------------------------
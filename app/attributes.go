@@ -0,0 +1,110 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"slices"
+	"strings"
+
+	domain "github.com/slidebolt/sb-domain"
+)
+
+// ---------------------------------------------------------------------------
+// Attributes — extra entity attributes from json_attributes_topic
+// ---------------------------------------------------------------------------
+
+// decodeAttributes decodes the attributes of a json_attributes_topic
+// message, rendered through its json_attributes_template when set. ok is
+// false unless they form a JSON object.
+func decodeAttributes(template string, payload []byte, render func(src string, payload []byte) (string, bool)) (map[string]json.RawMessage, bool) {
+	if strings.TrimSpace(template) != "" {
+		out, ok := render(template, payload)
+		if !ok {
+			return nil, false
+		}
+		payload = []byte(out)
+	}
+	var attrs map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &attrs); err != nil || attrs == nil {
+		return nil, false
+	}
+	return attrs, true
+}
+
+// applyAttributes stores the attributes a message on topic carries for the
+// entity key of info in meta. It reports whether they changed.
+func (p *plugin) applyAttributes(key domain.EntityKey, meta *EntityMeta, info EntityTopicInfo, topic string, payload []byte) bool {
+	if info.AttributesTopic == "" || info.AttributesTopic != topic {
+		return false
+	}
+	render := func(src string, payload []byte) (string, bool) {
+		return p.templates.renderJSON(key, src, payload)
+	}
+	attrs, ok := decodeAttributes(info.AttributesTemplate, payload, render)
+	if !ok {
+		return false
+	}
+	prev, _ := json.Marshal(meta.Attributes)
+	next, _ := json.Marshal(attrs)
+	if bytes.Equal(prev, next) {
+		return false
+	}
+	meta.Attributes = attrs
+	return true
+}
+
+// indexAttributesLocked points the attributes topic of info at key. It
+// returns the topic when it lies outside the base topic and needs a
+// subscription. Callers hold mu.
+func (in *instance) indexAttributesLocked(key domain.EntityKey, info EntityTopicInfo) []string {
+	in.unindexAttributesLocked(key)
+	topic := info.AttributesTopic
+	if topic == "" {
+		return nil
+	}
+	var subscribe []string
+	if !in.underBaseTopic(topic) && !in.foreignSubscribedLocked(topic) {
+		subscribe = append(subscribe, topic)
+	}
+	in.attributesIndex[topic] = appendUniqueKey(in.attributesIndex[topic], key)
+	return subscribe
+}
+
+// unindexAttributesLocked removes key from its attributes topic. Callers
+// hold mu.
+func (in *instance) unindexAttributesLocked(key domain.EntityKey) {
+	dropKey(in.attributesIndex, in.indexed[key].AttributesTopic, key)
+}
+
+// handleAttributes applies a message on an attributes topic to the entities
+// that use it. Entities whose state topic it is are left to
+// handleStateMessage, which stores the attributes with the state.
+func (in *instance) handleAttributes(topic string, payload []byte) {
+	p := in.p
+	in.mu.RLock()
+	keys := slices.Clone(in.attributesIndex[topic])
+	in.mu.RUnlock()
+
+	for _, key := range keys {
+		info, err := p.getTopicInfo(key)
+		if err != nil || info.StateTopic == topic {
+			continue
+		}
+		raw, err := p.store.Get(key)
+		if err != nil {
+			continue
+		}
+		var entity domain.Entity
+		if err := json.Unmarshal(raw, &entity); err != nil {
+			continue
+		}
+		meta := readEntityMeta(raw)
+		if !p.applyAttributes(key, &meta, info, topic, payload) {
+			continue
+		}
+		if err := p.saveEntity(entity, meta); err != nil {
+			log.Printf("plugin-zigbee2mqtt: failed to update attributes of %s: %v", key.Key(), err)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	domain "github.com/slidebolt/sb-domain"
+)
+
+// ---------------------------------------------------------------------------
+// Availability — per-entity online/offline from the discovery availability
+// ---------------------------------------------------------------------------
+
+// Availability modes of a discovery config.
+const (
+	availabilityAll    = "all"
+	availabilityAny    = "any"
+	availabilityLatest = "latest"
+)
+
+const (
+	defaultPayloadAvailable    = "online"
+	defaultPayloadNotAvailable = "offline"
+)
+
+// AvailabilitySource is one topic an entity reports its availability on.
+// Template, when set, extracts the value compared with the payloads.
+type AvailabilitySource struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+	Template            string `json:"template,omitempty"`
+}
+
+// EntityAvailabilityEvent reports an entity going online or offline.
+type EntityAvailabilityEvent struct {
+	Entity    string `json:"entity"`
+	Instance  string `json:"instance,omitempty"`
+	Available bool   `json:"available"`
+}
+
+// availabilitySources collects the availability_topic and availability list
+// of a discovery config, with HA's default payloads filled in.
+func availabilitySources(d DiscoveryPayload) []AvailabilitySource {
+	payload := func(raw json.RawMessage, def string) string {
+		if len(raw) == 0 {
+			return def
+		}
+		return d.GetPayloadString(raw)
+	}
+	var sources []AvailabilitySource
+	if d.AvailabilityTopic != "" {
+		sources = append(sources, AvailabilitySource{
+			Topic:               d.AvailabilityTopic,
+			PayloadAvailable:    payload(d.PayloadAvailable, defaultPayloadAvailable),
+			PayloadNotAvailable: payload(d.PayloadNotAvailable, defaultPayloadNotAvailable),
+			Template:            d.AvailabilityTemplate,
+		})
+	}
+	for _, a := range d.Availability {
+		if a.Topic == "" {
+			continue
+		}
+		sources = append(sources, AvailabilitySource{
+			Topic:               a.Topic,
+			PayloadAvailable:    payload(a.PayloadAvailable, defaultPayloadAvailable),
+			PayloadNotAvailable: payload(a.PayloadNotAvailable, defaultPayloadNotAvailable),
+			Template:            a.ValueTemplate,
+		})
+	}
+	return sources
+}
+
+// parse maps an availability message to available or not; ok is false for
+// payloads matching neither payload or templates that cannot be evaluated.
+// render evaluates the source's template against the message.
+func (s AvailabilitySource) parse(payload []byte, render func(src string, payload []byte) (string, bool)) (available, ok bool) {
+	value := strings.TrimSpace(string(payload))
+	if s.Template != "" {
+		if value, ok = render(s.Template, payload); !ok {
+			return false, false
+		}
+	}
+	switch value {
+	case s.PayloadAvailable:
+		return true, true
+	case s.PayloadNotAvailable:
+		return false, true
+	}
+	return false, false
+}
+
+// evaluateAvailability combines the values received per source topic: every
+// source must be available in mode all, one in mode any, and in mode latest
+// the last message decides. Sources not heard from yet count as unavailable.
+func evaluateAvailability(mode string, sources []AvailabilitySource, values map[string]bool, latest bool) bool {
+	switch mode {
+	case availabilityAll:
+		for _, src := range sources {
+			if !values[src.Topic] {
+				return false
+			}
+		}
+		return true
+	case availabilityAny:
+		for _, src := range sources {
+			if values[src.Topic] {
+				return true
+			}
+		}
+		return false
+	default:
+		return latest
+	}
+}
+
+// indexAvailabilityLocked points the availability topics of info at key and
+// drops key from topics it no longer uses. It returns the topics outside the
+// base topic that were not indexed before and need a subscription. Callers
+// hold mu.
+func (in *instance) indexAvailabilityLocked(key domain.EntityKey, info EntityTopicInfo) []string {
+	in.unindexAvailabilityLocked(key)
+	var subscribe []string
+	for _, src := range info.AvailabilitySources {
+		if !in.underBaseTopic(src.Topic) && !in.foreignSubscribedLocked(src.Topic) {
+			subscribe = append(subscribe, src.Topic)
+		}
+		in.availabilityIndex[src.Topic] = appendUniqueKey(in.availabilityIndex[src.Topic], key)
+	}
+	return subscribe
+}
+
+// unindexAvailabilityLocked removes key from its availability topics.
+// Callers hold mu.
+func (in *instance) unindexAvailabilityLocked(key domain.EntityKey) {
+	for _, src := range in.indexed[key].AvailabilitySources {
+		dropKey(in.availabilityIndex, src.Topic, key)
+	}
+}
+
+func (in *instance) underBaseTopic(topic string) bool {
+	return strings.HasPrefix(topic, in.cfg.BaseTopic+"/")
+}
+
+// foreignSubscribedLocked reports whether an entity already uses topic for
+// availability or attributes, so it is subscribed. Callers hold mu.
+func (in *instance) foreignSubscribedLocked(topic string) bool {
+	return len(in.availabilityIndex[topic]) > 0 || len(in.attributesIndex[topic]) > 0
+}
+
+// subscribeForeign subscribes to availability and attributes topics the
+// base topic wildcard does not cover. It must not run on the paho inbound
+// goroutine, which a subscription from a message callback would deadlock.
+func (in *instance) subscribeForeign(client mqtt.Client, topics []string) {
+	if client == nil || !client.IsConnected() {
+		return
+	}
+	for _, topic := range topics {
+		token := client.Subscribe(topic, in.cfg.StateQoS, in.handleStateMessage)
+		token.WaitTimeout(5 * time.Second)
+		if token.Error() != nil {
+			log.Printf("plugin-zigbee2mqtt: [%s] failed to subscribe to %s: %v", in.label(), topic, token.Error())
+		}
+	}
+}
+
+// foreignTopics returns the indexed availability and attributes topics
+// outside the base topic.
+func (in *instance) foreignTopics() []string {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	var topics []string
+	for _, index := range []map[string][]domain.EntityKey{in.availabilityIndex, in.attributesIndex} {
+		for topic := range index {
+			if !in.underBaseTopic(topic) {
+				topics = append(topics, topic)
+			}
+		}
+	}
+	slices.Sort(topics)
+	return slices.Compact(topics)
+}
+
+// handleAvailability applies a message on an availability topic to the
+// entities that use it.
+func (in *instance) handleAvailability(topic string, payload []byte) {
+	p := in.p
+	in.mu.RLock()
+	keys := slices.Clone(in.availabilityIndex[topic])
+	in.mu.RUnlock()
+
+	for _, key := range keys {
+		info, err := p.getTopicInfo(key)
+		if err != nil {
+			continue
+		}
+		if in.recordAvailability(key, info, topic, payload) {
+			in.writeAvailability(key, in.effectiveAvailability(key, info))
+		}
+	}
+}
+
+// recordAvailability stores the value of topic for key and re-evaluates the
+// entity's own availability. It reports false when the message carried none.
+func (in *instance) recordAvailability(key domain.EntityKey, info EntityTopicInfo, topic string, payload []byte) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	values := in.availability[key]
+	if values == nil {
+		values = make(map[string]bool)
+		in.availability[key] = values
+	}
+	latest, decided := false, false
+	for _, src := range info.AvailabilitySources {
+		if src.Topic != topic {
+			continue
+		}
+		render := func(src string, payload []byte) (string, bool) {
+			return in.p.templates.render(key, src, payload)
+		}
+		if v, ok := src.parse(payload, render); ok {
+			values[topic] = v
+			latest, decided = v, true
+			break
+		}
+	}
+	if !decided {
+		return false
+	}
+	in.available[key] = evaluateAvailability(info.AvailabilityMode, info.AvailabilitySources, values, latest)
+	return true
+}
+
+// effectiveAvailability is the availability flag stored for an entity:
+// false while the bridge is down, otherwise the entity's own availability,
+// or nil when its discovery config declares none.
+func (in *instance) effectiveAvailability(key domain.EntityKey, info EntityTopicInfo) *bool {
+	if in.bridgeDown() {
+		return new(bool)
+	}
+	if len(info.AvailabilitySources) == 0 {
+		return nil
+	}
+	in.mu.RLock()
+	available := in.available[key]
+	in.mu.RUnlock()
+	return &available
+}
+
+// writeAvailability stores the availability flag of an entity and publishes
+// an entity_availability event when it changed.
+func (in *instance) writeAvailability(key domain.EntityKey, available *bool) {
+	p := in.p
+	raw, err := p.store.Get(key)
+	if err != nil {
+		return
+	}
+	var entity domain.Entity
+	if err := json.Unmarshal(raw, &entity); err != nil {
+		return
+	}
+	meta := readEntityMeta(raw)
+	if (meta.Available == nil) == (available == nil) && (available == nil || *meta.Available == *available) {
+		return
+	}
+	meta.Available = available
+	if err := p.saveEntity(entity, meta); err != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to update availability of %s: %v", key.Key(), err)
+		return
+	}
+	if available != nil {
+		p.publishEvent(eventEntityAvailability, EntityAvailabilityEvent{
+			Entity:    key.Key(),
+			Instance:  in.cfg.Name,
+			Available: *available,
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	domain "github.com/slidebolt/sb-domain"
+	storage "github.com/slidebolt/sb-storage-sdk"
+)
+
+// ---------------------------------------------------------------------------
+// Bridge connection — diagnostic entity describing the link to Zigbee2MQTT
+// ---------------------------------------------------------------------------
+
+// bridgeConnectionType is the entity type of the per-instance diagnostic
+// entity plugin-zigbee2mqtt.bridge.connection.
+const bridgeConnectionType = "z2m_bridge_connection"
+
+const (
+	bridgeDeviceID     = "bridge"
+	bridgeConnectionID = "connection"
+)
+
+// BridgeConnection is the state of the bridge connection entity.
+type BridgeConnection struct {
+	// Connected reports whether the plugin is connected to the MQTT broker.
+	Connected   bool      `json:"connected"`
+	LastConnect time.Time `json:"last_connect,omitempty"`
+	// Reconnects counts successful connections after the first one.
+	Reconnects int    `json:"reconnects"`
+	LastError  string `json:"last_error,omitempty"`
+	// BridgeOnline mirrors <base_topic>/bridge/state, published by Z2M.
+	BridgeOnline bool `json:"bridge_online"`
+}
+
+func init() {
+	domain.Register(bridgeConnectionType, BridgeConnection{})
+}
+
+// bridgeStatus tracks one instance's BridgeConnection. While the broker is
+// down or Z2M reports itself offline, every entity of the instance is
+// unavailable.
+type bridgeStatus struct {
+	mu         sync.Mutex
+	state      BridgeConnection
+	connects   int
+	brokerDown bool
+	z2mOffline bool
+}
+
+// down reports whether Z2M is unreachable. Callers hold mu.
+func (s *bridgeStatus) down() bool {
+	return s.brokerDown || s.z2mOffline
+}
+
+// bridgeDown reports whether the instance's entities are cut off from Z2M.
+func (in *instance) bridgeDown() bool {
+	in.bridge.mu.Lock()
+	defer in.bridge.mu.Unlock()
+	return in.bridge.down()
+}
+
+func (in *instance) bridgeKey() domain.EntityKey {
+	return domain.EntityKey{Plugin: pluginID, DeviceID: in.deviceID(bridgeDeviceID), ID: bridgeConnectionID}
+}
+
+// updateBridge applies fn to the instance's bridge connection state and
+// saves the diagnostic entity.
+func (in *instance) updateBridge(fn func(s *bridgeStatus)) {
+	in.bridge.mu.Lock()
+	fn(in.bridge)
+	state := in.bridge.state
+	in.bridge.mu.Unlock()
+
+	if in.p.store == nil {
+		return
+	}
+	name := "Zigbee2MQTT Bridge"
+	if in.cfg.Name != "" {
+		name += " (" + in.cfg.Name + ")"
+	}
+	key := in.bridgeKey()
+	entity := domain.Entity{
+		ID:       key.ID,
+		Plugin:   key.Plugin,
+		DeviceID: key.DeviceID,
+		Type:     bridgeConnectionType,
+		Name:     name,
+		State:    state,
+	}
+	if err := in.p.store.Save(entity); err != nil {
+		log.Printf("plugin-zigbee2mqtt: [%s] failed to save bridge connection: %v", in.label(), err)
+	}
+}
+
+func (in *instance) bridgeConnected() {
+	var changed bool
+	in.updateBridge(func(s *bridgeStatus) {
+		if s.connects > 0 {
+			s.state.Reconnects++
+		}
+		s.connects++
+		s.state.Connected = true
+		s.state.LastConnect = time.Now()
+		changed = s.setDown(func() { s.brokerDown = false })
+	})
+	if changed {
+		in.applyBridgeAvailability()
+	}
+}
+
+// setDown applies fn to the down flags and reports whether down() changed.
+// Callers hold mu.
+func (s *bridgeStatus) setDown(fn func()) bool {
+	was := s.down()
+	fn()
+	return s.down() != was
+}
+
+// bridgeDisconnected records a lost or failed broker connection. Z2M is
+// unreachable without the broker, so the bridge is reported offline too.
+func (in *instance) bridgeDisconnected(err error) {
+	var changed bool
+	in.updateBridge(func(s *bridgeStatus) {
+		s.state.Connected = false
+		s.state.BridgeOnline = false
+		if err != nil {
+			s.state.LastError = err.Error()
+		}
+		changed = s.setDown(func() { s.brokerDown = true })
+	})
+	if changed {
+		in.applyBridgeAvailability()
+	}
+}
+
+// handleBridgeState records Z2M's own availability. Z2M publishes either a
+// bare "online"/"offline" or, since 1.29, {"state":"online"}.
+func (in *instance) handleBridgeState(payload []byte) {
+	state := strings.TrimSpace(string(payload))
+	var wrapped struct {
+		State string `json:"state"`
+	}
+	if json.Unmarshal(payload, &wrapped) == nil && wrapped.State != "" {
+		state = wrapped.State
+	}
+	online := state == statusOnline
+	log.Printf("plugin-zigbee2mqtt: [%s] Z2M bridge is %s", in.label(), state)
+	var reported, changed bool
+	in.updateBridge(func(s *bridgeStatus) {
+		s.state.BridgeOnline = online
+		reported = s.z2mOffline == online
+		changed = s.setDown(func() { s.z2mOffline = !online })
+	})
+	if changed {
+		in.applyBridgeAvailability()
+	}
+	// An offline/online pair is a Z2M restart.
+	if reported {
+		in.p.publishEvent(eventBridgeState, BridgeStateEvent{Instance: in.cfg.Name, Online: online})
+	}
+}
+
+// applyBridgeAvailability refreshes the availability flag of every entity
+// of the instance after the bridge went down or came back.
+func (in *instance) applyBridgeAvailability() {
+	if in.p.store == nil {
+		return
+	}
+	infos, err := in.topicInfos()
+	if err != nil {
+		log.Printf("plugin-zigbee2mqtt: [%s] failed to load topic info: %v", in.label(), err)
+		return
+	}
+	for key, info := range infos {
+		in.writeAvailability(key, in.effectiveAvailability(key, info))
+	}
+}
+
+// topicInfos returns the stored topic info of every entity of the instance.
+func (in *instance) topicInfos() (map[domain.EntityKey]EntityTopicInfo, error) {
+	entries, err := in.p.store.SearchFiles(storage.Internal, pluginID+".*.*")
+	if err != nil {
+		return nil, err
+	}
+	infos := make(map[domain.EntityKey]EntityTopicInfo)
+	for _, entry := range entries {
+		key, ok := parseEntityKey(entry.Key)
+		if !ok {
+			continue
+		}
+		var info EntityTopicInfo
+		if err := json.Unmarshal(entry.Data, &info); err != nil || info.Instance != in.cfg.Name {
+			continue
+		}
+		infos[key] = info
+	}
+	return infos, nil
+}
+
+// Z2M bridge/event types and interview statuses.
+const (
+	bridgeEventJoined    = "device_joined"
+	bridgeEventLeave     = "device_leave"
+	bridgeEventInterview = "device_interview"
+
+	interviewSuccessful = "successful"
+	interviewFailed     = "failed"
+)
+
+// handleBridgeEvent republishes the device lifecycle events Z2M reports on
+// <base_topic>/bridge/event. Announces and started interviews are dropped.
+func (in *instance) handleBridgeEvent(payload []byte) {
+	var ev struct {
+		Type string `json:"type"`
+		Data struct {
+			FriendlyName string `json:"friendly_name"`
+			IEEEAddress  string `json:"ieee_address"`
+			Status       string `json:"status"`
+			Supported    *bool  `json:"supported"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		log.Printf("plugin-zigbee2mqtt: [%s] failed to parse bridge event: %v", in.label(), err)
+		return
+	}
+
+	var name string
+	switch {
+	case ev.Type == bridgeEventJoined:
+		name = eventDeviceJoined
+	case ev.Type == bridgeEventLeave:
+		name = eventDeviceLeft
+	case ev.Type == bridgeEventInterview && ev.Data.Status == interviewSuccessful:
+		name = eventDeviceInterviewSuccessful
+	case ev.Type == bridgeEventInterview && ev.Data.Status == interviewFailed:
+		name = eventDeviceInterviewFailed
+	default:
+		return
+	}
+	if ev.Data.IEEEAddress == "" {
+		return
+	}
+
+	log.Printf("plugin-zigbee2mqtt: [%s] %s: %s (%s)", in.label(), name, ev.Data.FriendlyName, ev.Data.IEEEAddress)
+	in.p.publishEvent(name, BridgeDeviceEvent{
+		Instance:     in.cfg.Name,
+		Device:       in.deviceID(ev.Data.IEEEAddress),
+		IEEEAddress:  ev.Data.IEEEAddress,
+		FriendlyName: ev.Data.FriendlyName,
+		Supported:    ev.Data.Supported,
+	})
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"slices"
+	"strings"
+
+	translate "github.com/slidebolt/plugin-zigbee2mqtt/internal/translate"
+	domain "github.com/slidebolt/sb-domain"
+)
+
+// ---------------------------------------------------------------------------
+// Device-based discovery — one config per device with a cmps component map
+// ---------------------------------------------------------------------------
+
+// deviceDiscoveryType is the component of device-based discovery topics,
+// <prefix>/device/<id>/config.
+const deviceDiscoveryType = "device"
+
+// handleDeviceDiscovery fans a device-based discovery config out into one
+// entity per component, keyed on the component ID and inheriting the shared
+// device, origin and availability blocks. Components the config no longer
+// lists, or lists with only their platform, are removed.
+func (in *instance) handleDeviceDiscovery(configID string, payload []byte) {
+	if len(bytes.TrimSpace(payload)) == 0 {
+		in.dropComponents(configID, nil, "discovery config cleared")
+		return
+	}
+	components, err := translate.DeviceComponents(payload)
+	if err != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to parse device discovery for %s: %v", configID, err)
+		return
+	}
+
+	kept := make(map[string]bool)
+	for _, c := range components {
+		if c.Removed {
+			continue
+		}
+		var discovery DiscoveryPayload
+		if err := json.Unmarshal(c.Config, &discovery); err != nil {
+			log.Printf("plugin-zigbee2mqtt: failed to parse component %s of %s: %v", c.ID, configID, err)
+			continue
+		}
+		in.discoverEntity(configNodeID(configID), c.Platform, c.ID, discovery, c.Config, configID)
+		kept[c.ID] = true
+	}
+	in.dropComponents(configID, kept, "component removed")
+}
+
+// configNodeID is the node ID that keys the device of a device-based config
+// without an IEEE address. A config published under node_id/object_id has a
+// "/" in its ID, which is replaced so the ID is a single key segment like the
+// node ID of a per-component topic.
+func configNodeID(configID string) string {
+	return strings.ReplaceAll(configID, "/", "_")
+}
+
+// dropComponents removes the entities of the device-based config configID
+// that are not in kept.
+func (in *instance) dropComponents(configID string, kept map[string]bool, reason string) {
+	p := in.p
+	deviceID := in.deviceID(in.nodeDevice(configNodeID(configID)))
+	dev, ok := p.getDevice(deviceID)
+	if !ok {
+		return
+	}
+	for _, id := range slices.Clone(dev.Entities) {
+		if kept[id] {
+			continue
+		}
+		key := domain.EntityKey{Plugin: pluginID, DeviceID: deviceID, ID: id}
+		if info, err := p.getTopicInfo(key); err != nil || info.DeviceConfig != configID {
+			continue
+		}
+		in.markSeen(key, false)
+		in.removeEntity(key, reason)
+	}
+}
@@ -0,0 +1,227 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	messenger "github.com/slidebolt/sb-messenger-sdk"
+	storage "github.com/slidebolt/sb-storage-sdk"
+)
+
+// ---------------------------------------------------------------------------
+// Stored configuration and hot reload
+// ---------------------------------------------------------------------------
+
+// subjectConfigSet is the request/reply subject that replaces the running
+// configuration. The request body is a Config; the reply is a configReply.
+const subjectConfigSet = pluginID + ".config.set"
+
+// configKey addresses the persisted Config. It lives in the plugin-private
+// storage target because it carries broker credentials.
+type configKey struct{}
+
+func (configKey) Key() string { return pluginID }
+
+type configReply struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// loadStoredConfig returns the Config persisted by a previous config.set,
+// or ok=false when none has been stored yet.
+func (p *plugin) loadStoredConfig() (cfg Config, ok bool, err error) {
+	data, err := p.store.ReadFile(storage.Private, configKey{})
+	if err != nil || len(data) == 0 {
+		// Nothing stored yet — env vars remain the bootstrap default.
+		return Config{}, false, nil
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, false, fmt.Errorf("parse stored config: %w", err)
+	}
+	return cfg, true, nil
+}
+
+// startupConfig returns the config to start with: the stored one, held to
+// the same checks as config.set, or else the one built from env vars.
+func (p *plugin) startupConfig() (Config, error) {
+	cfg, stored, err := p.loadStoredConfig()
+	if err != nil {
+		return Config{}, err
+	}
+	if stored {
+		if err := validateForApply(cfg); err != nil {
+			return Config{}, fmt.Errorf("stored config: %w", err)
+		}
+		return cfg, nil
+	}
+	if cfg, err = loadConfig(); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("config: %w", err)
+	}
+	return cfg, nil
+}
+
+func (p *plugin) saveConfig(cfg Config) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return p.store.WriteFile(storage.Private, configKey{}, data)
+}
+
+// validateForApply runs the checks that need to pass before a new config
+// replaces a running one: structure, protocol version, session settings,
+// WebSocket and TLS options, reconciliation, discovery filters and TLS
+// material.
+func validateForApply(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	for _, in := range cfg.Instances {
+		if err := in.validateProtocol(); err != nil {
+			return fmt.Errorf("instance %q: %w", in.Name, err)
+		}
+		if err := in.validateSession(); err != nil {
+			return fmt.Errorf("instance %q: %w", in.Name, err)
+		}
+		if err := in.validateWebsocket(); err != nil {
+			return fmt.Errorf("instance %q: %w", in.Name, err)
+		}
+		if err := in.validateTLS(); err != nil {
+			return fmt.Errorf("instance %q: %w", in.Name, err)
+		}
+		if err := in.validateReconcile(); err != nil {
+			return fmt.Errorf("instance %q: %w", in.Name, err)
+		}
+		if err := in.validateDiscoveryMode(); err != nil {
+			return fmt.Errorf("instance %q: %w", in.Name, err)
+		}
+		if err := validateFilters(in.Filters); err != nil {
+			return fmt.Errorf("instance %q: %w", in.Name, err)
+		}
+		if _, err := buildTLSConfig(in); err != nil {
+			return fmt.Errorf("instance %q: %w", in.Name, err)
+		}
+	}
+	return nil
+}
+
+// handleConfigSet validates, persists and applies a new configuration.
+func (p *plugin) handleConfigSet(msg *messenger.Message) {
+	reply := func(err error) {
+		resp := configReply{OK: err == nil}
+		if err != nil {
+			resp.Error = err.Error()
+			log.Printf("plugin-zigbee2mqtt: config.set rejected: %v", err)
+		}
+		data, _ := json.Marshal(resp)
+		if rerr := msg.Respond(data); rerr != nil {
+			log.Printf("plugin-zigbee2mqtt: config.set reply failed: %v", rerr)
+		}
+	}
+
+	cfg, err := decodeConfig(msg.Data, loadMQTTConfig())
+	if err != nil {
+		reply(fmt.Errorf("parse config: %w", err))
+		return
+	}
+	if err := validateForApply(cfg); err != nil {
+		reply(err)
+		return
+	}
+	p.reloadMu.Lock()
+	if err := p.saveConfig(cfg); err != nil {
+		p.reloadMu.Unlock()
+		reply(fmt.Errorf("persist config: %w", err))
+		return
+	}
+	p.applyConfig(cfg)
+	p.reloadMu.Unlock()
+	log.Printf("plugin-zigbee2mqtt: config reloaded (%d instances)", len(cfg.Instances))
+	reply(nil)
+}
+
+// applyConfig tears down every running paho client and starts connecting
+// with the new configuration in the background. The state topic index is
+// rebuilt from storage, and instances that keep their name also carry their
+// in-memory index and queued commands over, so entities keep receiving state
+// without waiting for discovery to be replayed. Callers hold p.reloadMu.
+func (p *plugin) applyConfig(cfg Config) {
+	p.mu.Lock()
+	old := p.instances
+	p.instances = nil
+	p.cfg = cfg
+	p.mu.Unlock()
+
+	carried := make(map[string]*instance, len(old))
+	for _, in := range old {
+		in.disconnect()
+		carried[in.cfg.Name] = in
+	}
+
+	next := make([]*instance, 0, len(cfg.Instances))
+	for _, instCfg := range cfg.Instances {
+		in := newInstance(p, instCfg)
+		if prev, ok := carried[instCfg.Name]; ok {
+			in.adopt(prev)
+			delete(carried, instCfg.Name)
+		}
+		next = append(next, in)
+	}
+	for _, removed := range carried {
+		removed.failQueued("instance removed by config.set")
+	}
+	p.restoreIndex(next)
+
+	p.mu.Lock()
+	p.instances = next
+	p.mu.Unlock()
+
+	// Settle the demo before connecting: onMQTTConnect removes it, and a
+	// seed landing after the broker answered would bring it back.
+	p.applyDemo(cfg.Demo)
+
+	for _, in := range next {
+		if err := in.connect(); err != nil {
+			if strings.TrimSpace(in.cfg.Broker) != "" {
+				in.bridgeDisconnected(err)
+			}
+			log.Printf("plugin-zigbee2mqtt: [%s] MQTT connection failed: %v", in.label(), err)
+			log.Printf("plugin-zigbee2mqtt: [%s] continuing without MQTT - set a broker to enable", in.label())
+			continue
+		}
+		log.Printf("plugin-zigbee2mqtt: [%s] connecting to %s in the background", in.label(), in.cfg.Broker)
+	}
+}
+
+// applyDemo seeds the demo device in demo mode and removes it otherwise.
+// Real devices win: nothing is seeded while an instance is connected.
+func (p *plugin) applyDemo(demo bool) {
+	if !demo {
+		p.removeDemo()
+		return
+	}
+	if p.anyConnected() {
+		log.Println("plugin-zigbee2mqtt: demo mode - not seeding, an MQTT broker is connected")
+		return
+	}
+	if err := p.seedDemo(); err != nil {
+		log.Printf("plugin-zigbee2mqtt: seed demo: %v", err)
+		return
+	}
+	log.Println("plugin-zigbee2mqtt: demo mode - seeded demo device")
+}
+
+// anyConnected reports whether any instance is connected to its broker.
+func (p *plugin) anyConnected() bool {
+	for _, in := range p.runningInstances() {
+		if in.mqtt != nil && in.mqtt.IsConnected() {
+			return true
+		}
+	}
+	return false
+}
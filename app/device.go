@@ -0,0 +1,138 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+	"slices"
+
+	translate "github.com/slidebolt/plugin-zigbee2mqtt/internal/translate"
+	domain "github.com/slidebolt/sb-domain"
+)
+
+// ---------------------------------------------------------------------------
+// Devices — one record per Zigbee device, built from the discovery dev block
+// ---------------------------------------------------------------------------
+
+// Device is the stored record of one Zigbee device. Every discovery config
+// of a device carries the same device block, so the record is refreshed as
+// each entity is discovered and lists the IDs of all of them.
+//
+// Devices live at plugin-zigbee2mqtt.<deviceID>, next to their entities at
+// plugin-zigbee2mqtt.<deviceID>.<entityID>, and can be queried by field:
+//
+//	store.Query(storage.Query{
+//		Pattern: "plugin-zigbee2mqtt.*",
+//		Where:   []storage.Filter{{Field: "manufacturer", Op: storage.Eq, Value: "IKEA"}},
+//	})
+//
+// The health fields, e.g. battery below 20 or linkquality below 30, can be
+// queried the same way.
+type Device struct {
+	ID           string   `json:"id"`
+	Plugin       string   `json:"plugin"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	ModelID      string   `json:"model_id,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+	HWVersion    string   `json:"hw_version,omitempty"`
+	IEEEAddress  string   `json:"ieee_address,omitempty"`
+	Identifiers  []string `json:"identifiers,omitempty"`
+	ViaDevice    string   `json:"via_device,omitempty"`
+	Area         string   `json:"area,omitempty"`
+	Instance     string   `json:"instance,omitempty"`
+	Entities     []string `json:"entities"`
+	DeviceHealth
+}
+
+func (d Device) Key() string { return d.Plugin + "." + d.ID }
+
+type deviceKey struct{ deviceID string }
+
+func (k deviceKey) Key() string { return pluginID + "." + k.deviceID }
+
+// ieeePattern matches the IEEE address Z2M embeds in device identifiers,
+// e.g. "zigbee2mqtt_0x00158d0001a2b3c4".
+var ieeePattern = regexp.MustCompile(`0x[0-9a-fA-F]{16}`)
+
+// ieeeAddress returns the IEEE address in a device block's identifiers.
+func ieeeAddress(info translate.DeviceInfo) string {
+	for _, id := range info.Identifiers {
+		if ieee := ieeePattern.FindString(id); ieee != "" {
+			return ieee
+		}
+	}
+	return ""
+}
+
+func (p *plugin) getDevice(deviceID string) (Device, bool) {
+	raw, err := p.store.Get(deviceKey{deviceID})
+	if err != nil {
+		return Device{}, false
+	}
+	var dev Device
+	if err := json.Unmarshal(raw, &dev); err != nil {
+		return Device{}, false
+	}
+	return dev, true
+}
+
+// saveDevice merges a discovery device block into the device record and
+// links entityID to it.
+func (in *instance) saveDevice(deviceID string, info translate.DeviceInfo, entityID string) {
+	p := in.p
+	dev, ok := p.getDevice(deviceID)
+	if !ok {
+		dev = Device{ID: deviceID, Plugin: pluginID}
+	}
+	dev.Instance = in.cfg.Name
+
+	set := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	set(&dev.Name, info.Name)
+	set(&dev.Manufacturer, info.Manufacturer)
+	set(&dev.Model, info.Model)
+	set(&dev.ModelID, info.ModelID)
+	set(&dev.SWVersion, info.SWVersion)
+	set(&dev.HWVersion, info.HWVersion)
+	set(&dev.ViaDevice, info.ViaDevice)
+	set(&dev.Area, info.SuggestedArea)
+	if len(info.Identifiers) > 0 {
+		dev.Identifiers = info.Identifiers
+	}
+	if ieee := ieeeAddress(translate.DeviceInfo{Identifiers: dev.Identifiers}); ieee != "" {
+		dev.IEEEAddress = ieee
+	}
+	if !slices.Contains(dev.Entities, entityID) {
+		dev.Entities = append(dev.Entities, entityID)
+	}
+
+	if err := p.store.Save(dev); err != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to save device %s: %v", deviceID, err)
+	}
+}
+
+// unlinkDevice drops a removed entity from its device record, deleting the
+// record once the device has no entities left.
+func (p *plugin) unlinkDevice(key domain.EntityKey) {
+	dev, ok := p.getDevice(key.DeviceID)
+	if !ok {
+		return
+	}
+	dev.Entities = slices.DeleteFunc(dev.Entities, func(id string) bool { return id == key.ID })
+	if len(dev.Entities) > 0 {
+		if err := p.store.Save(dev); err != nil {
+			log.Printf("plugin-zigbee2mqtt: failed to save device %s: %v", dev.ID, err)
+		}
+		return
+	}
+	if err := p.store.Delete(dev); err != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to delete device %s: %v", dev.ID, err)
+		return
+	}
+	log.Printf("plugin-zigbee2mqtt: removed device %s", dev.ID)
+}
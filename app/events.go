@@ -0,0 +1,90 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Events — notifications published on the messenger for other services
+// ---------------------------------------------------------------------------
+
+// subjectEventPrefix prefixes every event subject, e.g.
+// "plugin-zigbee2mqtt.events.command_failed".
+const subjectEventPrefix = pluginID + ".events."
+
+const (
+	eventCommandFailed = "command_failed"
+	eventEntityRemoved = "entity_removed"
+	eventDeviceRenamed = "device_renamed"
+
+	eventEntityAvailability = "entity_availability"
+
+	eventBridgeState               = "bridge_state"
+	eventDeviceJoined              = "device_joined"
+	eventDeviceLeft                = "device_left"
+	eventDeviceInterviewSuccessful = "device_interview_successful"
+	eventDeviceInterviewFailed     = "device_interview_failed"
+)
+
+// CommandFailedEvent reports a command that never reached the broker or that
+// the broker didn't acknowledge. The entity's optimistic state has already
+// been rolled back, or was never applied, when it is sent.
+type CommandFailedEvent struct {
+	Entity   string    `json:"entity"`
+	Command  string    `json:"command"`
+	Reason   string    `json:"reason"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// publishEvent publishes v as JSON on the subject for the named event.
+func (p *plugin) publishEvent(name string, v any) {
+	if p.msg == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to encode %s event: %v", name, err)
+		return
+	}
+	if err := p.msg.Publish(subjectEventPrefix+name, data); err != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to publish %s event: %v", name, err)
+	}
+}
+
+// EntityRemovedEvent reports an entity deleted from storage, e.g. because
+// Z2M cleared its discovery config.
+type EntityRemovedEvent struct {
+	Entity   string `json:"entity"`
+	Instance string `json:"instance,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// DeviceRenamedEvent reports a friendly-name rename in Z2M. The entities
+// keep their keys; only their topics and generated names change.
+type DeviceRenamedEvent struct {
+	Instance string   `json:"instance,omitempty"`
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Entities []string `json:"entities"`
+}
+
+// BridgeStateEvent reports Z2M going offline or coming back online, as
+// published on <base_topic>/bridge/state. An offline event followed by an
+// online one is a Z2M restart.
+type BridgeStateEvent struct {
+	Instance string `json:"instance,omitempty"`
+	Online   bool   `json:"online"`
+}
+
+// BridgeDeviceEvent reports a device joining or leaving the Zigbee network,
+// or the outcome of its interview. Device is the SlideBolt device ID;
+// Supported is only set for interviews.
+type BridgeDeviceEvent struct {
+	Instance     string `json:"instance,omitempty"`
+	Device       string `json:"device"`
+	IEEEAddress  string `json:"ieee_address"`
+	FriendlyName string `json:"friendly_name,omitempty"`
+	Supported    *bool  `json:"supported,omitempty"`
+}
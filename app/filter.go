@@ -0,0 +1,275 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"sort"
+	"strings"
+
+	domain "github.com/slidebolt/sb-domain"
+	messenger "github.com/slidebolt/sb-messenger-sdk"
+)
+
+// ---------------------------------------------------------------------------
+// Discovery filters — include/exclude rules applied before entities are stored
+// ---------------------------------------------------------------------------
+
+// Filter actions, see FilterRule.
+const (
+	filterInclude = "include"
+	filterExclude = "exclude"
+)
+
+// subjectFiltersDryRun is the request/reply subject that evaluates filter
+// rules against the entities discovered so far without applying them. The
+// request body is a filterDryRunRequest; the reply is a FilterDryRun.
+const subjectFiltersDryRun = pluginID + ".filters.dry_run"
+
+// FilterRule includes or excludes the discovered entities it matches. A rule
+// matches when every field it sets matches; fields are case-insensitive
+// globs where * matches any run of characters and ? a single one. DeviceID
+// is the Z2M device ID (usually the IEEE address) and Model matches either
+// the model or the model ID.
+//
+// Rules are evaluated in order and the first match decides. An entity that
+// no rule matches is stored, unless the rules contain an include rule.
+type FilterRule struct {
+	Name   string `json:"name,omitempty"`
+	Action string `json:"action"`
+
+	DeviceID       string `json:"device_id,omitempty"`
+	FriendlyName   string `json:"friendly_name,omitempty"`
+	EntityType     string `json:"entity_type,omitempty"`
+	EntityCategory string `json:"entity_category,omitempty"`
+	DeviceClass    string `json:"device_class,omitempty"`
+	Manufacturer   string `json:"manufacturer,omitempty"`
+	Model          string `json:"model,omitempty"`
+}
+
+// filterCandidate is what the rules see of a discovered entity.
+type filterCandidate struct {
+	DeviceID       string
+	FriendlyName   string
+	EntityType     string
+	EntityCategory string
+	DeviceClass    string
+	Manufacturer   string
+	Model          string
+	ModelID        string
+}
+
+func (r FilterRule) matches(c filterCandidate) bool {
+	return globField(r.DeviceID, c.DeviceID) &&
+		globField(r.FriendlyName, c.FriendlyName) &&
+		globField(r.EntityType, c.EntityType) &&
+		globField(r.EntityCategory, c.EntityCategory) &&
+		globField(r.DeviceClass, c.DeviceClass) &&
+		globField(r.Manufacturer, c.Manufacturer) &&
+		(globField(r.Model, c.Model) || globField(r.Model, c.ModelID))
+}
+
+func validateFilters(rules []FilterRule) error {
+	for i, r := range rules {
+		if r.Action != filterInclude && r.Action != filterExclude {
+			return fmt.Errorf("filter %d: action %q must be %q or %q", i, r.Action, filterInclude, filterExclude)
+		}
+	}
+	return nil
+}
+
+// evaluateFilters returns whether rules accept c and the index of the
+// deciding rule, or -1 when none matched.
+func evaluateFilters(rules []FilterRule, c filterCandidate) (int, bool) {
+	for i, r := range rules {
+		if r.matches(c) {
+			return i, r.Action == filterInclude
+		}
+	}
+	for _, r := range rules {
+		if r.Action == filterInclude {
+			return -1, false
+		}
+	}
+	return -1, true
+}
+
+// globField matches an optional rule field; an empty pattern matches all.
+func globField(pattern, s string) bool {
+	return pattern == "" || globMatch(strings.ToLower(pattern), strings.ToLower(s))
+}
+
+// globMatch reports whether s matches pattern, where * matches any run of
+// characters and ? a single character.
+func globMatch(pattern, s string) bool {
+	p, str := []rune(pattern), []rune(s)
+	pi, si := 0, 0
+	star, mark := -1, 0
+	for si < len(str) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == str[si]):
+			pi++
+			si++
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, si
+			pi++
+		case star >= 0:
+			pi = star + 1
+			mark++
+			si = mark
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// filterCandidate describes a discovered entity for the filter rules.
+func (in *instance) filterCandidate(key domain.EntityKey, discovery DiscoveryPayload, info EntityTopicInfo) filterCandidate {
+	dev, _ := discovery.DeviceInfo()
+	friendlyName := dev.Name
+	if name, ok := strings.CutPrefix(info.StateTopic, in.cfg.BaseTopic+"/"); ok {
+		friendlyName = name
+	}
+	deviceID := key.DeviceID
+	if in.cfg.Name != "" {
+		deviceID = strings.TrimPrefix(deviceID, in.cfg.Name+"_")
+	}
+	return filterCandidate{
+		DeviceID:       deviceID,
+		FriendlyName:   friendlyName,
+		EntityType:     info.EntityType,
+		EntityCategory: discovery.EntityCategory,
+		DeviceClass:    discovery.DeviceClass,
+		Manufacturer:   dev.Manufacturer,
+		Model:          dev.Model,
+		ModelID:        dev.ModelID,
+	}
+}
+
+// admit records a discovered entity for dry runs and reports whether the
+// instance's filters let it be stored.
+func (in *instance) admit(key domain.EntityKey, discovery DiscoveryPayload, info EntityTopicInfo) bool {
+	c := in.filterCandidate(key, discovery, info)
+	rule, ok := evaluateFilters(in.cfg.Filters, c)
+	if !ok {
+		// Rules may have changed since the entity was stored.
+		in.removeEntity(key, "excluded by discovery filter")
+		log.Printf("plugin-zigbee2mqtt: [%s] filtered out %s (rule %d)", in.label(), key.Key(), rule)
+	}
+	in.mu.Lock()
+	in.candidates[key] = c
+	in.mu.Unlock()
+	return ok
+}
+
+func (in *instance) forgetCandidate(key domain.EntityKey) {
+	in.mu.Lock()
+	delete(in.candidates, key)
+	in.mu.Unlock()
+}
+
+type filterDryRunRequest struct {
+	Instance string `json:"instance"`
+	// Rules to evaluate; the instance's configured rules when omitted.
+	Rules []FilterRule `json:"rules"`
+}
+
+// FilterDryRun lists, per rule, the discovered entities it decides. An
+// entity an earlier rule already decided is listed as shadowed instead.
+type FilterDryRun struct {
+	Instance  string             `json:"instance,omitempty"`
+	Rules     []FilterRuleResult `json:"rules"`
+	Unmatched FilterRuleResult   `json:"unmatched"`
+	Error     string             `json:"error,omitempty"`
+}
+
+// FilterRuleResult holds the entity keys one rule decides; Rule is nil for
+// the entities no rule matched.
+type FilterRuleResult struct {
+	Rule     *FilterRule `json:"rule,omitempty"`
+	Accepted []string    `json:"accepted"`
+	Rejected []string    `json:"rejected"`
+	Shadowed []string    `json:"shadowed,omitempty"`
+}
+
+// dryRun evaluates rules against every entity discovered since the
+// instance started, stored or not.
+func (in *instance) dryRun(rules []FilterRule) FilterDryRun {
+	in.mu.RLock()
+	candidates := maps.Clone(in.candidates)
+	in.mu.RUnlock()
+
+	report := FilterDryRun{
+		Instance:  in.cfg.Name,
+		Rules:     make([]FilterRuleResult, len(rules)),
+		Unmatched: FilterRuleResult{Accepted: []string{}, Rejected: []string{}},
+	}
+	for i := range rules {
+		report.Rules[i] = FilterRuleResult{Rule: &rules[i], Accepted: []string{}, Rejected: []string{}}
+	}
+	for key, c := range candidates {
+		decided, ok := evaluateFilters(rules, c)
+		result := &report.Unmatched
+		if decided >= 0 {
+			result = &report.Rules[decided]
+		}
+		if ok {
+			result.Accepted = append(result.Accepted, key.Key())
+		} else {
+			result.Rejected = append(result.Rejected, key.Key())
+		}
+		for i := decided + 1; decided >= 0 && i < len(rules); i++ {
+			if rules[i].matches(c) {
+				report.Rules[i].Shadowed = append(report.Rules[i].Shadowed, key.Key())
+			}
+		}
+	}
+
+	sortResult := func(r *FilterRuleResult) {
+		sort.Strings(r.Accepted)
+		sort.Strings(r.Rejected)
+		sort.Strings(r.Shadowed)
+	}
+	for i := range report.Rules {
+		sortResult(&report.Rules[i])
+	}
+	sortResult(&report.Unmatched)
+	return report
+}
+
+// handleFiltersDryRun answers a filters.dry_run request.
+func (p *plugin) handleFiltersDryRun(msg *messenger.Message) {
+	reply := func(report FilterDryRun) {
+		data, _ := json.Marshal(report)
+		if err := msg.Respond(data); err != nil {
+			log.Printf("plugin-zigbee2mqtt: filters.dry_run reply failed: %v", err)
+		}
+	}
+
+	var req filterDryRunRequest
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			reply(FilterDryRun{Error: fmt.Sprintf("parse request: %v", err)})
+			return
+		}
+	}
+	in := p.instance(req.Instance)
+	if in == nil {
+		reply(FilterDryRun{Instance: req.Instance, Error: fmt.Sprintf("unknown instance %q", req.Instance)})
+		return
+	}
+	rules := req.Rules
+	if rules == nil {
+		rules = in.cfg.Filters
+	}
+	if err := validateFilters(rules); err != nil {
+		reply(FilterDryRun{Instance: req.Instance, Error: err.Error()})
+		return
+	}
+	reply(in.dryRun(rules))
+}
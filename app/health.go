@@ -0,0 +1,64 @@
+package app
+
+import (
+	"log"
+	"time"
+
+	translate "github.com/slidebolt/plugin-zigbee2mqtt/internal/translate"
+)
+
+// ---------------------------------------------------------------------------
+// Device health — link quality, battery and last seen on the device record
+// ---------------------------------------------------------------------------
+
+// lastSeenResolution bounds how often a state message that changes nothing
+// but the last-seen time rewrites the device record.
+const lastSeenResolution = time.Minute
+
+// DeviceHealth is refreshed from every state message of a device. Fields
+// the device never reported are omitted.
+type DeviceHealth struct {
+	LinkQuality *int     `json:"linkquality,omitempty"`
+	Battery     *float64 `json:"battery,omitempty"` // percent
+	Voltage     *float64 `json:"voltage,omitempty"` // millivolts
+	// LastSeen is Z2M's last_seen when it reports one, otherwise the time
+	// of the last state message.
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// merge applies the fields h carries to d and reports whether the record
+// needs saving.
+func (d *DeviceHealth) merge(h translate.Health) bool {
+	changed := false
+	if h.LinkQuality != nil && (d.LinkQuality == nil || *d.LinkQuality != *h.LinkQuality) {
+		d.LinkQuality, changed = h.LinkQuality, true
+	}
+	if h.Battery != nil && (d.Battery == nil || *d.Battery != *h.Battery) {
+		d.Battery, changed = h.Battery, true
+	}
+	if h.Voltage != nil && (d.Voltage == nil || *d.Voltage != *h.Voltage) {
+		d.Voltage, changed = h.Voltage, true
+	}
+	if h.LastSeen != nil && (d.LastSeen == nil || changed || h.LastSeen.Sub(*d.LastSeen) >= lastSeenResolution) {
+		d.LastSeen, changed = h.LastSeen, true
+	}
+	return changed
+}
+
+// updateHealth refreshes the health of the devices behind a state message.
+func (p *plugin) updateHealth(deviceIDs []string, payload []byte) {
+	h, _ := translate.DecodeHealth(payload)
+	if h.LastSeen == nil {
+		now := time.Now().UTC()
+		h.LastSeen = &now
+	}
+	for _, deviceID := range deviceIDs {
+		dev, ok := p.getDevice(deviceID)
+		if !ok || !dev.merge(h) {
+			continue
+		}
+		if err := p.store.Save(dev); err != nil {
+			log.Printf("plugin-zigbee2mqtt: failed to save health of device %s: %v", deviceID, err)
+		}
+	}
+}
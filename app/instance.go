@@ -0,0 +1,336 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	domain "github.com/slidebolt/sb-domain"
+	storage "github.com/slidebolt/sb-storage-sdk"
+)
+
+// ---------------------------------------------------------------------------
+// Instances — one per Zigbee2MQTT installation
+// ---------------------------------------------------------------------------
+
+// Config is the full plugin configuration: one MQTTConfig per Zigbee2MQTT
+// instance driven by this plugin.
+//
+// Set Z2M_INSTANCES to a JSON array of MQTTConfig objects to drive several
+// instances. Without it, a single unnamed instance is built from the
+// Z2M_MQTT_* environment variables. Z2M_DEMO_MODE=true turns on Demo.
+type Config struct {
+	Instances []MQTTConfig `json:"instances"`
+
+	// Demo seeds a fake demo_device for trying the plugin without a broker.
+	// It is removed when demo mode is off or a broker connects.
+	Demo bool `json:"demo"`
+}
+
+// instance is one Zigbee2MQTT installation: its broker connection, topics and
+// the state topic index built from its discovery messages.
+type instance struct {
+	p    *plugin
+	cfg  MQTTConfig
+	mqtt mqtt.Client
+
+	// stateTopicIndex maps MQTT state topics (e.g. "zigbee2mqtt/Main_LB_01")
+	// to the entity keys that share that topic. Built during discovery.
+	// seen holds the entities rediscovered since the last connect, for
+	// reconciliation. mu also guards reconcileTimer, nodes, candidates, the
+	// availability and attributes indexes and the availability values.
+	mu              sync.RWMutex
+	stateTopicIndex map[string][]domain.EntityKey
+	seen            map[domain.EntityKey]bool
+	reconcileTimer  *time.Timer
+	// nodes maps discovery node IDs to the IEEE address of their device.
+	nodes map[string]string
+	// candidates holds every discovered entity, stored or filtered out, for
+	// filter dry runs.
+	candidates map[domain.EntityKey]filterCandidate
+	// availabilityIndex maps availability topics to the entities using them;
+	// availability holds the last value per availability topic of each and
+	// available the availability they combine to.
+	availabilityIndex map[string][]domain.EntityKey
+	availability      map[domain.EntityKey]map[string]bool
+	available         map[domain.EntityKey]bool
+	// attributesIndex maps json_attributes_topic topics to the entities
+	// using them.
+	attributesIndex map[string][]domain.EntityKey
+	// indexed holds the topic info each entity is indexed under, so
+	// reindexing one entity only touches the topics it used before.
+	indexed map[domain.EntityKey]EntityTopicInfo
+
+	// queue holds commands issued while the broker is unreachable; stop ends
+	// the goroutine that expires them.
+	queue *commandQueue
+	stop  chan struct{}
+
+	bridge *bridgeStatus
+}
+
+func newInstance(p *plugin, cfg MQTTConfig) *instance {
+	return &instance{
+		p:               p,
+		cfg:             cfg,
+		stateTopicIndex: make(map[string][]domain.EntityKey),
+		seen:            make(map[domain.EntityKey]bool),
+		nodes:           make(map[string]string),
+		candidates:      make(map[domain.EntityKey]filterCandidate),
+
+		availabilityIndex: make(map[string][]domain.EntityKey),
+		availability:      make(map[domain.EntityKey]map[string]bool),
+		available:         make(map[domain.EntityKey]bool),
+		attributesIndex:   make(map[string][]domain.EntityKey),
+		indexed:           make(map[domain.EntityKey]EntityTopicInfo),
+		queue:             newCommandQueue(cfg.CommandQueueSize),
+		bridge:            &bridgeStatus{},
+	}
+}
+
+func loadConfig() (Config, error) {
+	base := loadMQTTConfig()
+	demo := getEnvBool("Z2M_DEMO_MODE", false)
+	raw := getEnv("Z2M_INSTANCES", "")
+	if raw == "" {
+		return Config{Instances: []MQTTConfig{base}, Demo: demo}, nil
+	}
+
+	cfg, err := decodeConfig([]byte(raw), base)
+	if err != nil {
+		return Config{}, fmt.Errorf("parse Z2M_INSTANCES: %w", err)
+	}
+	cfg.Demo = cfg.Demo || demo
+	return cfg, nil
+}
+
+// decodeConfig decodes either a Config object or a bare array of instances.
+// Each instance is decoded on top of base, so any field it leaves out keeps
+// the bootstrap value — including zero-valued settings such as QoS.
+func decodeConfig(data []byte, base MQTTConfig) (Config, error) {
+	var raws []json.RawMessage
+	var demo bool
+	if err := json.Unmarshal(data, &raws); err != nil {
+		var wrapped struct {
+			Instances []json.RawMessage `json:"instances"`
+			Demo      bool              `json:"demo"`
+		}
+		if err2 := json.Unmarshal(data, &wrapped); err2 != nil {
+			return Config{}, err
+		}
+		raws = wrapped.Instances
+		demo = wrapped.Demo
+	}
+
+	cfg := Config{Demo: demo}
+	for _, raw := range raws {
+		in := base
+		// Identity fields are derived per instance rather than inherited.
+		in.Name, in.ClientID, in.StatusTopic = "", "", ""
+		// Unmarshal merges into an existing map; don't share base's.
+		in.HTTPHeaders = maps.Clone(base.HTTPHeaders)
+		in.UserProperties = maps.Clone(base.UserProperties)
+		in.Filters = slices.Clone(base.Filters)
+		if err := json.Unmarshal(raw, &in); err != nil {
+			return Config{}, err
+		}
+		cfg.Instances = append(cfg.Instances, in)
+	}
+	cfg.applyDefaults(base)
+	return cfg, nil
+}
+
+// applyDefaults derives a distinct client ID and status topic per named
+// instance so two instances on the same broker don't kick each other off.
+// Unset ones get "-<name>" and "/<name>" appended to the bootstrap values.
+func (c *Config) applyDefaults(base MQTTConfig) {
+	for i := range c.Instances {
+		in := &c.Instances[i]
+		if in.ClientID == "" {
+			in.ClientID = base.ClientID
+			if in.Name != "" {
+				in.ClientID += "-" + in.Name
+			}
+		}
+		if in.StatusTopic == "" && base.StatusTopic != "" {
+			in.StatusTopic = base.StatusTopic
+			if in.Name != "" {
+				in.StatusTopic += "/" + in.Name
+			}
+		}
+	}
+}
+
+// Validate checks that instance names are usable as device ID namespaces
+// and don't collide.
+func (c Config) Validate() error {
+	if len(c.Instances) == 0 {
+		return fmt.Errorf("no Zigbee2MQTT instances configured")
+	}
+	seen := make(map[string]bool, len(c.Instances))
+	for i, in := range c.Instances {
+		if len(c.Instances) > 1 && in.Name == "" {
+			return fmt.Errorf("instance %d: name is required when more than one instance is configured", i)
+		}
+		if !validInstanceName(in.Name) {
+			return fmt.Errorf("instance %d: name %q may only contain letters, digits and '-'", i, in.Name)
+		}
+		if seen[in.Name] {
+			return fmt.Errorf("instance %d: duplicate name %q", i, in.Name)
+		}
+		seen[in.Name] = true
+	}
+	return nil
+}
+
+// validInstanceName rejects '.' (the storage key separator) and '_' (the
+// namespace separator) so a namespaced device ID always splits unambiguously.
+func validInstanceName(name string) bool {
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// deviceID namespaces a Zigbee2MQTT device ID with the instance name so the
+// same device ID on two networks maps to two SlideBolt devices. The unnamed
+// instance keeps bare device IDs.
+func (in *instance) deviceID(z2mDeviceID string) string {
+	if in.cfg.Name == "" {
+		return z2mDeviceID
+	}
+	return in.cfg.Name + "_" + z2mDeviceID
+}
+
+// label names the instance in log lines.
+func (in *instance) label() string {
+	if in.cfg.Name == "" {
+		return "default"
+	}
+	return in.cfg.Name
+}
+
+// adopt takes over the topic indexes, known nodes, queued commands and
+// connection history of a replaced instance.
+func (in *instance) adopt(prev *instance) {
+	prev.mu.RLock()
+	in.mu.Lock()
+	for topic, keys := range prev.stateTopicIndex {
+		in.stateTopicIndex[topic] = append([]domain.EntityKey(nil), keys...)
+	}
+	for topic, keys := range prev.availabilityIndex {
+		in.availabilityIndex[topic] = slices.Clone(keys)
+	}
+	for topic, keys := range prev.attributesIndex {
+		in.attributesIndex[topic] = slices.Clone(keys)
+	}
+	maps.Copy(in.indexed, prev.indexed)
+	maps.Copy(in.nodes, prev.nodes)
+	maps.Copy(in.candidates, prev.candidates)
+	in.mu.Unlock()
+	prev.mu.RUnlock()
+
+	for _, cmd := range prev.queue.take() {
+		in.enqueueCommand(cmd)
+	}
+
+	prev.bridge.mu.Lock()
+	in.bridge.state = prev.bridge.state
+	in.bridge.connects = prev.bridge.connects
+	prev.bridge.mu.Unlock()
+}
+
+// restoreIndex rebuilds the state, availability and attributes topic
+// indexes of each instance from the EntityTopicInfo records in internal
+// storage, so known entities follow state updates right away instead of
+// waiting for discovery to be replayed.
+func (p *plugin) restoreIndex(instances []*instance) {
+	if p.store == nil {
+		return
+	}
+	entries, err := p.store.SearchFiles(storage.Internal, pluginID+".*.*")
+	if err != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to load topic info: %v", err)
+		return
+	}
+
+	byName := make(map[string]*instance, len(instances))
+	for _, in := range instances {
+		byName[in.cfg.Name] = in
+	}
+	restored := 0
+	for _, entry := range entries {
+		key, ok := parseEntityKey(entry.Key)
+		if !ok {
+			continue
+		}
+		var info EntityTopicInfo
+		if err := json.Unmarshal(entry.Data, &info); err != nil {
+			continue
+		}
+		in, ok := byName[info.Instance]
+		if !ok {
+			continue
+		}
+		in.mu.Lock()
+		in.indexLocked(key, info)
+		in.mu.Unlock()
+		if info.StateTopic != "" {
+			restored++
+		}
+	}
+	log.Printf("plugin-zigbee2mqtt: restored %d state topic mappings from storage", restored)
+}
+
+// failQueued fails every command still waiting for the broker.
+func (in *instance) failQueued(reason string) {
+	for _, cmd := range in.queue.take() {
+		in.p.failCommand(cmd, reason)
+	}
+}
+
+// disconnect announces a clean shutdown and closes the paho client. A clean
+// disconnect discards the Last Will, so "offline" is published explicitly.
+func (in *instance) disconnect() {
+	in.cancelReconcile()
+	if in.stop != nil {
+		close(in.stop)
+		in.stop = nil
+	}
+	if in.mqtt == nil {
+		return
+	}
+	if in.mqtt.IsConnected() {
+		in.publishStatus(in.mqtt, statusOffline)
+	}
+	// Also stops paho's connect-retry loop for a broker that never answered.
+	in.mqtt.Disconnect(250)
+}
+
+// instance returns the running instance with the given name.
+func (p *plugin) instance(name string) *instance {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, in := range p.instances {
+		if in.cfg.Name == name {
+			return in
+		}
+	}
+	return nil
+}
+
+// runningInstances returns a snapshot of the running instances.
+func (p *plugin) runningInstances() []*instance {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*instance(nil), p.instances...)
+}
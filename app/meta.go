@@ -0,0 +1,90 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+
+	domain "github.com/slidebolt/sb-domain"
+)
+
+// ---------------------------------------------------------------------------
+// Entity metadata — HA discovery fields stored alongside the domain entity
+// ---------------------------------------------------------------------------
+
+// EntityMeta is the discovery metadata stored with an entity, flattened into
+// the same JSON object, so UIs can hide disabled entities and the
+// config/diagnostic noise Z2M generates for every device.
+type EntityMeta struct {
+	UniqueID string `json:"unique_id,omitempty"`
+	ObjectID string `json:"object_id,omitempty"`
+	// EntityCategory is "config" or "diagnostic" for entities that are not
+	// a primary function of the device.
+	EntityCategory string `json:"entity_category,omitempty"`
+	// Disabled is set on creation for enabled_by_default false and is left
+	// alone afterwards, so a user may enable the entity.
+	Disabled            bool   `json:"disabled,omitempty"`
+	Icon                string `json:"icon,omitempty"`
+	JSONAttributesTopic string `json:"json_attributes_topic,omitempty"`
+	DisplayPrecision    *int   `json:"display_precision,omitempty"`
+	// Available is the entity's availability, see availability.go; nil when
+	// its discovery config declares none.
+	Available *bool `json:"available,omitempty"`
+	// Attributes holds the extra attributes from JSONAttributesTopic, see
+	// attributes.go.
+	Attributes map[string]json.RawMessage `json:"attributes,omitempty"`
+}
+
+func discoveryMeta(d DiscoveryPayload) EntityMeta {
+	return EntityMeta{
+		UniqueID:            d.UniqueID,
+		ObjectID:            d.ObjectID,
+		EntityCategory:      d.EntityCategory,
+		Disabled:            d.EnabledByDefault != nil && !*d.EnabledByDefault,
+		Icon:                d.Icon,
+		JSONAttributesTopic: d.JSONAttributesTopic,
+		DisplayPrecision:    d.SuggestedDisplayPrecision,
+	}
+}
+
+// readEntityMeta returns the metadata of a stored entity record.
+func readEntityMeta(raw []byte) EntityMeta {
+	var meta EntityMeta
+	_ = json.Unmarshal(raw, &meta)
+	return meta
+}
+
+// entityRecord is the stored form of an entity: the domain entity with its
+// metadata merged into the same object.
+type entityRecord struct {
+	domain.Entity
+	Meta EntityMeta
+}
+
+func (r entityRecord) MarshalJSON() ([]byte, error) {
+	base, err := json.Marshal(r.Entity)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(base, &fields); err != nil || fields == nil {
+		return nil, fmt.Errorf("entity %s does not encode as a JSON object", r.Entity.Key())
+	}
+	meta, err := json.Marshal(r.Meta)
+	if err != nil {
+		return nil, err
+	}
+	var metaFields map[string]json.RawMessage
+	if err := json.Unmarshal(meta, &metaFields); err != nil {
+		return nil, err
+	}
+	for k, v := range metaFields {
+		fields[k] = v
+	}
+	return json.Marshal(fields)
+}
+
+// saveEntity stores an entity with its metadata. Entity updates pass the
+// metadata read from the stored record, so it survives state changes.
+func (p *plugin) saveEntity(entity domain.Entity, meta EntityMeta) error {
+	return p.store.Save(entityRecord{Entity: entity, Meta: meta})
+}
@@ -0,0 +1,538 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ---------------------------------------------------------------------------
+// MQTT 5 — paho.golang behind the paho.mqtt.golang Client interface
+// ---------------------------------------------------------------------------
+
+// v5Timeout bounds a single MQTT 5 subscribe, unsubscribe or publish.
+const v5Timeout = 10 * time.Second
+
+// validateProtocol checks the protocol version and rejects MQTT 5 settings
+// on a 3.1.1 connection, where they would be silently ignored.
+func (c MQTTConfig) validateProtocol() error {
+	if _, err := pahoProtocolVersion(c.ProtocolVersion); err != nil {
+		return err
+	}
+	if !c.mqtt5() {
+		if len(c.UserProperties) > 0 || c.ResponseTopic != "" {
+			return fmt.Errorf("user_properties and response_topic need protocol_version 5")
+		}
+		return nil
+	}
+	if !c.CleanSession && c.SessionExpiryInterval == 0 {
+		return fmt.Errorf("session_expiry_interval must be positive when clean_session is false")
+	}
+	return nil
+}
+
+// v5Client adapts an autopaho connection to mqtt.Client, so instances drive
+// MQTT 5 brokers exactly like 3.1.1 ones. Session expiry and user
+// properties go on the CONNECT, user properties on every PUBLISH, and the
+// reason code of a refused publish is returned as a *publishError.
+type v5Client struct {
+	cfg           autopaho.ClientConfig
+	router        *paho.StandardRouter
+	user          paho.UserProperties
+	responseTopic string
+	connected     atomic.Bool
+
+	mu      sync.Mutex
+	cm      *autopaho.ConnectionManager
+	cancel  context.CancelFunc
+	lastErr error
+}
+
+// newV5Client builds the MQTT 5 client for the instance's broker. Like paho's
+// options, it retries until the broker answers and calls onMQTTConnect and
+// onMQTTDisconnect as the connection comes and goes.
+func (in *instance) newV5Client() (*v5Client, error) {
+	if err := in.cfg.validateProtocol(); err != nil {
+		return nil, fmt.Errorf("MQTT config: %w", err)
+	}
+	if err := in.cfg.validateSession(); err != nil {
+		return nil, fmt.Errorf("MQTT config: %w", err)
+	}
+	broker, err := in.cfg.brokerURL()
+	if err != nil {
+		return nil, fmt.Errorf("MQTT config: %w", err)
+	}
+	server, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("MQTT config: parse broker URL: %w", err)
+	}
+	tlsCfg, err := buildTLSConfig(in.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("MQTT TLS: %w", err)
+	}
+	wsCfg, err := websocketV5Config(in.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("MQTT websocket: %w", err)
+	}
+
+	c := &v5Client{
+		router:        paho.NewStandardRouter(),
+		user:          userProperties(in.cfg.UserProperties),
+		responseTopic: in.cfg.ResponseTopic,
+	}
+	// A clean session ends with the connection, as it does over 3.1.1.
+	expiry := in.cfg.SessionExpiryInterval
+	if in.cfg.CleanSession {
+		expiry = 0
+	}
+	c.cfg = autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{server},
+		TlsCfg:                        tlsCfg,
+		WebSocketCfg:                  wsCfg,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: in.cfg.CleanSession,
+		SessionExpiryInterval:         expiry,
+		// Dial straight away, then every 5s like the 3.1.1 client.
+		ReconnectBackoff: func(attempt int) time.Duration {
+			if attempt == 0 {
+				return 0
+			}
+			return 5 * time.Second
+		},
+		ConnectUsername: in.cfg.Username,
+		ConnectPassword: []byte(in.cfg.Password),
+		ConnectPacketBuilder: func(cp *paho.Connect, _ *url.URL) (*paho.Connect, error) {
+			if len(c.user) > 0 {
+				if cp.Properties == nil {
+					cp.Properties = &paho.ConnectProperties{}
+				}
+				cp.Properties.User = c.user
+			}
+			return cp, nil
+		},
+		// onMQTTConnect blocks on subscribes, which autopaho's callbacks
+		// must not; paho.mqtt.golang runs it on its own goroutine too.
+		OnConnectionUp: func(*autopaho.ConnectionManager, *paho.Connack) {
+			c.connected.Store(true)
+			go in.onMQTTConnect(c)
+		},
+		OnConnectionDown: func() bool {
+			c.connected.Store(false)
+			go in.onMQTTDisconnect(c, c.takeErr())
+			return true
+		},
+		OnConnectError: func(err error) {
+			err = connectError(err)
+			log.Printf("plugin-zigbee2mqtt: [%s] MQTT 5 connect: %v", in.label(), err)
+			in.bridgeDisconnected(err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: in.cfg.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					c.router.Route(pr.Packet.Packet())
+					return true, nil
+				},
+			},
+			OnClientError: c.setErr,
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				c.setErr(disconnectError(d))
+			},
+		},
+	}
+	if in.cfg.StatusTopic != "" {
+		c.cfg.WillMessage = &paho.WillMessage{Topic: in.cfg.StatusTopic, Payload: []byte(statusOffline), QoS: 1, Retain: true}
+	}
+	return c, nil
+}
+
+// userProperties converts configured user properties, sorted by key so
+// every packet carries them in the same order.
+func userProperties(m map[string]string) paho.UserProperties {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var props paho.UserProperties
+	for _, k := range keys {
+		props.Add(k, m[k])
+	}
+	return props
+}
+
+func (c *v5Client) setErr(err error) {
+	c.mu.Lock()
+	c.lastErr = err
+	c.mu.Unlock()
+}
+
+// takeErr returns and clears the error that took the connection down.
+func (c *v5Client) takeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.lastErr
+	c.lastErr = nil
+	if err == nil {
+		err = errors.New("connection lost")
+	}
+	return err
+}
+
+func (c *v5Client) manager() *autopaho.ConnectionManager {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cm
+}
+
+func (c *v5Client) IsConnected() bool      { return c.connected.Load() }
+func (c *v5Client) IsConnectionOpen() bool { return c.connected.Load() }
+
+// Connect starts the connection manager. The token completes once the
+// first connection is up, or with an error when Disconnect stops it first.
+func (c *v5Client) Connect() mqtt.Token {
+	ctx, cancel := context.WithCancel(context.Background())
+	cm, err := autopaho.NewConnection(ctx, c.cfg)
+	if err != nil {
+		cancel()
+		return doneToken(err)
+	}
+	c.mu.Lock()
+	c.cm, c.cancel = cm, cancel
+	c.mu.Unlock()
+	return runToken(func() error { return cm.AwaitConnection(ctx) })
+}
+
+// Disconnect sends a DISCONNECT, waiting up to quiesce milliseconds, and
+// stops reconnecting.
+func (c *v5Client) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	cm, cancel := c.cm, c.cancel
+	c.mu.Unlock()
+	if cm == nil {
+		return
+	}
+	ctx, stop := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer stop()
+	_ = cm.Disconnect(ctx)
+	cancel()
+	c.connected.Store(false)
+}
+
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return c.publish(topic, qos, retained, payload, "")
+}
+
+// PublishCommand publishes a command with the configured response topic.
+func (c *v5Client) PublishCommand(topic string, qos byte, payload []byte) mqtt.Token {
+	return c.publish(topic, qos, false, payload, c.responseTopic)
+}
+
+func (c *v5Client) publish(topic string, qos byte, retained bool, payload interface{}, responseTopic string) mqtt.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	default:
+		return doneToken(fmt.Errorf("unsupported payload type %T", payload))
+	}
+	cm := c.manager()
+	if cm == nil {
+		return doneToken(autopaho.ConnectionDownError)
+	}
+	pub := &paho.Publish{
+		Topic:      topic,
+		QoS:        qos,
+		Retain:     retained,
+		Payload:    data,
+		Properties: &paho.PublishProperties{User: c.user, ResponseTopic: responseTopic},
+	}
+	t := &v5PublishToken{v5Token: v5Token{done: make(chan struct{})}}
+	go func() {
+		defer close(t.done)
+		ctx, cancel := context.WithTimeout(context.Background(), v5Timeout)
+		defer cancel()
+		resp, err := cm.Publish(ctx, pub)
+		if resp != nil && qos > 0 {
+			t.code, t.hasCode = resp.ReasonCode, true
+			if resp.ReasonCode >= 0x80 {
+				// paho.golang reports a refused QoS 2 publish as success.
+				err = newPublishError(resp)
+			}
+		}
+		t.err = err
+	}()
+	return t
+}
+
+func (c *v5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *v5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	sub := &paho.Subscribe{}
+	for topic, qos := range filters {
+		c.AddRoute(topic, callback)
+		sub.Subscriptions = append(sub.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+	}
+	if len(c.user) > 0 {
+		sub.Properties = &paho.SubscribeProperties{User: c.user}
+	}
+	cm := c.manager()
+	if cm == nil {
+		return doneToken(autopaho.ConnectionDownError)
+	}
+	return runToken(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), v5Timeout)
+		defer cancel()
+		suback, err := cm.Subscribe(ctx, sub)
+		if err != nil {
+			return err
+		}
+		for i, code := range suback.Reasons {
+			if code >= 0x80 && i < len(sub.Subscriptions) {
+				return fmt.Errorf("subscribe %s refused: %s", sub.Subscriptions[i].Topic, reasonName(code))
+			}
+		}
+		return nil
+	})
+}
+
+func (c *v5Client) Unsubscribe(topics ...string) mqtt.Token {
+	for _, topic := range topics {
+		c.router.UnregisterHandler(topic)
+	}
+	cm := c.manager()
+	if cm == nil {
+		return doneToken(autopaho.ConnectionDownError)
+	}
+	return runToken(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), v5Timeout)
+		defer cancel()
+		_, err := cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+// AddRoute replaces the handler of topic, as paho.mqtt.golang does; the
+// resubscribe on every reconnect must not stack handlers.
+func (c *v5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.router.UnregisterHandler(topic)
+	c.router.RegisterHandler(topic, func(p *paho.Publish) {
+		callback(c, v5Message{p})
+	})
+}
+
+func (c *v5Client) OptionsReader() mqtt.ClientOptionsReader { return mqtt.ClientOptionsReader{} }
+
+// v5Message is a received MQTT 5 PUBLISH as an mqtt.Message. paho.golang
+// acknowledges it once the handlers return.
+type v5Message struct{ p *paho.Publish }
+
+func (m v5Message) Duplicate() bool   { return m.p.Duplicate() }
+func (m v5Message) Qos() byte         { return m.p.QoS }
+func (m v5Message) Retained() bool    { return m.p.Retain }
+func (m v5Message) Topic() string     { return m.p.Topic }
+func (m v5Message) MessageID() uint16 { return m.p.PacketID }
+func (m v5Message) Payload() []byte   { return m.p.Payload }
+func (m v5Message) Ack()              {}
+
+// v5Token is the mqtt.Token of an MQTT 5 operation.
+type v5Token struct {
+	done chan struct{}
+	err  error
+}
+
+// runToken runs fn in the background and completes with its error.
+func runToken(fn func() error) *v5Token {
+	t := &v5Token{done: make(chan struct{})}
+	go func() {
+		t.err = fn()
+		close(t.done)
+	}()
+	return t
+}
+
+// doneToken is a token that already completed with err.
+func doneToken(err error) *v5Token {
+	t := &v5Token{done: make(chan struct{}), err: err}
+	close(t.done)
+	return t
+}
+
+func (t *v5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *v5Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *v5Token) Done() <-chan struct{} { return t.done }
+
+func (t *v5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// v5PublishToken also carries the reason code of the PUBACK or PUBREC.
+type v5PublishToken struct {
+	v5Token
+	code    byte
+	hasCode bool
+}
+
+// ReasonCode returns the broker's reason code; ok is false for QoS 0
+// publishes and publishes that got no reply.
+func (t *v5PublishToken) ReasonCode() (code byte, ok bool) {
+	select {
+	case <-t.done:
+		return t.code, t.hasCode
+	default:
+		return 0, false
+	}
+}
+
+// commandPublisher is implemented by clients that add properties to
+// command publishes.
+type commandPublisher interface {
+	PublishCommand(topic string, qos byte, payload []byte) mqtt.Token
+}
+
+// publishCommand publishes a Z2M /set command, with the MQTT 5 response
+// topic when the client supports it.
+func publishCommand(client mqtt.Client, topic string, qos byte, payload []byte) mqtt.Token {
+	if cp, ok := client.(commandPublisher); ok {
+		return cp.PublishCommand(topic, qos, payload)
+	}
+	return client.Publish(topic, qos, false, payload)
+}
+
+// publishReason formats the reason code of a completed publish for the
+// command log, or "" when the protocol or QoS gives none.
+func publishReason(token mqtt.Token) string {
+	rt, ok := token.(interface{ ReasonCode() (byte, bool) })
+	if !ok {
+		return ""
+	}
+	code, ok := rt.ReasonCode()
+	if !ok {
+		return ""
+	}
+	return " reason=" + reasonName(code)
+}
+
+// publishError is a publish the broker refused with an MQTT 5 reason code.
+type publishError struct {
+	Code   byte
+	Reason string // the broker's reason string, if any
+}
+
+func newPublishError(resp *paho.PublishResponse) *publishError {
+	err := &publishError{Code: resp.ReasonCode}
+	if resp.Properties != nil {
+		err.Reason = resp.Properties.ReasonString
+	}
+	return err
+}
+
+func (e *publishError) Error() string {
+	msg := "publish refused: " + reasonName(e.Code)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// connectError spells out the CONNACK reason code of a refused connection.
+func connectError(err error) error {
+	var ce *autopaho.ConnackError
+	if !errors.As(err, &ce) {
+		return err
+	}
+	msg := "connection refused: " + reasonName(ce.ReasonCode)
+	if ce.Reason != "" {
+		msg += ": " + ce.Reason
+	}
+	return errors.New(msg)
+}
+
+// disconnectError describes a DISCONNECT sent by the broker.
+func disconnectError(d *paho.Disconnect) error {
+	msg := "disconnected by broker: " + reasonName(d.ReasonCode)
+	if d.Properties != nil && d.Properties.ReasonString != "" {
+		msg += ": " + d.Properties.ReasonString
+	}
+	return errors.New(msg)
+}
+
+// reasonNames are the MQTT 5 reason codes a client sees in CONNACK,
+// PUBACK, PUBREC, SUBACK and DISCONNECT packets.
+var reasonNames = map[byte]string{
+	0x00: "success",
+	0x01: "granted QoS 1",
+	0x02: "granted QoS 2",
+	0x10: "no matching subscribers",
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8A: "banned",
+	0x8B: "server shutting down",
+	0x8C: "bad authentication method",
+	0x8D: "keep alive timeout",
+	0x8E: "session taken over",
+	0x8F: "topic filter invalid",
+	0x90: "topic name invalid",
+	0x91: "packet identifier in use",
+	0x93: "receive maximum exceeded",
+	0x95: "packet too large",
+	0x97: "quota exceeded",
+	0x99: "payload format invalid",
+	0x9A: "retain not supported",
+	0x9B: "QoS not supported",
+	0x9C: "use another server",
+	0x9D: "server moved",
+	0x9E: "shared subscriptions not supported",
+	0x9F: "connection rate exceeded",
+	0xA1: "subscription identifiers not supported",
+	0xA2: "wildcard subscriptions not supported",
+}
+
+// reasonName formats a reason code as "0x87 (not authorized)".
+func reasonName(code byte) string {
+	if name, ok := reasonNames[code]; ok {
+		return fmt.Sprintf("0x%02X (%s)", code, name)
+	}
+	return fmt.Sprintf("0x%02X", code)
+}
@@ -0,0 +1,531 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	domain "github.com/slidebolt/sb-domain"
+	storage "github.com/slidebolt/sb-storage-sdk"
+)
+
+// ---------------------------------------------------------------------------
+// Native discovery — entities from the exposes in <base_topic>/bridge/devices
+// ---------------------------------------------------------------------------
+
+// Discovery modes, see MQTTConfig.DiscoveryMode.
+const (
+	discoveryHomeAssistant = "homeassistant"
+	discoveryNative        = "native"
+	discoveryBoth          = "both"
+)
+
+func (c MQTTConfig) validateDiscoveryMode() error {
+	switch c.DiscoveryMode {
+	case "", discoveryHomeAssistant, discoveryNative, discoveryBoth:
+		return nil
+	default:
+		return fmt.Errorf("discovery_mode %q must be %q, %q or %q", c.DiscoveryMode, discoveryHomeAssistant, discoveryNative, discoveryBoth)
+	}
+}
+
+func (c MQTTConfig) haDiscovery() bool {
+	return c.DiscoveryMode != discoveryNative
+}
+
+func (c MQTTConfig) nativeDiscovery() bool {
+	return c.DiscoveryMode == discoveryNative || c.DiscoveryMode == discoveryBoth
+}
+
+// accessSet is the expose access bit of properties that can be written
+// through <base_topic>/<friendly_name>/set.
+const accessSet = 2
+
+// bridgeDevice is one entry of the retained <base_topic>/bridge/devices list.
+type bridgeDevice struct {
+	IEEEAddress     string            `json:"ieee_address"`
+	Type            string            `json:"type"`
+	FriendlyName    string            `json:"friendly_name"`
+	Disabled        bool              `json:"disabled"`
+	ModelID         string            `json:"model_id"`
+	SoftwareBuildID string            `json:"software_build_id"`
+	Definition      *deviceDefinition `json:"definition"`
+}
+
+type deviceDefinition struct {
+	Model       string   `json:"model"`
+	Vendor      string   `json:"vendor"`
+	Description string   `json:"description"`
+	Exposes     []expose `json:"exposes"`
+}
+
+// expose is one node of a definition's exposes tree. Specific exposes
+// (light, switch, cover, lock, climate, fan) and composites group Features.
+type expose struct {
+	Type      string          `json:"type"`
+	Name      string          `json:"name"`
+	Label     string          `json:"label"`
+	Property  string          `json:"property"`
+	Endpoint  string          `json:"endpoint"`
+	Access    int             `json:"access"`
+	Unit      string          `json:"unit"`
+	ValueMin  *float64        `json:"value_min"`
+	ValueMax  *float64        `json:"value_max"`
+	ValueStep *float64        `json:"value_step"`
+	ValueOn   json.RawMessage `json:"value_on"`
+	ValueOff  json.RawMessage `json:"value_off"`
+	Values    []string        `json:"values"`
+	Category  string          `json:"category"`
+	Features  []expose        `json:"features"`
+}
+
+func (e expose) feature(names ...string) (expose, bool) {
+	for _, name := range names {
+		for _, f := range e.Features {
+			if f.Name == name {
+				return f, true
+			}
+		}
+	}
+	return expose{}, false
+}
+
+func (e expose) label() string {
+	if e.Label != "" {
+		return e.Label
+	}
+	name := strings.ReplaceAll(e.Name, "_", " ")
+	if name == "" {
+		return ""
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// sensorDeviceClasses maps read-only numeric expose names to sensor classes.
+var sensorDeviceClasses = map[string]string{
+	"temperature": "temperature",
+	"humidity":    "humidity",
+	"pressure":    "pressure",
+	"illuminance": "illuminance",
+	"battery":     "battery",
+	"voltage":     "voltage",
+	"current":     "current",
+	"power":       "power",
+	"energy":      "energy",
+}
+
+// nativeEntity is an entity derived from one expose. Config is the HA
+// discovery config it is equivalent to, so the translate codecs and the
+// command path treat it like a discovered entity.
+type nativeEntity struct {
+	id       string
+	typ      string
+	config   map[string]any
+	property string
+	endpoint string
+	settable bool
+}
+
+// nativeEntities maps the exposes of a device to entities: specific
+// exposes to their own type, generic ones to a sensor or binary_sensor when
+// read-only and to a switch, number, select or text when settable.
+// Composites are flattened into their features.
+func nativeEntities(baseTopic string, dev bridgeDevice) []nativeEntity {
+	stateTopic := baseTopic + "/" + dev.FriendlyName
+	device := map[string]any{
+		"name":         dev.FriendlyName,
+		"identifiers":  []string{"zigbee2mqtt_" + dev.IEEEAddress},
+		"manufacturer": dev.Definition.Vendor,
+		"model":        dev.Definition.Model,
+		"model_id":     dev.ModelID,
+		"sw_version":   dev.SoftwareBuildID,
+	}
+
+	var out []nativeEntity
+	var walk func(e expose, parent string)
+	walk = func(e expose, parent string) {
+		switch e.Type {
+		case "light", "switch", "cover", "lock", "climate", "fan":
+			if parent == "" {
+				out = append(out, specificEntity(e, dev.FriendlyName))
+			}
+		case "binary", "numeric", "enum", "text":
+			if ne, ok := genericEntity(e, parent, dev.FriendlyName); ok {
+				out = append(out, ne)
+			}
+		case "composite":
+			if e.Property == "" {
+				return
+			}
+			for _, f := range e.Features {
+				walk(f, joinPath(parent, e.Property))
+			}
+		}
+	}
+	for _, e := range dev.Definition.Exposes {
+		walk(e, "")
+	}
+
+	for i := range out {
+		cfg := out[i].config
+		cfg["state_topic"] = stateTopic
+		if out[i].settable {
+			cfg["command_topic"] = stateTopic + "/set"
+		}
+		cfg["device"] = device
+	}
+	return out
+}
+
+func specificEntity(e expose, friendlyName string) nativeEntity {
+	ne := nativeEntity{id: e.Type, typ: e.Type, endpoint: e.Endpoint, settable: true}
+	name := friendlyName
+	if e.Endpoint != "" {
+		ne.id += "_" + e.Endpoint
+		name += " " + e.Endpoint
+	}
+	cfg := map[string]any{"name": name}
+
+	switch e.Type {
+	case "light":
+		if f, ok := e.feature("brightness"); ok {
+			cfg["brightness"] = true
+			if f.ValueMax != nil {
+				cfg["brightness_scale"] = int(*f.ValueMax)
+			}
+		}
+		if f, ok := e.feature("color_temp"); ok {
+			cfg["color_temp"] = true
+			if f.ValueMin != nil && f.ValueMax != nil {
+				cfg["min_mireds"] = int(*f.ValueMin)
+				cfg["max_mireds"] = int(*f.ValueMax)
+			}
+		}
+	case "switch":
+		if f, ok := e.feature("state"); ok {
+			setRaw(cfg, "payload_on", f.ValueOn)
+			setRaw(cfg, "payload_off", f.ValueOff)
+		}
+	case "lock":
+		if f, ok := e.feature("state"); ok {
+			setRaw(cfg, "payload_lock", f.ValueOn)
+			setRaw(cfg, "payload_unlock", f.ValueOff)
+		}
+	case "cover":
+		cfg["payload_open"] = "OPEN"
+		cfg["payload_close"] = "CLOSE"
+		cfg["payload_stop"] = "STOP"
+	case "climate":
+		if f, ok := e.feature("system_mode"); ok {
+			cfg["modes"] = f.Values
+		}
+		if f, ok := e.feature("occupied_heating_setpoint", "current_heating_setpoint"); ok {
+			if f.ValueMin != nil && f.ValueMax != nil {
+				cfg["min_temp"] = *f.ValueMin
+				cfg["max_temp"] = *f.ValueMax
+			}
+			if f.ValueStep != nil {
+				cfg["temp_step"] = *f.ValueStep
+			}
+			if f.Unit != "" {
+				cfg["temperature_unit"] = f.Unit
+			}
+		}
+	case "fan":
+		if f, ok := e.feature("mode"); ok {
+			cfg["preset_modes"] = f.Values
+		}
+	}
+	ne.config = cfg
+	return ne
+}
+
+func genericEntity(e expose, parent, friendlyName string) (nativeEntity, bool) {
+	if e.Property == "" {
+		return nativeEntity{}, false
+	}
+	path := joinPath(parent, e.Property)
+	ne := nativeEntity{id: strings.ReplaceAll(path, ".", "_"), property: path}
+	cfg := map[string]any{
+		"name":           strings.TrimSpace(friendlyName + " " + e.label()),
+		"value_template": "{{ value_json." + path + " }}",
+	}
+	settable := e.Access&accessSet != 0
+	ne.settable = settable
+	if e.Unit != "" {
+		cfg["unit_of_measurement"] = e.Unit
+	}
+	if e.Category != "" {
+		cfg["entity_category"] = e.Category
+	}
+
+	switch e.Type {
+	case "binary":
+		ne.typ = "binary_sensor"
+		if settable {
+			ne.typ = "switch"
+		}
+		setRaw(cfg, "payload_on", e.ValueOn)
+		setRaw(cfg, "payload_off", e.ValueOff)
+	case "numeric":
+		ne.typ = "sensor"
+		if settable {
+			ne.typ = "number"
+			if e.ValueMin != nil && e.ValueMax != nil {
+				cfg["min"] = *e.ValueMin
+				cfg["max"] = *e.ValueMax
+			}
+			if e.ValueStep != nil {
+				cfg["step"] = *e.ValueStep
+			}
+		} else if class, ok := sensorDeviceClasses[e.Name]; ok {
+			cfg["device_class"] = class
+		}
+	case "enum":
+		ne.typ = "sensor"
+		if settable {
+			ne.typ = "select"
+			cfg["options"] = e.Values
+		}
+	case "text":
+		ne.typ = "sensor"
+		if settable {
+			ne.typ = "text"
+		}
+	}
+	ne.config = cfg
+	return ne, true
+}
+
+func setRaw(cfg map[string]any, key string, v json.RawMessage) {
+	if len(v) > 0 {
+		cfg[key] = v
+	}
+}
+
+func joinPath(parent, property string) string {
+	if parent == "" {
+		return property
+	}
+	return parent + "." + property
+}
+
+// handleBridgeDevices applies friendly-name renames from a bridge/devices
+// message and, in native mode, maps its devices to entities. The list is
+// retained and republished whenever a device changes.
+func (in *instance) handleBridgeDevices(payload []byte) {
+	var devices []bridgeDevice
+	if err := json.Unmarshal(payload, &devices); err != nil {
+		log.Printf("plugin-zigbee2mqtt: [%s] failed to parse bridge/devices: %v", in.label(), err)
+		return
+	}
+	in.syncFriendlyNames(devices)
+	if in.cfg.nativeDiscovery() {
+		in.mapBridgeDevices(devices)
+	}
+}
+
+// mapBridgeDevices creates or refreshes the entities of every device and
+// removes native entities no longer listed.
+func (in *instance) mapBridgeDevices(devices []bridgeDevice) {
+	current := make(map[domain.EntityKey]bool)
+	for _, dev := range devices {
+		if dev.Type == "Coordinator" || dev.Disabled || dev.Definition == nil || dev.IEEEAddress == "" || dev.FriendlyName == "" {
+			continue
+		}
+		deviceID := in.deviceID(dev.IEEEAddress)
+		for _, ne := range nativeEntities(in.cfg.BaseTopic, dev) {
+			raw, err := json.Marshal(ne.config)
+			if err != nil {
+				continue
+			}
+			var discovery DiscoveryPayload
+			if err := json.Unmarshal(raw, &discovery); err != nil {
+				continue
+			}
+			key := domain.EntityKey{Plugin: pluginID, DeviceID: deviceID, ID: ne.id}
+			info := in.newTopicInfo(ne.typ, deviceID, discovery.Name, discovery, raw)
+			info.Native = true
+			info.Property = ne.property
+			info.Endpoint = ne.endpoint
+			if ne.property != "" {
+				// nativeState already projects the property; its
+				// value_template is for HA consumers of the config.
+				info.ValueField = "value"
+				info.Templates = nil
+			}
+			in.markSeen(key, true)
+			current[key] = true
+			in.upsertEntity(key, discovery, info)
+		}
+	}
+	log.Printf("plugin-zigbee2mqtt: [%s] bridge/devices: %d devices, %d entities", in.label(), len(devices), len(current))
+
+	in.dropNative(current)
+}
+
+// dropNative removes the native entities of this instance not in current.
+func (in *instance) dropNative(current map[domain.EntityKey]bool) {
+	entries, err := in.p.store.SearchFiles(storage.Internal, pluginID+".*.*")
+	if err != nil {
+		log.Printf("plugin-zigbee2mqtt: [%s] failed to search topic info: %v", in.label(), err)
+		return
+	}
+	for _, entry := range entries {
+		key, ok := parseEntityKey(entry.Key)
+		if !ok || current[key] {
+			continue
+		}
+		var info EntityTopicInfo
+		if err := json.Unmarshal(entry.Data, &info); err != nil {
+			continue
+		}
+		if info.Native && info.Instance == in.cfg.Name {
+			in.removeEntity(key, "removed from bridge/devices")
+		}
+	}
+}
+
+// nativeState projects a device state payload onto the keys the codec of a
+// native entity decodes: the value of Property, or the Endpoint-suffixed
+// keys with the suffix removed. Other entities get the payload unchanged.
+func nativeState(info EntityTopicInfo, payload []byte) ([]byte, bool) {
+	if info.Property == "" && info.Endpoint == "" {
+		return payload, true
+	}
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return nil, false
+	}
+
+	if info.Property != "" {
+		v, ok := lookupPath(state, info.Property)
+		if !ok {
+			return nil, false
+		}
+		var discovery DiscoveryPayload
+		_ = json.Unmarshal(info.Discovery, &discovery)
+		var projected map[string]any
+		switch info.EntityType {
+		case "switch":
+			power := "OFF"
+			if isOn(v, discovery.PayloadOn) {
+				power = "ON"
+			}
+			projected = map[string]any{"state": power}
+		case "binary_sensor":
+			projected = map[string]any{"value": isOn(v, discovery.PayloadOn)}
+		case "select":
+			projected = map[string]any{"option": v}
+		default:
+			projected = map[string]any{"value": v}
+		}
+		data, err := json.Marshal(projected)
+		return data, err == nil
+	}
+
+	suffix := "_" + info.Endpoint
+	out := make(map[string]json.RawMessage)
+	for k, v := range state {
+		if strings.HasSuffix(k, suffix) {
+			out[strings.TrimSuffix(k, suffix)] = v
+		}
+	}
+	if len(out) == 0 {
+		return nil, false
+	}
+	data, err := json.Marshal(out)
+	return data, err == nil
+}
+
+// nativeCommandKeys is the key holding the value in an encoded command, per
+// entity type of a single-property native entity.
+var nativeCommandKeys = map[string]string{
+	"switch": "state",
+	"number": "value",
+	"select": "state",
+	"text":   "text",
+}
+
+// nativeCommand rewrites an encoded command for a native entity: the value
+// is set on Property, or every key gets the Endpoint suffix.
+func nativeCommand(info EntityTopicInfo, payload json.RawMessage) json.RawMessage {
+	if info.Property == "" && info.Endpoint == "" {
+		return payload
+	}
+	var cmd map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return payload
+	}
+
+	if info.Property != "" {
+		v, ok := cmd[nativeCommandKeys[info.EntityType]]
+		if !ok {
+			return payload
+		}
+		if info.EntityType == "switch" {
+			var discovery DiscoveryPayload
+			_ = json.Unmarshal(info.Discovery, &discovery)
+			switch {
+			case bytes.Equal(v, []byte(`"ON"`)) && len(discovery.PayloadOn) > 0:
+				v = discovery.PayloadOn
+			case bytes.Equal(v, []byte(`"OFF"`)) && len(discovery.PayloadOff) > 0:
+				v = discovery.PayloadOff
+			}
+		}
+		parts := strings.Split(info.Property, ".")
+		var out any = v
+		for i := len(parts) - 1; i >= 0; i-- {
+			out = map[string]any{parts[i]: out}
+		}
+		data, err := json.Marshal(out)
+		if err != nil {
+			return payload
+		}
+		return data
+	}
+
+	out := make(map[string]json.RawMessage, len(cmd))
+	for k, v := range cmd {
+		out[k+"_"+info.Endpoint] = v
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return payload
+	}
+	return data
+}
+
+// lookupPath returns the value at a dotted path in a state payload.
+func lookupPath(state map[string]json.RawMessage, path string) (json.RawMessage, bool) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		var next map[string]json.RawMessage
+		if err := json.Unmarshal(state[part], &next); err != nil {
+			return nil, false
+		}
+		state = next
+	}
+	v, ok := state[parts[len(parts)-1]]
+	return v, ok
+}
+
+// isOn compares a state value with the expose's value_on, defaulting to
+// true or "ON" when the expose has none.
+func isOn(v, on json.RawMessage) bool {
+	if len(on) > 0 {
+		var a, b bytes.Buffer
+		if json.Compact(&a, v) != nil || json.Compact(&b, on) != nil {
+			return false
+		}
+		return bytes.Equal(a.Bytes(), b.Bytes())
+	}
+	var s string
+	if json.Unmarshal(v, &s) == nil {
+		return strings.EqualFold(s, "on")
+	}
+	var on2 bool
+	return json.Unmarshal(v, &on2) == nil && on2
+}
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	domain "github.com/slidebolt/sb-domain"
+)
+
+// ---------------------------------------------------------------------------
+// Offline command queue — holds commands while the broker is unreachable
+// ---------------------------------------------------------------------------
+
+// queuedCommand is an encoded command waiting for the broker to come back.
+type queuedCommand struct {
+	key       domain.EntityKey
+	cmdType   string
+	topic     string
+	payload   []byte
+	queuedAt  time.Time
+	expiresAt time.Time
+	// prevState is the entity state before the first optimistic update that
+	// is still pending, restored if the command never reaches the broker.
+	prevState any
+}
+
+// commandQueue is a bounded FIFO with one pending command per entity: a newer
+// command for the same entity replaces the older one (latest wins).
+type commandQueue struct {
+	mu    sync.Mutex
+	max   int
+	items []queuedCommand
+}
+
+func newCommandQueue(max int) *commandQueue {
+	return &commandQueue{max: max}
+}
+
+// push enqueues cmd and returns the commands dropped to make room for it.
+// A command already queued for the same entity is replaced; the rollback
+// state of the replaced command is kept, since it predates both updates.
+func (q *commandQueue) push(cmd queuedCommand) (dropped []queuedCommand) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, item := range q.items {
+		if item.key == cmd.key {
+			cmd.prevState = item.prevState
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			break
+		}
+	}
+	for len(q.items) >= q.max {
+		dropped = append(dropped, q.items[0])
+		q.items = q.items[1:]
+	}
+	q.items = append(q.items, cmd)
+	return dropped
+}
+
+// expire removes and returns the commands whose TTL has passed.
+func (q *commandQueue) expire(now time.Time) (expired []queuedCommand) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	kept := q.items[:0]
+	for _, item := range q.items {
+		if now.After(item.expiresAt) {
+			expired = append(expired, item)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	q.items = kept
+	return expired
+}
+
+// take removes and returns every queued command in enqueue order.
+func (q *commandQueue) take() []queuedCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := q.items
+	q.items = nil
+	return items
+}
+
+// enqueueCommand queues cmd for the next connection. Commands pushed out of
+// a full queue, or issued with the queue disabled, fail immediately.
+func (in *instance) enqueueCommand(cmd queuedCommand) {
+	if in.cfg.CommandQueueSize <= 0 {
+		in.p.failCommand(cmd, "MQTT not connected")
+		return
+	}
+	for _, dropped := range in.queue.push(cmd) {
+		in.p.failCommand(dropped, "queue full")
+	}
+}
+
+// drainQueue publishes the queued commands in order once the broker is back.
+// Commands that expired while waiting are failed instead of sent.
+func (in *instance) drainQueue(client mqtt.Client) {
+	now := time.Now()
+	for _, cmd := range in.queue.take() {
+		if now.After(cmd.expiresAt) {
+			in.p.failCommand(cmd, "expired")
+			continue
+		}
+		token := publishCommand(client, cmd.topic, in.cfg.CommandQoS, cmd.payload)
+		acked := token.WaitTimeout(5 * time.Second)
+		if token.Error() != nil {
+			in.p.failCommand(cmd, token.Error().Error())
+			continue
+		}
+		if !acked {
+			in.p.failCommand(cmd, "publish not acknowledged")
+			continue
+		}
+		log.Printf("plugin-zigbee2mqtt: [CMD] SENT entity=%s topic=%s queued=%s", cmd.key.Key(), cmd.topic, now.Sub(cmd.queuedAt).Round(time.Millisecond))
+	}
+}
+
+// expireLoop fails queued commands as their TTL runs out, so the optimistic
+// state is rolled back while the broker is still down rather than on reconnect.
+func (in *instance) expireLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, cmd := range in.queue.expire(now) {
+				in.p.failCommand(cmd, "expired")
+			}
+		}
+	}
+}
+
+// failCommand rolls back the optimistic state of a command that never
+// reached the broker and reports the failure.
+func (p *plugin) failCommand(cmd queuedCommand, reason string) {
+	log.Printf("plugin-zigbee2mqtt: [CMD] FAIL entity=%s type=%s reason=%s", cmd.key.Key(), cmd.cmdType, reason)
+	p.rollbackState(cmd.key, cmd.prevState)
+	p.publishEvent(eventCommandFailed, CommandFailedEvent{
+		Entity:   cmd.key.Key(),
+		Command:  cmd.cmdType,
+		Reason:   reason,
+		QueuedAt: cmd.queuedAt,
+	})
+}
+
+// rollbackState restores an entity's state after a failed command. A nil
+// state means the entity had none, so no optimistic update was applied.
+func (p *plugin) rollbackState(key domain.EntityKey, state any) {
+	if p.store == nil || state == nil {
+		return
+	}
+	raw, err := p.store.Get(key)
+	if err != nil {
+		log.Printf("plugin-zigbee2mqtt: rollback %s: %v", key.Key(), err)
+		return
+	}
+	var entity domain.Entity
+	if err := json.Unmarshal(raw, &entity); err != nil {
+		log.Printf("plugin-zigbee2mqtt: rollback %s: %v", key.Key(), err)
+		return
+	}
+	entity.State = state
+	if err := p.saveEntity(entity, readEntityMeta(raw)); err != nil {
+		log.Printf("plugin-zigbee2mqtt: rollback %s: %v", key.Key(), err)
+	}
+}
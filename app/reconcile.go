@@ -0,0 +1,241 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	domain "github.com/slidebolt/sb-domain"
+	storage "github.com/slidebolt/sb-storage-sdk"
+)
+
+// ---------------------------------------------------------------------------
+// Reconciliation — finds entities whose device is gone from Zigbee2MQTT
+// ---------------------------------------------------------------------------
+
+// Orphan actions, see MQTTConfig.OrphanAction.
+const (
+	orphanMark   = "mark"
+	orphanDelete = "delete"
+)
+
+const eventReconcileReport = "reconcile_report"
+
+// ReconcileReport summarises one reconciliation pass of an instance.
+type ReconcileReport struct {
+	Instance   string    `json:"instance,omitempty"`
+	Action     string    `json:"action"`
+	Discovered int       `json:"discovered"`
+	Orphaned   []string  `json:"orphaned"`
+	At         time.Time `json:"at"`
+}
+
+func (c MQTTConfig) validateReconcile() error {
+	if c.ReconcileAfterSeconds < 0 {
+		return fmt.Errorf("reconcile_after_seconds %d must not be negative", c.ReconcileAfterSeconds)
+	}
+	switch c.OrphanAction {
+	case "", orphanMark, orphanDelete:
+		return nil
+	default:
+		return fmt.Errorf("orphan_action %q must be %q or %q", c.OrphanAction, orphanMark, orphanDelete)
+	}
+}
+
+// markSeen records that a discovery config for key arrived on the current
+// connection.
+func (in *instance) markSeen(key domain.EntityKey, seen bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if seen {
+		in.seen[key] = true
+	} else {
+		delete(in.seen, key)
+	}
+}
+
+// scheduleReconcile starts the settle window after a (re)connect. The broker
+// replays every retained discovery config on subscribe, so once the window
+// has passed, anything stored but not replayed no longer exists in Z2M.
+func (in *instance) scheduleReconcile() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.seen = make(map[domain.EntityKey]bool)
+	if in.reconcileTimer != nil {
+		in.reconcileTimer.Stop()
+		in.reconcileTimer = nil
+	}
+	if in.cfg.ReconcileAfterSeconds <= 0 {
+		return
+	}
+	in.reconcileTimer = time.AfterFunc(time.Duration(in.cfg.ReconcileAfterSeconds)*time.Second, in.reconcile)
+}
+
+// cancelReconcile stops a pending pass; a lost connection may have cut the
+// discovery replay short.
+func (in *instance) cancelReconcile() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.reconcileTimer != nil {
+		in.reconcileTimer.Stop()
+		in.reconcileTimer = nil
+	}
+}
+
+// reconcile marks or deletes the stored entities of this instance that were
+// not rediscovered, then publishes a ReconcileReport.
+func (in *instance) reconcile() {
+	p := in.p
+	in.mu.Lock()
+	in.reconcileTimer = nil
+	seen := make(map[domain.EntityKey]bool, len(in.seen))
+	for key := range in.seen {
+		seen[key] = true
+	}
+	in.mu.Unlock()
+
+	// An empty replay means the broker lost its retained configs or
+	// discovery is disabled, not that every device was removed.
+	if len(seen) == 0 {
+		log.Printf("plugin-zigbee2mqtt: [%s] no discovery configs received; skipping reconciliation", in.label())
+		return
+	}
+
+	orphans, err := in.storedEntityKeys()
+	if err != nil {
+		log.Printf("plugin-zigbee2mqtt: [%s] reconcile: %v", in.label(), err)
+		return
+	}
+
+	action := in.cfg.OrphanAction
+	if action == "" {
+		action = orphanMark
+	}
+	report := ReconcileReport{
+		Instance:   in.cfg.Name,
+		Action:     action,
+		Discovered: len(seen),
+		Orphaned:   []string{},
+		At:         time.Now(),
+	}
+	for _, key := range orphans {
+		if seen[key] {
+			continue
+		}
+		report.Orphaned = append(report.Orphaned, key.Key())
+		if action == orphanDelete {
+			in.removeEntity(key, "not rediscovered")
+		} else {
+			in.markOrphaned(key, report.At)
+		}
+	}
+	sort.Strings(report.Orphaned)
+
+	log.Printf("plugin-zigbee2mqtt: [%s] reconciled: %d discovered, %d orphaned (%s)", in.label(), report.Discovered, len(report.Orphaned), action)
+	p.publishEvent(eventReconcileReport, report)
+}
+
+// storedEntityKeys lists the entities in storage that belong to this
+// instance: those whose topic info names it, plus entities without topic
+// info in its device namespace. Plugin-owned devices are skipped.
+func (in *instance) storedEntityKeys() ([]domain.EntityKey, error) {
+	p := in.p
+	infos, err := p.store.SearchFiles(storage.Internal, pluginID+".*.*")
+	if err != nil {
+		return nil, fmt.Errorf("search topic info: %w", err)
+	}
+	entities, err := p.store.Search(pluginID + ".*.*")
+	if err != nil {
+		return nil, fmt.Errorf("search entities: %w", err)
+	}
+
+	owned := make(map[domain.EntityKey]bool)
+	withInfo := make(map[domain.EntityKey]bool)
+	for _, entry := range infos {
+		key, ok := parseEntityKey(entry.Key)
+		if !ok {
+			continue
+		}
+		var info EntityTopicInfo
+		if err := json.Unmarshal(entry.Data, &info); err != nil {
+			continue
+		}
+		withInfo[key] = true
+		if info.Instance == in.cfg.Name {
+			owned[key] = true
+		}
+	}
+	for _, entry := range entities {
+		key, ok := parseEntityKey(entry.Key)
+		if !ok || withInfo[key] || p.ownsDevice(key.DeviceID) {
+			continue
+		}
+		if p.deviceOwner(key.DeviceID) == in {
+			owned[key] = true
+		}
+	}
+
+	keys := make([]domain.EntityKey, 0, len(owned))
+	for key := range owned {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// markOrphaned flags an entity's topic info as orphaned; rediscovery
+// rewrites the record and clears the flag.
+func (in *instance) markOrphaned(key domain.EntityKey, at time.Time) {
+	info, err := in.p.getTopicInfo(key)
+	if err != nil {
+		info = EntityTopicInfo{DeviceID: key.DeviceID, Instance: in.cfg.Name}
+	}
+	if info.OrphanedAt != nil {
+		return
+	}
+	info.OrphanedAt = &at
+	if err := in.saveTopicInfo(key, info); err != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to mark %s orphaned: %v", key.Key(), err)
+	}
+}
+
+// ownsDevice reports whether a device ID belongs to the plugin itself rather
+// than to a Zigbee2MQTT network.
+func (p *plugin) ownsDevice(deviceID string) bool {
+	if deviceID == demoDeviceID {
+		return true
+	}
+	for _, in := range p.runningInstances() {
+		if deviceID == in.deviceID(bridgeDeviceID) {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceOwner returns the instance whose namespace a device ID falls in:
+// the named instance whose prefix it carries, otherwise the unnamed one.
+func (p *plugin) deviceOwner(deviceID string) *instance {
+	var unnamed *instance
+	for _, in := range p.runningInstances() {
+		if in.cfg.Name == "" {
+			unnamed = in
+			continue
+		}
+		if strings.HasPrefix(deviceID, in.cfg.Name+"_") {
+			return in
+		}
+	}
+	return unnamed
+}
+
+// parseEntityKey splits a "plugin.device.entity" storage key.
+func parseEntityKey(s string) (domain.EntityKey, bool) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return domain.EntityKey{}, false
+	}
+	return domain.EntityKey{Plugin: parts[0], DeviceID: parts[1], ID: parts[2]}, true
+}
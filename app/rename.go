@@ -0,0 +1,308 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+
+	domain "github.com/slidebolt/sb-domain"
+)
+
+// ---------------------------------------------------------------------------
+// Renames — entities keyed on the IEEE address follow friendly-name changes
+// ---------------------------------------------------------------------------
+
+// rememberNode records the IEEE address behind a discovery node ID, so a
+// cleared config, which has no device block, resolves to the same device.
+func (in *instance) rememberNode(nodeID, ieee string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.nodes[nodeID] = ieee
+}
+
+// nodeDevice returns the Z2M device ID for a discovery node ID.
+func (in *instance) nodeDevice(nodeID string) string {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	if ieee, ok := in.nodes[nodeID]; ok {
+		return ieee
+	}
+	return nodeID
+}
+
+// migrateEntity moves an entity stored under its node ID key, as before
+// devices were keyed on their IEEE address, to the IEEE key to: the entity
+// with its state, metadata and custom name, its topic info and its link in
+// the device record. Nothing happens unless from is indexed and to is not.
+func (in *instance) migrateEntity(from, to domain.EntityKey) {
+	p := in.p
+	in.mu.RLock()
+	_, stale := in.indexed[from]
+	_, known := in.indexed[to]
+	in.mu.RUnlock()
+	if !stale || known {
+		return
+	}
+	info, err := p.getTopicInfo(from)
+	if err != nil {
+		return
+	}
+
+	if raw, err := p.store.Get(from); err == nil {
+		var entity domain.Entity
+		if err := json.Unmarshal(raw, &entity); err == nil {
+			entity.DeviceID = to.DeviceID
+			if err := p.saveEntity(entity, readEntityMeta(raw)); err != nil {
+				log.Printf("plugin-zigbee2mqtt: failed to move entity %s: %v", from.Key(), err)
+				return
+			}
+		}
+		if err := p.store.Delete(from); err != nil {
+			log.Printf("plugin-zigbee2mqtt: failed to delete entity %s: %v", from.Key(), err)
+		}
+	}
+
+	info.DeviceID = to.DeviceID
+	if err := in.saveTopicInfo(to, info); err != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to save topic info %s: %v", to.Key(), err)
+		return
+	}
+	in.mu.Lock()
+	if values, ok := in.availability[from]; ok {
+		in.availability[to] = values
+	}
+	if available, ok := in.available[from]; ok {
+		in.available[to] = available
+	}
+	in.mu.Unlock()
+	if err := in.deleteTopicInfo(from); err != nil {
+		log.Printf("plugin-zigbee2mqtt: failed to delete topic info %s: %v", from.Key(), err)
+	}
+	in.forgetCandidate(from)
+	in.markSeen(from, false)
+
+	if old, ok := p.getDevice(from.DeviceID); ok {
+		dev, ok := p.getDevice(to.DeviceID)
+		if !ok {
+			dev = old
+			dev.ID = to.DeviceID
+			dev.Entities = nil
+		}
+		if !slices.Contains(dev.Entities, to.ID) {
+			dev.Entities = append(dev.Entities, to.ID)
+		}
+		if err := p.store.Save(dev); err != nil {
+			log.Printf("plugin-zigbee2mqtt: failed to save device %s: %v", dev.ID, err)
+		}
+	}
+	p.unlinkDevice(from)
+
+	log.Printf("plugin-zigbee2mqtt: [%s] moved %s to %s", in.label(), from.Key(), to.Key())
+}
+
+// customName reports whether the stored entity name was changed by the user,
+// i.e. differs from the name the plugin generated for it last.
+func (in *instance) customName(key domain.EntityKey, name string) bool {
+	if name == "" {
+		return false
+	}
+	info, err := in.p.getTopicInfo(key)
+	if err != nil || info.FriendlyName == "" {
+		return false
+	}
+	return name != info.FriendlyName
+}
+
+// handleRenameResponse applies the rename Z2M reports on
+// bridge/response/device/rename after a change in its frontend or API.
+func (in *instance) handleRenameResponse(payload []byte) {
+	var resp struct {
+		Status string `json:"status"`
+		Data   struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		log.Printf("plugin-zigbee2mqtt: [%s] failed to parse rename response: %v", in.label(), err)
+		return
+	}
+	if resp.Status != "ok" || resp.Data.From == "" || resp.Data.To == "" || resp.Data.From == resp.Data.To {
+		return
+	}
+
+	in.mu.RLock()
+	keys := slices.Clone(in.stateTopicIndex[in.cfg.BaseTopic+"/"+resp.Data.From])
+	in.mu.RUnlock()
+	in.renameEntities(keys, resp.Data.From, resp.Data.To)
+}
+
+// syncFriendlyNames catches renames that happened while the plugin was not
+// listening: a device whose entities still use another friendly name in
+// their state topic than bridge/devices lists is renamed.
+func (in *instance) syncFriendlyNames(devices []bridgeDevice) {
+	p := in.p
+	prefix := in.cfg.BaseTopic + "/"
+	for _, d := range devices {
+		if d.IEEEAddress == "" || d.FriendlyName == "" {
+			continue
+		}
+		dev, ok := p.getDevice(in.deviceID(d.IEEEAddress))
+		if !ok {
+			continue
+		}
+		keys := make([]domain.EntityKey, 0, len(dev.Entities))
+		from := ""
+		for _, id := range dev.Entities {
+			key := domain.EntityKey{Plugin: pluginID, DeviceID: dev.ID, ID: id}
+			keys = append(keys, key)
+			if from != "" {
+				continue
+			}
+			if info, err := p.getTopicInfo(key); err == nil && strings.HasPrefix(info.StateTopic, prefix) {
+				from = strings.TrimPrefix(info.StateTopic, prefix)
+			}
+		}
+		if from != "" && from != d.FriendlyName {
+			in.renameEntities(keys, from, d.FriendlyName)
+		}
+	}
+}
+
+// renameEntities moves entities from the friendly name from to to in place:
+// their topics, the state topic index and any generated names. Keys, state
+// and names the user changed are kept.
+func (in *instance) renameEntities(keys []domain.EntityKey, from, to string) {
+	if len(keys) == 0 {
+		return
+	}
+	p := in.p
+	oldBase := in.cfg.BaseTopic + "/" + from
+	newBase := in.cfg.BaseTopic + "/" + to
+
+	renamed := []string{}
+	devices := make(map[string]bool)
+	for _, key := range keys {
+		info, err := p.getTopicInfo(key)
+		if err != nil {
+			continue
+		}
+		info.StateTopic = renameTopic(info.StateTopic, oldBase, newBase)
+		info.CommandTopic = renameTopic(info.CommandTopic, oldBase, newBase)
+		info.Availability = renameTopic(info.Availability, oldBase, newBase)
+		for i, src := range info.AvailabilitySources {
+			info.AvailabilitySources[i].Topic = renameTopic(src.Topic, oldBase, newBase)
+		}
+		info.AttributesTopic = renameTopic(info.AttributesTopic, oldBase, newBase)
+		info.Discovery = renameDiscoveryTopics(info.Discovery, oldBase, newBase)
+
+		generated := info.FriendlyName
+		info.FriendlyName = renameGeneratedName(generated, from, to)
+		if raw, err := p.store.Get(key); err == nil {
+			var entity domain.Entity
+			if err := json.Unmarshal(raw, &entity); err == nil {
+				meta := readEntityMeta(raw)
+				attrTopic := renameTopic(meta.JSONAttributesTopic, oldBase, newBase)
+				rename := entity.Name == generated && generated != info.FriendlyName
+				if rename || attrTopic != meta.JSONAttributesTopic {
+					if rename {
+						entity.Name = info.FriendlyName
+					}
+					meta.JSONAttributesTopic = attrTopic
+					if err := p.saveEntity(entity, meta); err != nil {
+						log.Printf("plugin-zigbee2mqtt: failed to rename entity %s: %v", key.Key(), err)
+					}
+				}
+			}
+		}
+		if err := in.saveTopicInfo(key, info); err != nil {
+			log.Printf("plugin-zigbee2mqtt: failed to save topic info %s: %v", key.Key(), err)
+			continue
+		}
+		renamed = append(renamed, key.Key())
+		devices[key.DeviceID] = true
+	}
+
+	for deviceID := range devices {
+		if dev, ok := p.getDevice(deviceID); ok && dev.Name == from {
+			dev.Name = to
+			if err := p.store.Save(dev); err != nil {
+				log.Printf("plugin-zigbee2mqtt: failed to save device %s: %v", deviceID, err)
+			}
+		}
+	}
+	sort.Strings(renamed)
+
+	log.Printf("plugin-zigbee2mqtt: [%s] renamed %q to %q (%d entities)", in.label(), from, to, len(renamed))
+	p.publishEvent(eventDeviceRenamed, DeviceRenamedEvent{
+		Instance: in.cfg.Name,
+		From:     from,
+		To:       to,
+		Entities: renamed,
+	})
+}
+
+// renameTopic replaces the oldBase prefix of topic with newBase.
+func renameTopic(topic, oldBase, newBase string) string {
+	if topic == oldBase {
+		return newBase
+	}
+	if rest, ok := strings.CutPrefix(topic, oldBase+"/"); ok {
+		return newBase + "/" + rest
+	}
+	return topic
+}
+
+// renameGeneratedName renames a name generated from the friendly name from:
+// the friendly name itself, or it followed by a suffix such as an endpoint
+// or property label. Other names don't derive from it and are kept.
+func renameGeneratedName(name, from, to string) string {
+	if name == from {
+		return to
+	}
+	if rest, ok := strings.CutPrefix(name, from+" "); ok {
+		return to + " " + rest
+	}
+	return name
+}
+
+// renameDiscoveryTopics applies renameTopic to the topics of a stored
+// discovery config, abbreviated or not, including those nested in
+// availability lists and other objects.
+func renameDiscoveryTopics(raw json.RawMessage, oldBase, newBase string) json.RawMessage {
+	if len(raw) == 0 {
+		return raw
+	}
+	var cfg map[string]any
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return raw
+	}
+	renameNestedTopics(cfg, oldBase, newBase)
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return raw
+	}
+	return data
+}
+
+// renameNestedTopics renames the topic values in v in place, descending into
+// objects and arrays. Availability entries hold theirs under "topic" or "t".
+func renameNestedTopics(v any, oldBase, newBase string) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			topicKey := strings.HasSuffix(k, "_topic") || strings.HasSuffix(k, "_t") || k == "topic" || k == "t" || k == "~"
+			if s, ok := item.(string); ok && topicKey {
+				v[k] = renameTopic(s, oldBase, newBase)
+				continue
+			}
+			renameNestedTopics(item, oldBase, newBase)
+		}
+	case []any:
+		for _, item := range v {
+			renameNestedTopics(item, oldBase, newBase)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/slidebolt/plugin-zigbee2mqtt/internal/template"
+	domain "github.com/slidebolt/sb-domain"
+)
+
+// ---------------------------------------------------------------------------
+// Templates — discovery value, state, position and command templates
+// ---------------------------------------------------------------------------
+
+// Discovery options holding the templates stored in EntityTopicInfo.
+const (
+	optValueTemplate      = "value_template"
+	optStateValueTemplate = "state_value_template"
+	optPositionTemplate   = "position_template"
+	optCommandTemplate    = "command_template"
+)
+
+// stateTemplate is a template whose result is projected onto a state key.
+type stateTemplate struct {
+	option string
+	key    string
+}
+
+// stateTemplates lists, per entity type, the templates applied to state
+// messages and the key the codecs read each result from.
+var stateTemplates = map[string][]stateTemplate{
+	"sensor":        {{optValueTemplate, "value"}},
+	"binary_sensor": {{optValueTemplate, "value"}},
+	"switch":        {{optValueTemplate, "state"}},
+	"lock":          {{optValueTemplate, "state"}},
+	"light":         {{optStateValueTemplate, "state"}},
+	"fan":           {{optStateValueTemplate, "state"}},
+	"cover":         {{optValueTemplate, "state"}, {optPositionTemplate, "position"}},
+	"number":        {{optValueTemplate, "value"}},
+	"select":        {{optValueTemplate, "option"}},
+	"text":          {{optValueTemplate, "value"}},
+}
+
+// discoveryTemplates collects the templates of a discovery config. A
+// value_template the sensor codecs handle as a plain field lookup is left
+// to them.
+func discoveryTemplates(entityType string, d DiscoveryPayload, valueField string) map[string]string {
+	templates := make(map[string]string)
+	if d.ValueTemplate != "" && (valueField == "" || (entityType != "sensor" && entityType != "binary_sensor")) {
+		templates[optValueTemplate] = d.ValueTemplate
+	}
+	for option, src := range map[string]string{
+		optStateValueTemplate: d.StateValueTemplate,
+		optPositionTemplate:   d.PositionTemplate,
+		optCommandTemplate:    d.CommandTemplate,
+	} {
+		if src != "" {
+			templates[option] = src
+		}
+	}
+	if len(templates) == 0 {
+		return nil
+	}
+	return templates
+}
+
+// stateField is the field the sensor codecs read: "value" when a template
+// projected its result there, otherwise the plain value_template field.
+func (info EntityTopicInfo) stateField() string {
+	if info.Templates[optValueTemplate] != "" {
+		return "value"
+	}
+	return info.ValueField
+}
+
+// templateCache holds the parsed templates of each entity, so a template is
+// parsed once per discovery config instead of on every message. The zero
+// value is ready to use.
+type templateCache struct {
+	mu      sync.Mutex
+	entries map[domain.EntityKey]map[string]cachedTemplate
+}
+
+type cachedTemplate struct {
+	tmpl *template.Template
+	err  error
+}
+
+// get returns the parsed src of key's entity. Parse errors are cached and
+// logged once.
+func (c *templateCache) get(key domain.EntityKey, src string) (*template.Template, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key][src]; ok {
+		return entry.tmpl, entry.err
+	}
+	tmpl, err := template.Parse(src)
+	if err != nil {
+		log.Printf("plugin-zigbee2mqtt: unsupported template for %s: %v", key.Key(), err)
+	}
+	if c.entries == nil {
+		c.entries = make(map[domain.EntityKey]map[string]cachedTemplate)
+	}
+	if c.entries[key] == nil {
+		c.entries[key] = make(map[string]cachedTemplate)
+	}
+	c.entries[key][src] = cachedTemplate{tmpl, err}
+	return tmpl, err
+}
+
+// forget drops the templates of key's entity, whose discovery config
+// changed or went away.
+func (c *templateCache) forget(key domain.EntityKey) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
+
+// render renders src against a message for key's entity. ok is false when
+// the template does not parse or fails on this message, which is skipped
+// like any other payload the codecs cannot decode.
+func (c *templateCache) render(key domain.EntityKey, src string, payload []byte) (string, bool) {
+	tmpl, err := c.get(key, src)
+	if err != nil {
+		return "", false
+	}
+	out, err := tmpl.RenderValue(payload)
+	return out, err == nil
+}
+
+// renderJSON is render for a template whose result is decoded as JSON: a
+// mapping or list it outputs is rendered as JSON.
+func (c *templateCache) renderJSON(key domain.EntityKey, src string, payload []byte) (string, bool) {
+	tmpl, err := c.get(key, src)
+	if err != nil {
+		return "", false
+	}
+	out, err := tmpl.RenderJSON(payload)
+	return out, err == nil
+}
+
+// templateState applies the state templates of an entity to a state
+// message, projecting their results onto the keys the codecs read like
+// nativeState does for native properties.
+func (p *plugin) templateState(key domain.EntityKey, info EntityTopicInfo, payload []byte) ([]byte, bool) {
+	if len(info.Templates) == 0 {
+		return payload, true
+	}
+	var state map[string]any
+	if err := json.Unmarshal(payload, &state); err != nil || state == nil {
+		state = make(map[string]any)
+	}
+	var discovery DiscoveryPayload
+	applied := false
+	for _, st := range stateTemplates[info.EntityType] {
+		src := info.Templates[st.option]
+		if src == "" {
+			continue
+		}
+		out, ok := p.templates.render(key, src, payload)
+		if !ok {
+			return nil, false
+		}
+		if !applied {
+			_ = json.Unmarshal(info.Discovery, &discovery)
+			applied = true
+		}
+		v, ok := projectTemplate(info.EntityType, st.key, out, discovery)
+		if !ok {
+			return nil, false
+		}
+		state[st.key] = v
+		if info.EntityType == "lock" {
+			// The lock codec reads LOCK from state and LOCKED from
+			// lock_state; a template may produce either.
+			state["lock_state"] = v
+		}
+	}
+	if !applied {
+		return payload, true
+	}
+	data, err := json.Marshal(state)
+	return data, err == nil
+}
+
+// projectTemplate converts a rendered template into the value the codecs
+// expect under key. On/off entities compare it with their payload_on and
+// payload_off; results matching neither are skipped, as HA does.
+func projectTemplate(entityType, key, out string, d DiscoveryPayload) (any, bool) {
+	switch entityType {
+	case "binary_sensor", "switch":
+		on := templatePayload(d.PayloadOn, "ON")
+		off := templatePayload(d.PayloadOff, "OFF")
+		var power bool
+		switch {
+		case strings.EqualFold(out, on):
+			power = true
+		case strings.EqualFold(out, off):
+			power = false
+		default:
+			return nil, false
+		}
+		if entityType == "binary_sensor" {
+			return power, true
+		}
+		if power {
+			return "ON", true
+		}
+		return "OFF", true
+	case "sensor":
+		if f, err := strconv.ParseFloat(out, 64); err == nil {
+			return f, true
+		}
+		return out, out != ""
+	case "number":
+		f, err := strconv.ParseFloat(out, 64)
+		return f, err == nil
+	case "cover":
+		if key != "position" {
+			return out, true
+		}
+		f, err := strconv.ParseFloat(out, 64)
+		return int(math.Round(f)), err == nil
+	}
+	return out, true
+}
+
+// templatePayload returns a payload option as it compares with rendered
+// templates: JSON booleans render as Python's True and False.
+func templatePayload(raw json.RawMessage, def string) string {
+	if len(raw) == 0 {
+		return def
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return def
+	}
+	switch x := v.(type) {
+	case string:
+		return x
+	case bool:
+		if x {
+			return "True"
+		}
+		return "False"
+	case nil:
+		return def
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+// commandValue is the value a command_template renders, as Home Assistant
+// passes it: the number, option or text being set, or the configured
+// payload of a switch, fan, lock or button command. ok is false for the
+// other commands, such as light and cover ones, which HA templates through
+// separate per-attribute options; they are published as encoded.
+func commandValue(cmd any, d DiscoveryPayload) (value any, ok bool) {
+	payload := func(raw json.RawMessage, def string) string {
+		if s := d.GetPayloadString(raw); s != "" {
+			return s
+		}
+		return def
+	}
+	switch c := cmd.(type) {
+	case domain.NumberSetValue:
+		return c.Value, true
+	case domain.SelectOption:
+		return c.Option, true
+	case domain.TextSetValue:
+		return c.Value, true
+	case domain.SwitchTurnOn, domain.FanTurnOn:
+		return payload(d.PayloadOn, "ON"), true
+	case domain.SwitchTurnOff, domain.FanTurnOff:
+		return payload(d.PayloadOff, "OFF"), true
+	case domain.LockLock:
+		return payload(d.PayloadLock, "LOCK"), true
+	case domain.LockUnlock:
+		return payload(d.PayloadUnlock, "UNLOCK"), true
+	case domain.ButtonPress:
+		return payload(d.PayloadPress, "PRESS"), true
+	}
+	return nil, false
+}
+
+// commandTemplate renders the command_template of an entity, if it has
+// one and the command has a value for it, in place of the encoded payload.
+// The rendered text is published as is, JSON or not.
+func (p *plugin) commandTemplate(key domain.EntityKey, info EntityTopicInfo, cmd any, payload json.RawMessage) ([]byte, error) {
+	src := info.Templates[optCommandTemplate]
+	if src == "" {
+		return payload, nil
+	}
+	var discovery DiscoveryPayload
+	_ = json.Unmarshal(info.Discovery, &discovery)
+	value, ok := commandValue(cmd, discovery)
+	if !ok {
+		return payload, nil
+	}
+	tmpl, err := p.templates.get(key, src)
+	if err != nil {
+		return nil, err
+	}
+	out, err := tmpl.RenderCommand(value)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
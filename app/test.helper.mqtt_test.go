@@ -0,0 +1,122 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeToken is an already-completed mqtt.Token, or with timeout set one
+// whose acknowledgement never arrives.
+type fakeToken struct {
+	err     error
+	timeout bool
+}
+
+func (t fakeToken) Wait() bool                     { return true }
+func (t fakeToken) WaitTimeout(time.Duration) bool { return !t.timeout }
+func (t fakeToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+func (t fakeToken) Error() error { return t.err }
+
+// fakePublish records a single Publish call.
+type fakePublish struct {
+	Topic    string
+	QoS      byte
+	Retained bool
+	Payload  string
+}
+
+// fakeClient is an in-memory mqtt.Client that records publishes and
+// subscriptions instead of talking to a broker.
+type fakeClient struct {
+	mu         sync.Mutex
+	connected  bool
+	publishErr error
+	// publishTimeout leaves publishes unacknowledged.
+	publishTimeout bool
+	published      []fakePublish
+	subscribed     map[string]byte
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{connected: true, subscribed: map[string]byte{}}
+}
+
+func (c *fakeClient) IsConnected() bool      { c.mu.Lock(); defer c.mu.Unlock(); return c.connected }
+func (c *fakeClient) IsConnectionOpen() bool { return c.IsConnected() }
+func (c *fakeClient) Connect() mqtt.Token {
+	c.mu.Lock()
+	c.connected = true
+	c.mu.Unlock()
+	return fakeToken{}
+}
+func (c *fakeClient) Disconnect(uint) { c.mu.Lock(); c.connected = false; c.mu.Unlock() }
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var body string
+	switch v := payload.(type) {
+	case string:
+		body = v
+	case []byte:
+		body = string(v)
+	}
+	c.published = append(c.published, fakePublish{Topic: topic, QoS: qos, Retained: retained, Payload: body})
+	return fakeToken{err: c.publishErr, timeout: c.publishTimeout}
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, _ mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed[topic] = qos
+	return fakeToken{}
+}
+
+func (c *fakeClient) SubscribeMultiple(filters map[string]byte, _ mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic, qos := range filters {
+		c.subscribed[topic] = qos
+	}
+	return fakeToken{}
+}
+
+func (c *fakeClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		delete(c.subscribed, topic)
+	}
+	return fakeToken{}
+}
+
+func (c *fakeClient) AddRoute(string, mqtt.MessageHandler) {}
+
+func (c *fakeClient) OptionsReader() mqtt.ClientOptionsReader { return mqtt.ClientOptionsReader{} }
+
+func (c *fakeClient) publishes() []fakePublish {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]fakePublish(nil), c.published...)
+}
+
+// fakeMessage implements mqtt.Message for feeding handlers directly.
+type fakeMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 0 }
+func (m *fakeMessage) Retained() bool    { return m.retained }
+func (m *fakeMessage) Ack()              {}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	domain "github.com/slidebolt/sb-domain"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+func TestDecodeAttributes(t *testing.T) {
+	payload := []byte(`{"state":"ON","power_on_behavior":"previous","update":{"state":"idle","installed_version":1}}`)
+	cases := []struct {
+		template string
+		want     []string
+		ok       bool
+	}{
+		{"", []string{"state", "power_on_behavior", "update"}, true},
+		{"{{ value_json | tojson }}", []string{"state", "power_on_behavior", "update"}, true},
+		{"{{ value_json.update | tojson }}", []string{"state", "installed_version"}, true},
+		{"{{ value_json.state }}", nil, false},
+		{"{{ value_json.missing }}", nil, false},
+		{"{{ {'a': value_json.state} | tojson }}", []string{"a"}, true},
+		{"{{ value_json | nosuchfilter }}", nil, false},
+		// Mappings are rendered as JSON without | tojson, as in HA.
+		{"{{ value_json.update }}", []string{"state", "installed_version"}, true},
+		{"{{ {'a': value_json.state} }}", []string{"a"}, true},
+	}
+	var templates templateCache
+	render := func(src string, payload []byte) (string, bool) {
+		return templates.renderJSON(domain.EntityKey{}, src, payload)
+	}
+	for _, c := range cases {
+		attrs, ok := decodeAttributes(c.template, payload, render)
+		if ok != c.ok || len(attrs) != len(c.want) {
+			t.Errorf("decodeAttributes(%q) = %v, %v", c.template, attrs, ok)
+			continue
+		}
+		for _, k := range c.want {
+			if _, found := attrs[k]; !found {
+				t.Errorf("decodeAttributes(%q) lacks %q: %v", c.template, k, attrs)
+			}
+		}
+	}
+	attrs, _ := decodeAttributes("{{ value_json.update }}", payload, render)
+	if string(attrs["state"]) != `"idle"` || string(attrs["installed_version"]) != "1" {
+		t.Errorf("attributes rendered without tojson = %s, %s", attrs["state"], attrs["installed_version"])
+	}
+	if _, ok := decodeAttributes("", []byte(`"ON"`), render); ok {
+		t.Error("attributes decoded from a non-object")
+	}
+}
+
+func TestAttributes_StoredFromStateTopic(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+
+	cfg := `{"name":"lamp","stat_t":"zigbee2mqtt/lamp","cmd_t":"zigbee2mqtt/lamp/set","json_attr_t":"zigbee2mqtt/lamp",
+		"dev":{"ids":["zigbee2mqtt_` + renameIEEE + `"]}}`
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/light/" + renameIEEE + "/light/config", payload: []byte(cfg)})
+	upd := `{"name":"update","stat_t":"zigbee2mqtt/lamp","json_attr_t":"zigbee2mqtt/lamp","json_attr_tpl":"{{ value_json.update | tojson }}",
+		"dev":{"ids":["zigbee2mqtt_` + renameIEEE + `"]}}`
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/binary_sensor/" + renameIEEE + "/update/config", payload: []byte(upd)})
+
+	in.handleStateMessage(nil, &fakeMessage{
+		topic:   "zigbee2mqtt/lamp",
+		payload: []byte(`{"state":"ON","color_mode":"xy","power_on_behavior":"previous","update":{"state":"idle"}}`),
+	})
+
+	attrs := getEntityMeta(t, env, renameIEEE, "light").Attributes
+	if string(attrs["power_on_behavior"]) != `"previous"` || string(attrs["color_mode"]) != `"xy"` {
+		t.Fatalf("light attributes = %v", attrs)
+	}
+	if light, _ := getEntity(t, env, renameIEEE, "light"); light.State == nil {
+		t.Fatal("state not stored alongside the attributes")
+	}
+	attrs = getEntityMeta(t, env, renameIEEE, "update").Attributes
+	if len(attrs) != 1 || string(attrs["state"]) != `"idle"` {
+		t.Fatalf("update attributes = %v", attrs)
+	}
+
+	// Rediscovery keeps the attributes.
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/light/" + renameIEEE + "/light/config", payload: []byte(cfg)})
+	if attrs := getEntityMeta(t, env, renameIEEE, "light").Attributes; len(attrs) == 0 {
+		t.Fatal("attributes lost on rediscovery")
+	}
+}
+
+func TestAttributes_SeparateTopic(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, client := newNativeTestInstance(t, env, discoveryHomeAssistant)
+
+	cfg := `{"name":"lamp","stat_t":"zigbee2mqtt/lamp","json_attr_t":"tasmota/lamp/attrs",
+		"dev":{"ids":["zigbee2mqtt_` + renameIEEE + `"]}}`
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/sensor/" + renameIEEE + "/lamp/config", payload: []byte(cfg)})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		client.mu.Lock()
+		_, ok := client.subscribed["tasmota/lamp/attrs"]
+		client.mu.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("attributes topic outside the base topic not subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	in.handleStateMessage(nil, &fakeMessage{topic: "tasmota/lamp/attrs", payload: []byte(`{"rssi":-61}`)})
+	meta := getEntityMeta(t, env, renameIEEE, "lamp")
+	var rssi int
+	if err := json.Unmarshal(meta.Attributes["rssi"], &rssi); err != nil || rssi != -61 {
+		t.Fatalf("attributes = %v", meta.Attributes)
+	}
+
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/sensor/" + renameIEEE + "/lamp/config", payload: nil})
+	if got := in.foreignTopics(); len(got) != 0 {
+		t.Fatalf("topics of a removed entity still indexed: %v", got)
+	}
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	domain "github.com/slidebolt/sb-domain"
+	messenger "github.com/slidebolt/sb-messenger-sdk"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+func TestEvaluateAvailability(t *testing.T) {
+	sources := []AvailabilitySource{{Topic: "a"}, {Topic: "b"}}
+	cases := []struct {
+		mode   string
+		values map[string]bool
+		latest bool
+		want   bool
+	}{
+		{availabilityAll, map[string]bool{"a": true, "b": true}, true, true},
+		{availabilityAll, map[string]bool{"a": true}, true, false},
+		{availabilityAll, map[string]bool{"a": true, "b": false}, true, false},
+		{availabilityAny, map[string]bool{"a": false, "b": true}, false, true},
+		{availabilityAny, map[string]bool{"a": false}, false, false},
+		{availabilityLatest, map[string]bool{"a": true, "b": false}, false, false},
+		{"", map[string]bool{"a": false}, true, true},
+	}
+	for _, c := range cases {
+		if got := evaluateAvailability(c.mode, sources, c.values, c.latest); got != c.want {
+			t.Errorf("evaluateAvailability(%q, %v, %v) = %v, want %v", c.mode, c.values, c.latest, got, c.want)
+		}
+	}
+}
+
+func TestAvailabilitySource_Parse(t *testing.T) {
+	plain := AvailabilitySource{Topic: "t", PayloadAvailable: "online", PayloadNotAvailable: "offline"}
+	templated := plain
+	templated.Template = "{{ value_json.state }}"
+	inline := plain
+	inline.Template = "{{ 'online' if value_json.up else 'offline' }}"
+	cases := []struct {
+		src           AvailabilitySource
+		payload       string
+		available, ok bool
+	}{
+		{plain, "online", true, true},
+		{plain, " offline\n", false, true},
+		{plain, "unknown", false, false},
+		{templated, `{"state":"online"}`, true, true},
+		{templated, `{"state":"offline"}`, false, true},
+		{templated, `online`, false, false},
+		{templated, `{"other":"online"}`, false, false},
+		{inline, `{"up":true}`, true, true},
+		{inline, `{"up":false}`, false, true},
+	}
+	var templates templateCache
+	render := func(src string, payload []byte) (string, bool) {
+		return templates.render(domain.EntityKey{}, src, payload)
+	}
+	for _, c := range cases {
+		available, ok := c.src.parse([]byte(c.payload), render)
+		if available != c.available || ok != c.ok {
+			t.Errorf("parse(%q) with template %q = %v, %v", c.payload, c.src.Template, available, ok)
+		}
+	}
+
+	var d DiscoveryPayload
+	if err := json.Unmarshal([]byte(`{"avty_t":"x/avail","pl_avail":"up","pl_not_avail":"down","avty":[{"t":"y"}]}`), &d); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	got := availabilitySources(d)
+	if len(got) != 2 || got[0].PayloadAvailable != "up" || got[0].PayloadNotAvailable != "down" || got[1].PayloadAvailable != "online" {
+		t.Fatalf("sources = %+v", got)
+	}
+}
+
+func getAvailable(t *testing.T, env *testkit.TestEnv, entityID string) *bool {
+	t.Helper()
+	return getEntityMeta(t, env, renameIEEE, entityID).Available
+}
+
+func TestAvailability_TracksZ2MTopics(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+
+	events := make(chan EntityAvailabilityEvent, 4)
+	sub, err := env.Messenger().Subscribe(subjectEventPrefix+eventEntityAvailability, func(m *messenger.Message) {
+		var ev EntityAvailabilityEvent
+		if err := json.Unmarshal(m.Data, &ev); err == nil {
+			events <- ev
+		}
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	// Z2M's layout: the bridge and the device must both be online.
+	cfg := `{"name":"lamp","stat_t":"zigbee2mqtt/lamp","cmd_t":"zigbee2mqtt/lamp/set","avty_mode":"all",
+		"avty":[{"t":"zigbee2mqtt/bridge/state","val_tpl":"{{ value_json.state }}"},{"t":"zigbee2mqtt/lamp/availability","val_tpl":"{{ value_json.state }}"}],
+		"dev":{"ids":["zigbee2mqtt_` + renameIEEE + `"]}}`
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/light/" + renameIEEE + "/light/config", payload: []byte(cfg)})
+	if v := getAvailable(t, env, "light"); v == nil || *v {
+		t.Fatalf("available before any report = %v", v)
+	}
+
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/state", payload: []byte(`{"state":"online"}`)})
+	if v := getAvailable(t, env, "light"); *v {
+		t.Fatal("available with only the bridge online")
+	}
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/lamp/availability", payload: []byte(`{"state":"online"}`)})
+	if v := getAvailable(t, env, "light"); !*v {
+		t.Fatal("unavailable with bridge and device online")
+	}
+
+	// State updates and rediscovery keep the flag.
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/lamp", payload: []byte(`{"state":"ON"}`)})
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/light/" + renameIEEE + "/light/config", payload: []byte(cfg)})
+	if v := getAvailable(t, env, "light"); !*v {
+		t.Fatal("availability lost on update")
+	}
+
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/lamp/availability", payload: []byte(`{"state":"offline"}`)})
+	if v := getAvailable(t, env, "light"); *v {
+		t.Fatal("available after the device went offline")
+	}
+
+	for _, want := range []bool{true, false} {
+		select {
+		case ev := <-events:
+			if ev.Available != want || ev.Entity != PluginID+"."+renameIEEE+".light" {
+				t.Fatalf("event = %+v, want available %v", ev, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no entity_availability event for %v", want)
+		}
+	}
+}
+
+func TestAvailability_SubscribesForeignTopics(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, client := newNativeTestInstance(t, env, discoveryHomeAssistant)
+
+	cfg := `{"name":"lamp","stat_t":"zigbee2mqtt/lamp","avty_t":"tasmota/lamp/LWT","pl_avail":"Online","pl_not_avail":"Offline",
+		"dev":{"ids":["zigbee2mqtt_` + renameIEEE + `"]}}`
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/sensor/" + renameIEEE + "/lamp/config", payload: []byte(cfg)})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		client.mu.Lock()
+		_, ok := client.subscribed["tasmota/lamp/LWT"]
+		client.mu.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("availability topic outside the base topic not subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := in.foreignTopics(); len(got) != 1 {
+		t.Fatalf("foreign topics = %v", got)
+	}
+
+	in.handleStateMessage(nil, &fakeMessage{topic: "tasmota/lamp/LWT", payload: []byte("Online")})
+	if v := getAvailable(t, env, "lamp"); v == nil || !*v {
+		t.Fatalf("available = %v", v)
+	}
+
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/sensor/" + renameIEEE + "/lamp/config", payload: nil})
+	if got := in.foreignTopics(); len(got) != 0 {
+		t.Fatalf("topics of a removed entity still indexed: %v", got)
+	}
+}
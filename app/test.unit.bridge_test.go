@@ -0,0 +1,197 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	domain "github.com/slidebolt/sb-domain"
+	messenger "github.com/slidebolt/sb-messenger-sdk"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+func bridgeConnection(t *testing.T, env *testkit.TestEnv, deviceID string) BridgeConnection {
+	t.Helper()
+	raw, err := env.Storage().Get(domain.EntityKey{Plugin: PluginID, DeviceID: deviceID, ID: bridgeConnectionID})
+	if err != nil {
+		t.Fatalf("get bridge connection: %v", err)
+	}
+	var entity domain.Entity
+	if err := json.Unmarshal(raw, &entity); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	state, ok := entity.State.(BridgeConnection)
+	if !ok {
+		t.Fatalf("state = %T, want BridgeConnection", entity.State)
+	}
+	return state
+}
+
+func TestBridgeConnection_TracksConnectAndLoss(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("storage")
+	in := newInstance(&plugin{store: env.Storage()}, MQTTConfig{DiscoveryPrefix: "homeassistant", BaseTopic: "zigbee2mqtt"})
+	client := newFakeClient()
+
+	in.onMQTTConnect(client)
+	in.handleStateMessage(client, &fakeMessage{topic: "zigbee2mqtt/bridge/state", payload: []byte(`{"state":"online"}`)})
+	got := bridgeConnection(t, env, "bridge")
+	if !got.Connected || !got.BridgeOnline || got.Reconnects != 0 || got.LastConnect.IsZero() {
+		t.Fatalf("after connect = %+v", got)
+	}
+
+	in.onMQTTDisconnect(client, errors.New("connection reset by peer"))
+	got = bridgeConnection(t, env, "bridge")
+	if got.Connected || got.BridgeOnline || got.LastError != "connection reset by peer" {
+		t.Fatalf("after loss = %+v", got)
+	}
+
+	in.onMQTTConnect(client)
+	in.handleStateMessage(client, &fakeMessage{topic: "zigbee2mqtt/bridge/state", payload: []byte(`offline`)})
+	got = bridgeConnection(t, env, "bridge")
+	if !got.Connected || got.BridgeOnline || got.Reconnects != 1 {
+		t.Fatalf("after reconnect = %+v", got)
+	}
+}
+
+func TestBridgeConnection_NamespacedPerInstance(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("storage")
+	in := newInstance(&plugin{store: env.Storage()}, MQTTConfig{Name: "north", BaseTopic: "zigbee2mqtt"})
+
+	in.onMQTTConnect(newFakeClient())
+	if got := bridgeConnection(t, env, "north_bridge"); !got.Connected {
+		t.Fatalf("north bridge = %+v", got)
+	}
+}
+
+func TestBridgeState_MarksEntitiesUnavailable(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+
+	states := make(chan BridgeStateEvent, 4)
+	sub, err := env.Messenger().Subscribe(subjectEventPrefix+eventBridgeState, func(m *messenger.Message) {
+		var ev BridgeStateEvent
+		if err := json.Unmarshal(m.Data, &ev); err == nil {
+			states <- ev
+		}
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	dev := `"dev":{"ids":["zigbee2mqtt_` + renameIEEE + `"]}`
+	light := `{"name":"lamp","stat_t":"zigbee2mqtt/lamp","avty_t":"zigbee2mqtt/lamp/availability",` + dev + `}`
+	lqi := `{"name":"lamp Linkquality","stat_t":"zigbee2mqtt/lamp","val_tpl":"{{ value_json.linkquality }}",` + dev + `}`
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/light/" + renameIEEE + "/light/config", payload: []byte(light)})
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/sensor/" + renameIEEE + "/linkquality/config", payload: []byte(lqi)})
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/state", payload: []byte(`{"state":"online"}`)})
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/lamp/availability", payload: []byte(`online`)})
+	if v := getAvailable(t, env, "light"); v == nil || !*v {
+		t.Fatalf("light available = %v", v)
+	}
+	if v := getAvailable(t, env, "linkquality"); v != nil {
+		t.Fatalf("linkquality without availability config = %v", *v)
+	}
+
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/state", payload: []byte(`{"state":"offline"}`)})
+	for _, id := range []string{"light", "linkquality"} {
+		if v := getAvailable(t, env, id); v == nil || *v {
+			t.Fatalf("%s available with the bridge offline = %v", id, v)
+		}
+	}
+	// Device reports while Z2M is down don't bring entities back.
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/lamp/availability", payload: []byte(`online`)})
+	if v := getAvailable(t, env, "light"); *v {
+		t.Fatal("light available with the bridge offline")
+	}
+
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/state", payload: []byte(`{"state":"online"}`)})
+	if v := getAvailable(t, env, "light"); v == nil || !*v {
+		t.Fatalf("light after restart = %v", v)
+	}
+	if v := getAvailable(t, env, "linkquality"); v != nil {
+		t.Fatalf("linkquality after restart = %v", *v)
+	}
+
+	// Broker loss cuts every entity off too.
+	in.onMQTTDisconnect(nil, errors.New("connection reset by peer"))
+	if v := getAvailable(t, env, "light"); *v {
+		t.Fatal("light available without a broker")
+	}
+
+	for _, want := range []bool{false, true} {
+		select {
+		case ev := <-states:
+			if ev.Online != want {
+				t.Fatalf("bridge_state event = %+v, want online %v", ev, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no bridge_state event for online %v", want)
+		}
+	}
+}
+
+func TestBridgeEvent_PublishesDeviceEvents(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+
+	type received struct {
+		name string
+		ev   BridgeDeviceEvent
+	}
+	got := make(chan received, 8)
+	for _, name := range []string{eventDeviceJoined, eventDeviceLeft, eventDeviceInterviewSuccessful, eventDeviceInterviewFailed} {
+		sub, err := env.Messenger().Subscribe(subjectEventPrefix+name, func(m *messenger.Message) {
+			var ev BridgeDeviceEvent
+			if err := json.Unmarshal(m.Data, &ev); err == nil {
+				got <- received{name, ev}
+			}
+		})
+		if err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+		defer sub.Unsubscribe()
+	}
+
+	data := `"data":{"friendly_name":"` + renameIEEE + `","ieee_address":"` + renameIEEE + `"`
+	for _, payload := range []string{
+		`{"type":"device_joined",` + data + `}}`,
+		`{"type":"device_announce",` + data + `}}`,
+		`{"type":"device_interview",` + data + `,"status":"started"}}`,
+		`{"type":"device_interview",` + data + `,"status":"successful","supported":true}}`,
+		`{"type":"device_leave",` + data + `}}`,
+	} {
+		in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/event", payload: []byte(payload)})
+	}
+
+	seen := map[string]BridgeDeviceEvent{}
+	for len(seen) < 3 {
+		select {
+		case r := <-got:
+			seen[r.name] = r.ev
+		case <-time.After(2 * time.Second):
+			t.Fatalf("events = %+v", seen)
+		}
+	}
+	if ev := seen[eventDeviceJoined]; ev.Device != renameIEEE || ev.IEEEAddress != renameIEEE || ev.Supported != nil {
+		t.Fatalf("device_joined = %+v", ev)
+	}
+	if ev := seen[eventDeviceInterviewSuccessful]; ev.Supported == nil || !*ev.Supported {
+		t.Fatalf("device_interview_successful = %+v", ev)
+	}
+	if _, ok := seen[eventDeviceLeft]; !ok {
+		t.Fatal("no device_left event")
+	}
+	select {
+	case r := <-got:
+		t.Fatalf("unexpected %s event: %+v", r.name, r.ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
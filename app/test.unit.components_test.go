@@ -0,0 +1,127 @@
+package app
+
+import (
+	"testing"
+
+	domain "github.com/slidebolt/sb-domain"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+const deviceConfigTopic = "homeassistant/device/" + renameIEEE + "/config"
+
+// deviceConfig is a device-based config for a plug with a switch, a power
+// sensor and, when withLQI is set, a linkquality sensor.
+func deviceConfig(withLQI bool) string {
+	lqi := ""
+	if withLQI {
+		lqi = `,"linkquality":{"p":"sensor","val_tpl":"{{ value_json.linkquality }}","ent_cat":"diagnostic"}`
+	}
+	return `{
+		"dev":{"name":"plug","ids":["zigbee2mqtt_` + renameIEEE + `"],"mf":"SONOFF"},
+		"o":{"name":"Zigbee2MQTT","sw":"2.0.0"},
+		"~":"zigbee2mqtt/plug",
+		"stat_t":"~",
+		"avty":[{"t":"zigbee2mqtt/bridge/state"}],
+		"cmps":{
+			"switch":{"p":"switch","cmd_t":"~/set","pl_on":"ON","pl_off":"OFF","val_tpl":"{{ value_json.state }}"},
+			"power":{"p":"sensor","val_tpl":"{{ value_json.power }}","unit_of_meas":"W","dev_cla":"power"}` + lqi + `
+		}
+	}`
+}
+
+func TestDeviceDiscovery_FansOutComponents(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: deviceConfigTopic, payload: []byte(deviceConfig(true))})
+
+	for id, typ := range map[string]string{"switch": "switch", "power": "sensor", "linkquality": "sensor"} {
+		e, ok := getEntity(t, env, renameIEEE, id)
+		if !ok || e.Type != typ {
+			t.Fatalf("entity %s = %+v, %v", id, e, ok)
+		}
+		info, err := p.getTopicInfo(domain.EntityKey{Plugin: PluginID, DeviceID: renameIEEE, ID: id})
+		if err != nil || info.StateTopic != "zigbee2mqtt/plug" || info.DeviceConfig != renameIEEE {
+			t.Fatalf("topic info %s = %+v, %v", id, info, err)
+		}
+	}
+	info, _ := p.getTopicInfo(domain.EntityKey{Plugin: PluginID, DeviceID: renameIEEE, ID: "switch"})
+	if info.CommandTopic != "zigbee2mqtt/plug/set" {
+		t.Fatalf("command topic = %q", info.CommandTopic)
+	}
+	if dev, ok := p.getDevice(renameIEEE); !ok || dev.Manufacturer != "SONOFF" || len(dev.Entities) != 3 {
+		t.Fatalf("device = %+v", dev)
+	}
+
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/plug", payload: []byte(`{"state":"ON","power":12.5,"linkquality":80}`)})
+	if e, _ := getEntity(t, env, renameIEEE, "switch"); e.State == nil {
+		t.Fatal("switch state not decoded")
+	}
+	if e, _ := getEntity(t, env, renameIEEE, "power"); e.State == nil {
+		t.Fatal("power state not decoded")
+	}
+}
+
+func TestDeviceDiscovery_RemovesDroppedComponents(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: deviceConfigTopic, payload: []byte(deviceConfig(true))})
+
+	// A per-entity config on the same device is not the device config's to remove.
+	other := `{"name":"plug Identify","cmd_t":"zigbee2mqtt/plug/set","device":{"identifiers":["zigbee2mqtt_` + renameIEEE + `"]}}`
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/button/" + renameIEEE + "/identify/config", payload: []byte(other)})
+
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: deviceConfigTopic, payload: []byte(deviceConfig(false))})
+	if _, ok := getEntity(t, env, renameIEEE, "linkquality"); ok {
+		t.Fatal("dropped component still stored")
+	}
+	if _, ok := getEntity(t, env, renameIEEE, "power"); !ok {
+		t.Fatal("kept component removed")
+	}
+
+	// A component sent with only its platform is removed too.
+	removed := `{"dev":{"ids":["zigbee2mqtt_` + renameIEEE + `"]},"stat_t":"zigbee2mqtt/plug","cmps":{"switch":{"p":"switch","cmd_t":"zigbee2mqtt/plug/set"},"power":{"p":"sensor"}}}`
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: deviceConfigTopic, payload: []byte(removed)})
+	if _, ok := getEntity(t, env, renameIEEE, "power"); ok {
+		t.Fatal("platform-only component still stored")
+	}
+
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: deviceConfigTopic, payload: nil})
+	if _, ok := getEntity(t, env, renameIEEE, "switch"); ok {
+		t.Fatal("cleared device config left its components")
+	}
+	if _, ok := getEntity(t, env, renameIEEE, "identify"); !ok {
+		t.Fatal("per-entity config removed with the device config")
+	}
+}
+
+func TestDeviceDiscovery_NestedNodeID(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+
+	// Published under node_id/object_id, without an IEEE address to key on.
+	topic := "homeassistant/device/garden/pump/config"
+	config := `{"dev":{"name":"pump"},"stat_t":"garden/pump","cmps":{"switch":{"p":"switch","cmd_t":"garden/pump/set"}}}`
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: topic, payload: []byte(config)})
+
+	key := domain.EntityKey{Plugin: PluginID, DeviceID: "garden_pump", ID: "switch"}
+	if _, ok := getEntity(t, env, key.DeviceID, key.ID); !ok {
+		t.Fatal("component not keyed on the sanitised config ID")
+	}
+	if got, ok := parseEntityKey(key.Key()); !ok || got != key {
+		t.Fatalf("parseEntityKey(%q) = %+v, %v", key.Key(), got, ok)
+	}
+	if info, err := p.getTopicInfo(key); err != nil || info.DeviceConfig != "garden/pump" {
+		t.Fatalf("topic info = %+v, %v", info, err)
+	}
+
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: topic, payload: nil})
+	if _, ok := getEntity(t, env, key.DeviceID, key.ID); ok {
+		t.Fatal("cleared device config left its component")
+	}
+}
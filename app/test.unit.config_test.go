@@ -0,0 +1,166 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	domain "github.com/slidebolt/sb-domain"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+func requestConfigSet(t *testing.T, env *testkit.TestEnv, body string) configReply {
+	t.Helper()
+	resp, err := env.Messenger().Request(subjectConfigSet, []byte(body), 2*time.Second)
+	if err != nil {
+		t.Fatalf("request %s: %v", subjectConfigSet, err)
+	}
+	var reply configReply
+	if err := json.Unmarshal(resp.Data, &reply); err != nil {
+		t.Fatalf("unmarshal reply: %v", err)
+	}
+	return reply
+}
+
+func TestConfigSet_PersistsAndKeepsIndex(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+
+	p := &plugin{msg: env.Messenger(), store: env.Storage()}
+	north := newInstance(p, MQTTConfig{Name: "north", BaseTopic: "zigbee2mqtt"})
+	key := domain.EntityKey{Plugin: PluginID, DeviceID: "north_0x01", ID: "light"}
+	north.stateTopicIndex["zigbee2mqtt/lamp"] = []domain.EntityKey{key}
+	p.instances = []*instance{north}
+
+	sub, err := env.Messenger().Subscribe(subjectConfigSet, p.handleConfigSet)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	reply := requestConfigSet(t, env, `{"instances":[{"name":"north","base_topic":"z2m"},{"name":"south"}]}`)
+	if !reply.OK {
+		t.Fatalf("config.set failed: %s", reply.Error)
+	}
+
+	stored, ok, err := p.loadStoredConfig()
+	if err != nil || !ok {
+		t.Fatalf("stored config: ok=%v err=%v", ok, err)
+	}
+	if len(stored.Instances) != 2 || stored.Instances[0].BaseTopic != "z2m" {
+		t.Fatalf("stored config = %+v", stored)
+	}
+
+	reloaded := p.instance("north")
+	if reloaded == nil || reloaded == north {
+		t.Fatal("north instance was not rebuilt")
+	}
+	if got := reloaded.stateTopicIndex["zigbee2mqtt/lamp"]; len(got) != 1 || got[0] != key {
+		t.Fatalf("index after reload = %v", got)
+	}
+	if p.instance("south") == nil {
+		t.Fatal("south instance not started")
+	}
+}
+
+func TestConfigSet_RejectsInvalidConfig(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+
+	p := &plugin{msg: env.Messenger(), store: env.Storage()}
+	sub, err := env.Messenger().Subscribe(subjectConfigSet, p.handleConfigSet)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	for _, body := range []string{
+		`not json`,
+		`{"instances":[{"name":"a"},{"name":"a"}]}`,
+		`{"instances":[{"protocol_version":"6"}]}`,
+		`{"instances":[{"response_topic":"z2m/responses"}]}`,
+		`{"instances":[{"protocol_version":"5","session_expiry_interval":0}]}`,
+	} {
+		if reply := requestConfigSet(t, env, body); reply.OK {
+			t.Fatalf("config.set accepted %s", body)
+		}
+	}
+	if _, ok, _ := p.loadStoredConfig(); ok {
+		t.Fatal("invalid config was persisted")
+	}
+}
+
+func TestStartupConfig_ValidatesStoredConfig(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("storage")
+	p := &plugin{store: env.Storage()}
+
+	if err := p.saveConfig(Config{Instances: []MQTTConfig{{ProtocolVersion: "6"}}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if _, err := p.startupConfig(); err == nil {
+		t.Fatal("startupConfig accepted a stored config config.set would reject")
+	}
+
+	valid := Config{Instances: []MQTTConfig{{Name: "north", ClientID: "z2m-north"}}}
+	if err := p.saveConfig(valid); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	cfg, err := p.startupConfig()
+	if err != nil {
+		t.Fatalf("startupConfig: %v", err)
+	}
+	if len(cfg.Instances) != 1 || cfg.Instances[0].Name != "north" {
+		t.Fatalf("startup config = %+v", cfg)
+	}
+}
+
+func TestConfigSet_ConcurrentRequestsKeepStoredAndRunningInStep(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+
+	p := &plugin{msg: env.Messenger(), store: env.Storage()}
+	sub, err := env.Messenger().Subscribe(subjectConfigSet, p.handleConfigSet)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"instances":[{"name":"n%d","client_id":"z2m-n%d"}]}`, i, i)
+			resp, err := env.Messenger().Request(subjectConfigSet, []byte(body), 2*time.Second)
+			if err != nil {
+				t.Errorf("request %s: %v", body, err)
+				return
+			}
+			var reply configReply
+			if err := json.Unmarshal(resp.Data, &reply); err != nil || !reply.OK {
+				t.Errorf("config.set %s: %s %v", body, reply.Error, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stored, ok, err := p.loadStoredConfig()
+	if err != nil || !ok {
+		t.Fatalf("stored config: ok=%v err=%v", ok, err)
+	}
+	running := p.runningInstances()
+	defer func() {
+		for _, in := range running {
+			in.disconnect()
+		}
+	}()
+	if len(running) != 1 || running[0].cfg.Name != stored.Instances[0].Name {
+		t.Fatalf("running %d instances, stored %+v", len(running), stored.Instances)
+	}
+}
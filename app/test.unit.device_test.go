@@ -0,0 +1,130 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	translate "github.com/slidebolt/plugin-zigbee2mqtt/internal/translate"
+	storage "github.com/slidebolt/sb-storage-sdk"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+const kitchenDevice = `"device":{"name":"Kitchen Pendants","manufacturer":"IKEA","model":"LED1545G12","identifiers":["zigbee2mqtt_0x000b57fffec6a5b2"],"via_device":"zigbee2mqtt_bridge_0x00124b0022b3a1c5","suggested_area":"Kitchen"}`
+
+func TestDiscovery_SavesDeviceRecord(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("storage")
+	p := &plugin{store: env.Storage()}
+	in := newInstance(p, MQTTConfig{DiscoveryPrefix: "homeassistant", BaseTopic: "zigbee2mqtt"})
+
+	in.handleDiscoveryMessage(nil, &fakeMessage{
+		topic:   "homeassistant/light/0x000b57fffec6a5b2/light/config",
+		payload: []byte(`{"name":null,"state_topic":"zigbee2mqtt/kitchen",` + kitchenDevice + `}`),
+	})
+	in.handleDiscoveryMessage(nil, &fakeMessage{
+		topic:   "homeassistant/sensor/0x000b57fffec6a5b2/linkquality/config",
+		payload: []byte(`{"name":"Linkquality","state_topic":"zigbee2mqtt/kitchen",` + kitchenDevice + `}`),
+	})
+
+	dev, ok := p.getDevice("0x000b57fffec6a5b2")
+	if !ok {
+		t.Fatal("device record not saved")
+	}
+	if dev.Manufacturer != "IKEA" || dev.Model != "LED1545G12" || dev.Area != "Kitchen" {
+		t.Fatalf("device = %+v", dev)
+	}
+	if dev.IEEEAddress != "0x000b57fffec6a5b2" {
+		t.Fatalf("ieee address = %q", dev.IEEEAddress)
+	}
+	if len(dev.Entities) != 2 || dev.Entities[0] != "light" || dev.Entities[1] != "linkquality" {
+		t.Fatalf("entities = %v", dev.Entities)
+	}
+
+	entries, err := env.Storage().Query(storage.Query{
+		Pattern: PluginID + ".*",
+		Where:   []storage.Filter{{Field: "manufacturer", Op: storage.Eq, Value: "IKEA"}},
+	})
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("query by manufacturer returned %d entries", len(entries))
+	}
+	var queried Device
+	if err := json.Unmarshal(entries[0].Data, &queried); err != nil || queried.ID != dev.ID {
+		t.Fatalf("queried device = %+v (%v)", queried, err)
+	}
+
+	// Clearing both discovery configs removes the device with its entities.
+	for _, topic := range []string{
+		"homeassistant/light/0x000b57fffec6a5b2/light/config",
+		"homeassistant/sensor/0x000b57fffec6a5b2/linkquality/config",
+	} {
+		in.handleDiscoveryMessage(nil, &fakeMessage{topic: topic})
+	}
+	if _, ok := p.getDevice("0x000b57fffec6a5b2"); ok {
+		t.Fatal("device record kept without entities")
+	}
+}
+
+func TestStateMessage_RefreshesDeviceHealth(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("storage")
+	p := &plugin{store: env.Storage()}
+	in := newInstance(p, MQTTConfig{DiscoveryPrefix: "homeassistant", BaseTopic: "zigbee2mqtt"})
+	discoverLamp(in)
+
+	dev, _ := p.getDevice(renameIEEE)
+	if dev.LinkQuality == nil || *dev.LinkQuality != 90 || dev.LastSeen == nil {
+		t.Fatalf("health after first state = %+v", dev.DeviceHealth)
+	}
+
+	in.handleStateMessage(nil, &fakeMessage{
+		topic:   "zigbee2mqtt/lamp",
+		payload: []byte(`{"state":"ON","linkquality":12,"battery":15,"voltage":2800,"last_seen":"2026-10-16T08:30:00Z"}`),
+	})
+	dev, _ = p.getDevice(renameIEEE)
+	if *dev.LinkQuality != 12 || *dev.Battery != 15 || *dev.Voltage != 2800 {
+		t.Fatalf("health = %+v", dev.DeviceHealth)
+	}
+	if !dev.LastSeen.Equal(time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)) {
+		t.Fatalf("last seen = %v", dev.LastSeen)
+	}
+
+	// A message without battery keeps the last battery reading.
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/lamp", payload: []byte(`{"state":"OFF","linkquality":20}`)})
+	dev, _ = p.getDevice(renameIEEE)
+	if *dev.LinkQuality != 20 || dev.Battery == nil || *dev.Battery != 15 {
+		t.Fatalf("health = %+v", dev.DeviceHealth)
+	}
+
+	// Dying batteries are found with a storage query.
+	entries, err := env.Storage().Query(storage.Query{
+		Pattern: PluginID + ".*",
+		Where:   []storage.Filter{{Field: "battery", Op: storage.Lt, Value: 20}},
+	})
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("query by battery returned %d entries", len(entries))
+	}
+}
+
+func TestDeviceHealth_MergeThrottlesLastSeen(t *testing.T) {
+	t0 := time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)
+	lqi := 80
+	var d DeviceHealth
+	if !d.merge(translate.Health{LinkQuality: &lqi, LastSeen: &t0}) {
+		t.Fatal("first report not applied")
+	}
+	t1 := t0.Add(10 * time.Second)
+	if d.merge(translate.Health{LinkQuality: &lqi, LastSeen: &t1}) {
+		t.Fatal("unchanged report within the resolution rewrites the record")
+	}
+	t2 := t0.Add(lastSeenResolution)
+	if !d.merge(translate.Health{LastSeen: &t2}) || !d.LastSeen.Equal(t2) {
+		t.Fatalf("last seen = %v", d.LastSeen)
+	}
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "anything", true},
+		{"0x00158d*", "0x00158d0001a2b3c4", true},
+		{"kitchen/*", "kitchen/lamp", true},
+		{"kitchen/*", "hall/lamp", false},
+		{"lamp_?", "lamp_1", true},
+		{"lamp_?", "lamp_12", false},
+		{"*_sensor*", "hall_sensor_2", true},
+		{"", "", true},
+		{"a*b*c", "abxc", true},
+		{"a*b*c", "acxb", false},
+	}
+	for _, c := range cases {
+		if got := globMatch(c.pattern, c.s); got != c.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", c.pattern, c.s, got, c.want)
+		}
+	}
+}
+
+func TestEvaluateFilters_FirstMatchDecides(t *testing.T) {
+	rules := []FilterRule{
+		{Action: filterExclude, EntityCategory: "diagnostic"},
+		{Action: filterInclude, Manufacturer: "ikea"},
+	}
+	if rule, ok := evaluateFilters(rules, filterCandidate{Manufacturer: "IKEA", EntityCategory: "diagnostic"}); ok || rule != 0 {
+		t.Fatalf("diagnostic IKEA entity: rule %d ok %v", rule, ok)
+	}
+	if rule, ok := evaluateFilters(rules, filterCandidate{Manufacturer: "IKEA"}); !ok || rule != 1 {
+		t.Fatalf("IKEA entity: rule %d ok %v", rule, ok)
+	}
+	// With an include rule present, unmatched entities are rejected.
+	if rule, ok := evaluateFilters(rules, filterCandidate{Manufacturer: "SONOFF"}); ok || rule != -1 {
+		t.Fatalf("unmatched entity: rule %d ok %v", rule, ok)
+	}
+	// With exclude rules only, they are accepted.
+	if _, ok := evaluateFilters(rules[:1], filterCandidate{Manufacturer: "SONOFF"}); !ok {
+		t.Fatal("unmatched entity rejected without include rules")
+	}
+	if _, ok := evaluateFilters(nil, filterCandidate{}); !ok {
+		t.Fatal("entity rejected without rules")
+	}
+}
+
+func TestValidateFilters(t *testing.T) {
+	if err := validateFilters([]FilterRule{{Action: "drop"}}); err == nil {
+		t.Fatal("unknown action accepted")
+	}
+	if err := validateFilters([]FilterRule{{Action: filterInclude}, {Action: filterExclude}}); err != nil {
+		t.Fatalf("valid rules rejected: %v", err)
+	}
+}
+
+// discoverFiltered discovers a light and its diagnostic linkquality sensor.
+func discoverFiltered(in *instance) {
+	dev := `"device":{"name":"lamp","identifiers":["zigbee2mqtt_0x00158d0001a2b3c4"],"manufacturer":"IKEA","model":"LED1545G12"}`
+	light := `{"name":"lamp","state_topic":"zigbee2mqtt/lamp","command_topic":"zigbee2mqtt/lamp/set",` + dev + `}`
+	lqi := `{"name":"lamp Linkquality","state_topic":"zigbee2mqtt/lamp","value_template":"{{ value_json.linkquality }}","entity_category":"diagnostic",` + dev + `}`
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/light/0x00158d0001a2b3c4/light/config", payload: []byte(light)})
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/sensor/0x00158d0001a2b3c4/linkquality/config", payload: []byte(lqi)})
+}
+
+func TestDiscovery_FiltersBeforeSaving(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+	discoverFiltered(in)
+	if _, ok := getEntity(t, env, "0x00158d0001a2b3c4", "linkquality"); !ok {
+		t.Fatal("entity not stored without filters")
+	}
+
+	// Rules added later remove entities they exclude on rediscovery.
+	in.cfg.Filters = []FilterRule{{Action: filterExclude, EntityCategory: "diagnostic"}}
+	discoverFiltered(in)
+
+	if _, ok := getEntity(t, env, "0x00158d0001a2b3c4", "linkquality"); ok {
+		t.Fatal("diagnostic entity still stored")
+	}
+	if _, ok := getEntity(t, env, "0x00158d0001a2b3c4", "light"); !ok {
+		t.Fatal("light filtered out")
+	}
+	if got := in.stateTopicIndex["zigbee2mqtt/lamp"]; len(got) != 1 {
+		t.Fatalf("state topic index = %v", got)
+	}
+}
+
+func TestFiltersDryRun(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+	in.cfg.Filters = []FilterRule{{Action: filterExclude, EntityCategory: "diagnostic"}}
+	discoverFiltered(in)
+
+	sub, err := env.Messenger().Subscribe(subjectFiltersDryRun, p.handleFiltersDryRun)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	body := `{"rules":[{"action":"include","friendly_name":"lamp","entity_type":"light"},{"action":"exclude","manufacturer":"IKEA"}]}`
+	resp, err := env.Messenger().Request(subjectFiltersDryRun, []byte(body), 2*time.Second)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	var report FilterDryRun
+	if err := json.Unmarshal(resp.Data, &report); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	light := PluginID + ".0x00158d0001a2b3c4.light"
+	lqi := PluginID + ".0x00158d0001a2b3c4.linkquality"
+	if report.Error != "" || len(report.Rules) != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+	if !slices.Equal(report.Rules[0].Accepted, []string{light}) {
+		t.Fatalf("rule 0 = %+v", report.Rules[0])
+	}
+	// The filtered-out sensor is still evaluated.
+	if !slices.Equal(report.Rules[1].Rejected, []string{lqi}) || !slices.Equal(report.Rules[1].Shadowed, []string{light}) {
+		t.Fatalf("rule 1 = %+v", report.Rules[1])
+	}
+
+	// A dry run changes nothing.
+	if _, ok := getEntity(t, env, "0x00158d0001a2b3c4", "linkquality"); ok {
+		t.Fatal("dry run stored an entity")
+	}
+
+	resp, err = env.Messenger().Request(subjectFiltersDryRun, []byte(`{"instance":"nope"}`), 2*time.Second)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if err := json.Unmarshal(resp.Data, &report); err != nil || report.Error == "" {
+		t.Fatalf("unknown instance: %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,182 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+
+	domain "github.com/slidebolt/sb-domain"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "single unnamed instance", cfg: Config{Instances: []MQTTConfig{{}}}},
+		{name: "several named instances", cfg: Config{Instances: []MQTTConfig{{Name: "north"}, {Name: "south"}}}},
+		{name: "no instances", cfg: Config{}, wantErr: true},
+		{name: "unnamed among several", cfg: Config{Instances: []MQTTConfig{{Name: "north"}, {}}}, wantErr: true},
+		{name: "duplicate names", cfg: Config{Instances: []MQTTConfig{{Name: "north"}, {Name: "north"}}}, wantErr: true},
+		{name: "dot in name", cfg: Config{Instances: []MQTTConfig{{Name: "b.1"}}}, wantErr: true},
+		{name: "underscore in name", cfg: Config{Instances: []MQTTConfig{{Name: "b_1"}}}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Validate() err = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeConfig_InheritsBaseAndDerivesIdentity(t *testing.T) {
+	base := MQTTConfig{
+		DiscoveryPrefix: "homeassistant",
+		BaseTopic:       "zigbee2mqtt",
+		ClientID:        "slidebolt-z2m-plugin",
+		StatusTopic:     "slidebolt/plugin-zigbee2mqtt/status",
+		StateQoS:        1,
+	}
+	cfg, err := decodeConfig([]byte(`[{"name":"north","base_topic":"z2m-north","state_qos":0},
+		{"name":"south","status_topic":"site/south/status"}]`), base)
+	if err != nil {
+		t.Fatalf("decodeConfig: %v", err)
+	}
+	got := cfg.Instances[0]
+	if got.BaseTopic != "z2m-north" || got.DiscoveryPrefix != "homeassistant" {
+		t.Fatalf("topics = %q %q", got.BaseTopic, got.DiscoveryPrefix)
+	}
+	if got.StateQoS != 0 {
+		t.Fatalf("explicit state_qos 0 overridden: %d", got.StateQoS)
+	}
+	if got.ClientID != "slidebolt-z2m-plugin-north" {
+		t.Fatalf("client id = %q", got.ClientID)
+	}
+	if got.StatusTopic != "slidebolt/plugin-zigbee2mqtt/status/north" {
+		t.Fatalf("status topic = %q", got.StatusTopic)
+	}
+	if south := cfg.Instances[1]; south.StatusTopic != "site/south/status" {
+		t.Fatalf("explicit status topic overridden: %q", south.StatusTopic)
+	}
+}
+
+func TestInstances_SameDeviceIDDoesNotCollide(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p := &plugin{store: env.Storage()}
+	north := newInstance(p, MQTTConfig{Name: "north", DiscoveryPrefix: "homeassistant", BaseTopic: "zigbee2mqtt"})
+	south := newInstance(p, MQTTConfig{Name: "south", DiscoveryPrefix: "homeassistant", BaseTopic: "zigbee2mqtt"})
+	p.instances = []*instance{north, south}
+
+	discovery := []byte(`{"name":"Lamp","state_topic":"zigbee2mqtt/lamp","command_topic":"zigbee2mqtt/lamp/set"}`)
+	for _, in := range p.instances {
+		in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/light/0x01/config", payload: discovery})
+	}
+	north.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/lamp", payload: []byte(`{"state":"ON","brightness":200}`)})
+
+	for _, tc := range []struct {
+		deviceID string
+		wantOn   bool
+	}{
+		{deviceID: "north_0x01", wantOn: true},
+		{deviceID: "south_0x01", wantOn: false},
+	} {
+		raw, err := env.Storage().Get(domain.EntityKey{Plugin: PluginID, DeviceID: tc.deviceID, ID: "light"})
+		if err != nil {
+			t.Fatalf("get %s: %v", tc.deviceID, err)
+		}
+		var entity domain.Entity
+		if err := json.Unmarshal(raw, &entity); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		light, _ := entity.State.(domain.Light)
+		if light.Power != tc.wantOn {
+			t.Fatalf("%s power = %v, want %v", tc.deviceID, light.Power, tc.wantOn)
+		}
+		info, err := p.getTopicInfo(domain.EntityKey{Plugin: PluginID, DeviceID: tc.deviceID, ID: "light"})
+		if err != nil {
+			t.Fatalf("topic info %s: %v", tc.deviceID, err)
+		}
+		if want := tc.deviceID[:5]; info.Instance != want {
+			t.Fatalf("%s instance = %q, want %q", tc.deviceID, info.Instance, want)
+		}
+	}
+}
+
+func TestOnMQTTConnect_SubscribesWithConfiguredQoS(t *testing.T) {
+	client := newFakeClient()
+	in := newInstance(&plugin{}, MQTTConfig{
+		DiscoveryPrefix: "homeassistant",
+		BaseTopic:       "zigbee2mqtt",
+		DiscoveryQoS:    1,
+		StateQoS:        2,
+	})
+	in.onMQTTConnect(client)
+
+	if got := client.subscribed["homeassistant/#"]; got != 1 {
+		t.Fatalf("discovery qos = %d, want 1", got)
+	}
+	if got := client.subscribed["zigbee2mqtt/#"]; got != 2 {
+		t.Fatalf("state qos = %d, want 2", got)
+	}
+}
+
+func TestValidateSession(t *testing.T) {
+	if err := (MQTTConfig{ClientID: "plugin"}).validateSession(); err != nil {
+		t.Fatalf("persistent session with client id: %v", err)
+	}
+	if err := (MQTTConfig{}).validateSession(); err == nil {
+		t.Fatal("persistent session without client id accepted")
+	}
+	if err := (MQTTConfig{CleanSession: true}).validateSession(); err != nil {
+		t.Fatalf("clean session without client id: %v", err)
+	}
+	if err := (MQTTConfig{ClientID: "plugin", CommandQoS: 3}).validateSession(); err == nil {
+		t.Fatal("command qos 3 accepted")
+	}
+}
+
+func TestApplyConfig_RestoresIndexFromStorage(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("storage")
+
+	// A previous run discovered the lamp on the north instance.
+	before := &plugin{store: env.Storage()}
+	north := newInstance(before, MQTTConfig{Name: "north", DiscoveryPrefix: "homeassistant", BaseTopic: "zigbee2mqtt"})
+	north.handleDiscoveryMessage(nil, &fakeMessage{
+		topic:   "homeassistant/light/0x01/config",
+		payload: []byte(`{"name":"Lamp","state_topic":"zigbee2mqtt/lamp","command_topic":"zigbee2mqtt/lamp/set"}`),
+	})
+
+	// After a restart, no discovery message has been received yet.
+	p := &plugin{store: env.Storage()}
+	p.applyConfig(Config{Instances: []MQTTConfig{
+		{Name: "north", BaseTopic: "zigbee2mqtt"},
+		{Name: "south", BaseTopic: "zigbee2mqtt"},
+	}})
+
+	key := domain.EntityKey{Plugin: PluginID, DeviceID: "north_0x01", ID: "light"}
+	if got := p.instance("north").stateTopicIndex["zigbee2mqtt/lamp"]; len(got) != 1 || got[0] != key {
+		t.Fatalf("north index = %v", got)
+	}
+	if got := p.instance("south").stateTopicIndex; len(got) != 0 {
+		t.Fatalf("south index = %v", got)
+	}
+
+	p.instance("north").handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/lamp", payload: []byte(`{"state":"ON"}`)})
+	raw, err := env.Storage().Get(key)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	var entity domain.Entity
+	if err := json.Unmarshal(raw, &entity); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if light, _ := entity.State.(domain.Light); !light.Power {
+		t.Fatalf("state not applied after restart: %+v", entity.State)
+	}
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	domain "github.com/slidebolt/sb-domain"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+func getEntityMeta(t *testing.T, env *testkit.TestEnv, deviceID, entityID string) EntityMeta {
+	t.Helper()
+	raw, err := env.Storage().Get(domain.EntityKey{Plugin: PluginID, DeviceID: deviceID, ID: entityID})
+	if err != nil {
+		t.Fatalf("get %s.%s: %v", deviceID, entityID, err)
+	}
+	return readEntityMeta(raw)
+}
+
+func discoverMetaLamp(in *instance) {
+	dev := `"dev":{"name":"lamp","ids":["zigbee2mqtt_` + renameIEEE + `"]}`
+	light := `{"name":"lamp","stat_t":"zigbee2mqtt/lamp","cmd_t":"zigbee2mqtt/lamp/set","uniq_id":"` + renameIEEE + `_light_zigbee2mqtt","obj_id":"lamp",` + dev + `}`
+	lqi := `{"name":"lamp Linkquality","stat_t":"zigbee2mqtt/lamp","val_tpl":"{{ value_json.linkquality }}","ent_cat":"diagnostic","en":false,"ic":"mdi:signal","sug_dsp_prc":0,` + dev + `}`
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/light/" + renameIEEE + "/light/config", payload: []byte(light)})
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/sensor/" + renameIEEE + "/linkquality/config", payload: []byte(lqi)})
+}
+
+func TestDiscovery_StoresEntityMetadata(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+	discoverMetaLamp(in)
+
+	light := getEntityMeta(t, env, renameIEEE, "light")
+	if light.UniqueID != renameIEEE+"_light_zigbee2mqtt" || light.ObjectID != "lamp" || light.Disabled || light.EntityCategory != "" {
+		t.Fatalf("light meta = %+v", light)
+	}
+	lqi := getEntityMeta(t, env, renameIEEE, "linkquality")
+	if !lqi.Disabled || lqi.EntityCategory != "diagnostic" || lqi.Icon != "mdi:signal" {
+		t.Fatalf("linkquality meta = %+v", lqi)
+	}
+	if lqi.DisplayPrecision == nil || *lqi.DisplayPrecision != 0 {
+		t.Fatalf("display precision = %v", lqi.DisplayPrecision)
+	}
+	// The domain fields are stored as before.
+	if e, ok := getEntity(t, env, renameIEEE, "linkquality"); !ok || e.Type != "sensor" {
+		t.Fatalf("entity = %+v", e)
+	}
+}
+
+func TestEntityMetadata_SurvivesUpdates(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+	discoverMetaLamp(in)
+
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/lamp", payload: []byte(`{"state":"ON","linkquality":90}`)})
+	if meta := getEntityMeta(t, env, renameIEEE, "linkquality"); !meta.Disabled || meta.EntityCategory != "diagnostic" {
+		t.Fatalf("state update dropped metadata: %+v", meta)
+	}
+
+	// A user enables the entity; rediscovery must not disable it again.
+	e, _ := getEntity(t, env, renameIEEE, "linkquality")
+	meta := getEntityMeta(t, env, renameIEEE, "linkquality")
+	meta.Disabled = false
+	if err := env.Storage().Save(entityRecord{Entity: e, Meta: meta}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	discoverMetaLamp(in)
+	if meta := getEntityMeta(t, env, renameIEEE, "linkquality"); meta.Disabled || meta.Icon != "mdi:signal" {
+		t.Fatalf("rediscovery meta = %+v", meta)
+	}
+}
+
+func TestEntityRecord_MarshalJSON(t *testing.T) {
+	e := domain.Entity{ID: "light", Plugin: PluginID, DeviceID: "dev", Type: "light"}
+	plain, err := entityRecord{Entity: e}.MarshalJSON()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if !reflect.DeepEqual(readEntityMeta(plain), EntityMeta{}) {
+		t.Fatalf("empty meta encoded: %s", plain)
+	}
+	data, err := entityRecord{Entity: e, Meta: EntityMeta{EntityCategory: "config"}}.MarshalJSON()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if readEntityMeta(data).EntityCategory != "config" || !strings.Contains(string(data), `"entity_category":"config"`) {
+		t.Fatalf("meta not merged: %s", data)
+	}
+}
+
+func TestEntityRecord_RoundTrip(t *testing.T) {
+	precision := 1
+	available := true
+	e := domain.Entity{ID: "light", Plugin: PluginID, DeviceID: "dev", Type: "light", Name: "Lamp", State: domain.Light{Power: true, Brightness: 200}}
+	meta := EntityMeta{
+		UniqueID:         "dev_light_zigbee2mqtt",
+		EntityCategory:   "config",
+		Disabled:         true,
+		DisplayPrecision: &precision,
+		Available:        &available,
+		Attributes:       map[string]json.RawMessage{"last_seen": json.RawMessage(`"2024-01-01T00:00:00Z"`)},
+	}
+	data, err := json.Marshal(entityRecord{Entity: e, Meta: meta})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var got domain.Entity
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("unmarshal into domain.Entity: %v", err)
+	}
+	if got.Key() != e.Key() || got.Type != e.Type || got.Name != e.Name {
+		t.Fatalf("entity = %+v", got)
+	}
+	if s, ok := got.State.(domain.Light); !ok || !s.Power || s.Brightness != 200 {
+		t.Fatalf("state = %#v", got.State)
+	}
+	if gotMeta := readEntityMeta(data); !reflect.DeepEqual(gotMeta, meta) {
+		t.Fatalf("meta = %+v, want %+v", gotMeta, meta)
+	}
+
+	// Saving what was read back keeps both halves.
+	again, err := json.Marshal(entityRecord{Entity: got, Meta: readEntityMeta(data)})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if string(again) != string(data) {
+		t.Fatalf("second round trip = %s, want %s", again, data)
+	}
+}
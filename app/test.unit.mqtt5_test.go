@@ -0,0 +1,268 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	domain "github.com/slidebolt/sb-domain"
+	messenger "github.com/slidebolt/sb-messenger-sdk"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+func TestPahoProtocolVersion(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want uint
+		ok   bool
+	}{
+		{"", 0, true},
+		{"3.1.1", 4, true},
+		{"4", 4, true},
+		{"3.1", 3, true},
+		{"3", 3, true},
+		{"5", 5, true},
+		{"5.0", 5, true},
+		{"6", 0, false},
+		{"mqtt", 0, false},
+	} {
+		got, err := pahoProtocolVersion(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("pahoProtocolVersion(%q) = %d, %v; want %d, ok=%v", tc.in, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestValidateProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  MQTTConfig
+		ok   bool
+	}{
+		{"3.1.1", MQTTConfig{}, true},
+		{"v5 options on 3.1.1", MQTTConfig{ResponseTopic: "z2m/responses"}, false},
+		{"user properties on 3.1.1", MQTTConfig{ProtocolVersion: "3.1.1", UserProperties: map[string]string{"site": "home"}}, false},
+		{"v5 persistent session", MQTTConfig{ProtocolVersion: "5", SessionExpiryInterval: 3600}, true},
+		{"v5 session that never outlives the connection", MQTTConfig{ProtocolVersion: "5"}, false},
+		{"v5 clean session", MQTTConfig{ProtocolVersion: "5", CleanSession: true}, true},
+		{"unknown version", MQTTConfig{ProtocolVersion: "6"}, false},
+	} {
+		if err := tc.cfg.validateProtocol(); (err == nil) != tc.ok {
+			t.Errorf("%s: validateProtocol() = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+// fakeBroker is a single-connection MQTT 5 broker. It grants every
+// subscription, answers replay with the retained messages of a subscribed
+// filter, and refuses QoS 1 publishes to /set topics as not authorized.
+type fakeBroker struct {
+	ln       net.Listener
+	retained map[string][]*packets.Publish
+	connects chan *packets.Connect
+	pubs     chan *packets.Publish
+}
+
+func newFakeBroker(t *testing.T, retained map[string][]*packets.Publish) *fakeBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	b := &fakeBroker{
+		ln:       ln,
+		retained: retained,
+		connects: make(chan *packets.Connect, 1),
+		pubs:     make(chan *packets.Publish, 100),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go b.serve()
+	return b
+}
+
+func (b *fakeBroker) url() string { return "tcp://" + b.ln.Addr().String() }
+
+func (b *fakeBroker) serve() {
+	conn, err := b.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var replies []*packets.ControlPacket
+		switch p := cp.Content.(type) {
+		case *packets.Connect:
+			b.connects <- p
+			replies = append(replies, packets.NewControlPacket(packets.CONNACK))
+		case *packets.Subscribe:
+			ack := packets.NewControlPacket(packets.SUBACK)
+			suback := ack.Content.(*packets.Suback)
+			suback.PacketID = p.PacketID
+			replies = append(replies, ack)
+			for _, sub := range p.Subscriptions {
+				suback.Reasons = append(suback.Reasons, sub.QoS)
+				for _, pub := range b.retained[sub.Topic] {
+					msg := packets.NewControlPacket(packets.PUBLISH)
+					msg.Content = pub
+					replies = append(replies, msg)
+				}
+			}
+		case *packets.Publish:
+			b.pubs <- p
+			if p.QoS == 1 {
+				ack := packets.NewControlPacket(packets.PUBACK)
+				puback := ack.Content.(*packets.Puback)
+				puback.PacketID = p.PacketID
+				if strings.HasSuffix(p.Topic, "/set") {
+					puback.ReasonCode = 0x87
+					puback.Properties.ReasonString = "denied by ACL"
+				}
+				replies = append(replies, ack)
+			}
+		case *packets.Pingreq:
+			replies = append(replies, packets.NewControlPacket(packets.PINGRESP))
+		case *packets.Disconnect:
+			return
+		}
+		for _, reply := range replies {
+			if _, err := reply.WriteTo(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// nextPublish returns the next client publish to topic, skipping others.
+func (b *fakeBroker) nextPublish(t *testing.T, topic string) *packets.Publish {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case p := <-b.pubs:
+			if p.Topic == topic {
+				return p
+			}
+		case <-deadline:
+			t.Fatalf("no publish to %s", topic)
+			return nil
+		}
+	}
+}
+
+// storedLightPower reports the power of the stored 0x01 light; false until
+// it has been discovered.
+func storedLightPower(t *testing.T, env *testkit.TestEnv) bool {
+	t.Helper()
+	raw, err := env.Storage().Get(domain.EntityKey{Plugin: PluginID, DeviceID: "0x01", ID: "light"})
+	if err != nil {
+		return false
+	}
+	var entity domain.Entity
+	if err := json.Unmarshal(raw, &entity); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	light, _ := entity.State.(domain.Light)
+	return light.Power
+}
+
+func TestMQTT5_ConnectsWithPropertiesAndReportsReasonCodes(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+
+	broker := newFakeBroker(t, map[string][]*packets.Publish{
+		"homeassistant/#": {{
+			Topic:      "homeassistant/light/0x01/config",
+			Payload:    []byte(`{"name":"Lamp","state_topic":"zigbee2mqtt/lamp","command_topic":"zigbee2mqtt/lamp/set"}`),
+			Properties: &packets.Properties{},
+		}},
+		"zigbee2mqtt/#": {{
+			Topic:      "zigbee2mqtt/lamp",
+			Payload:    []byte(`{"state":"ON"}`),
+			Properties: &packets.Properties{},
+		}},
+	})
+
+	p := &plugin{msg: env.Messenger(), store: env.Storage()}
+	in := newInstance(p, MQTTConfig{
+		Broker:                broker.url(),
+		ClientID:              "z2m-test",
+		ProtocolVersion:       "5",
+		SessionExpiryInterval: 600,
+		UserProperties:        map[string]string{"site": "home"},
+		ResponseTopic:         "slidebolt/responses",
+		DiscoveryPrefix:       "homeassistant",
+		BaseTopic:             "zigbee2mqtt",
+		StatusTopic:           "slidebolt/plugin-zigbee2mqtt/status",
+		CommandQoS:            1,
+	})
+	p.instances = []*instance{in}
+	if err := in.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer in.disconnect()
+
+	var connect *packets.Connect
+	select {
+	case connect = <-broker.connects:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no CONNECT")
+	}
+	if connect.ProtocolVersion != 5 || connect.ClientID != "z2m-test" {
+		t.Fatalf("CONNECT version=%d client=%q", connect.ProtocolVersion, connect.ClientID)
+	}
+	if e := connect.Properties.SessionExpiryInterval; e == nil || *e != 600 {
+		t.Fatalf("CONNECT session expiry = %v, want 600", e)
+	}
+	if u := connect.Properties.User; len(u) != 1 || u[0] != (packets.User{Key: "site", Value: "home"}) {
+		t.Fatalf("CONNECT user properties = %+v", u)
+	}
+	if !connect.WillFlag || connect.WillTopic != "slidebolt/plugin-zigbee2mqtt/status" || string(connect.WillMessage) != statusOffline {
+		t.Fatalf("CONNECT will = %q %q", connect.WillTopic, connect.WillMessage)
+	}
+
+	// The birth message goes out once the subscriptions are granted.
+	if status := broker.nextPublish(t, "slidebolt/plugin-zigbee2mqtt/status"); string(status.Payload) != statusOnline || !status.Retain {
+		t.Fatalf("status publish = %+v", status)
+	}
+
+	// Retained discovery and state arrive through the subscription routes.
+	deadline := time.Now().Add(5 * time.Second)
+	for !storedLightPower(t, env) {
+		if time.Now().After(deadline) {
+			t.Fatal("retained state never reached the light")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Commands carry the response topic and user properties, and a
+	// refused publish surfaces the broker's reason code.
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: "0x01", EntityID: "light"}, domain.LightTurnOff{})
+	cmd := broker.nextPublish(t, "zigbee2mqtt/lamp/set")
+	if cmd.Properties.ResponseTopic != "slidebolt/responses" {
+		t.Fatalf("command response topic = %q", cmd.Properties.ResponseTopic)
+	}
+	if u := cmd.Properties.User; len(u) != 1 || u[0].Key != "site" {
+		t.Fatalf("command user properties = %+v", u)
+	}
+
+	token := publishCommand(in.mqtt, "zigbee2mqtt/lamp/set", 1, []byte(`{"state":"OFF"}`))
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatal("publish never completed")
+	}
+	var refused *publishError
+	if !errors.As(token.Error(), &refused) || refused.Code != 0x87 || refused.Reason != "denied by ACL" {
+		t.Fatalf("publish error = %v, want 0x87 denied by ACL", token.Error())
+	}
+	if got := publishReason(token); got != " reason=0x87 (not authorized)" {
+		t.Fatalf("publishReason = %q", got)
+	}
+}
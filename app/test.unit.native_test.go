@@ -0,0 +1,248 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+
+	domain "github.com/slidebolt/sb-domain"
+	messenger "github.com/slidebolt/sb-messenger-sdk"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+const bridgeDevicesFixture = `[
+	{"ieee_address":"0x0000000000000000","type":"Coordinator","friendly_name":"Coordinator"},
+	{"ieee_address":"0x00158d0001a2b3c4","type":"Router","friendly_name":"kitchen","model_id":"TRADFRI bulb E27","software_build_id":"2.3.093",
+	 "definition":{"model":"LED1545G12","vendor":"IKEA","description":"TRADFRI bulb","exposes":[
+		{"type":"light","features":[
+			{"type":"binary","name":"state","property":"state","access":7,"value_on":"ON","value_off":"OFF"},
+			{"type":"numeric","name":"brightness","property":"brightness","access":7,"value_min":0,"value_max":254},
+			{"type":"numeric","name":"color_temp","property":"color_temp","access":7,"value_min":250,"value_max":454}]},
+		{"type":"enum","name":"power_on_behavior","property":"power_on_behavior","access":7,"values":["off","on","previous"]},
+		{"type":"composite","name":"color_options","property":"color_options","access":2,"features":[
+			{"type":"binary","name":"execute_if_off","property":"execute_if_off","access":2,"value_on":true,"value_off":false}]},
+		{"type":"numeric","name":"linkquality","property":"linkquality","access":1,"unit":"lqi"}]}},
+	{"ieee_address":"0x00124b0022a1b2c3","type":"EndDevice","friendly_name":"hall sensor",
+	 "definition":{"model":"SNZB-02","vendor":"SONOFF","exposes":[
+		{"type":"numeric","name":"temperature","property":"temperature","access":1,"unit":"°C"},
+		{"type":"binary","name":"occupancy","property":"occupancy","access":1,"value_on":true,"value_off":false}]}},
+	{"ieee_address":"0x00124b0022d4e5f6","type":"Router","friendly_name":"double switch",
+	 "definition":{"model":"QBKG03LM","vendor":"Aqara","exposes":[
+		{"type":"switch","endpoint":"left","features":[{"type":"binary","name":"state","property":"state_left","access":7,"value_on":"ON","value_off":"OFF"}]},
+		{"type":"switch","endpoint":"right","features":[{"type":"binary","name":"state","property":"state_right","access":7,"value_on":"ON","value_off":"OFF"}]}]}}
+]`
+
+func newNativeTestInstance(t *testing.T, env *testkit.TestEnv, mode string) (*plugin, *instance, *fakeClient) {
+	t.Helper()
+	p := &plugin{msg: env.Messenger(), store: env.Storage()}
+	in := newInstance(p, MQTTConfig{
+		DiscoveryPrefix: "homeassistant",
+		BaseTopic:       "zigbee2mqtt",
+		DiscoveryMode:   mode,
+	})
+	client := newFakeClient()
+	in.mqtt = client
+	p.instances = []*instance{in}
+	return p, in, client
+}
+
+func getEntity(t *testing.T, env *testkit.TestEnv, deviceID, entityID string) (domain.Entity, bool) {
+	t.Helper()
+	raw, err := env.Storage().Get(domain.EntityKey{Plugin: PluginID, DeviceID: deviceID, ID: entityID})
+	if err != nil {
+		return domain.Entity{}, false
+	}
+	var entity domain.Entity
+	if err := json.Unmarshal(raw, &entity); err != nil {
+		t.Fatalf("unmarshal %s.%s: %v", deviceID, entityID, err)
+	}
+	return entity, true
+}
+
+func TestBridgeDevices_MapsExposesToEntities(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, _ := newNativeTestInstance(t, env, discoveryNative)
+
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/devices", payload: []byte(bridgeDevicesFixture)})
+
+	want := map[[2]string]string{
+		{"0x00158d0001a2b3c4", "light"}:                        "light",
+		{"0x00158d0001a2b3c4", "power_on_behavior"}:            "select",
+		{"0x00158d0001a2b3c4", "color_options_execute_if_off"}: "switch",
+		{"0x00158d0001a2b3c4", "linkquality"}:                  "sensor",
+		{"0x00124b0022a1b2c3", "temperature"}:                  "sensor",
+		{"0x00124b0022a1b2c3", "occupancy"}:                    "binary_sensor",
+		{"0x00124b0022d4e5f6", "switch_left"}:                  "switch",
+		{"0x00124b0022d4e5f6", "switch_right"}:                 "switch",
+	}
+	for k, typ := range want {
+		entity, ok := getEntity(t, env, k[0], k[1])
+		if !ok {
+			t.Fatalf("entity %s.%s not created", k[0], k[1])
+		}
+		if entity.Type != typ {
+			t.Fatalf("%s.%s type = %q, want %q", k[0], k[1], entity.Type, typ)
+		}
+	}
+	if _, ok := getEntity(t, env, "0x0000000000000000", "light"); ok {
+		t.Fatal("coordinator mapped to an entity")
+	}
+
+	dev, ok := p.getDevice("0x00158d0001a2b3c4")
+	if !ok || dev.Manufacturer != "IKEA" || dev.Model != "LED1545G12" || dev.IEEEAddress != "0x00158d0001a2b3c4" || len(dev.Entities) != 4 {
+		t.Fatalf("device = %+v", dev)
+	}
+}
+
+func TestBridgeDevices_DecodesStateThroughCodecs(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, _ := newNativeTestInstance(t, env, discoveryNative)
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/devices", payload: []byte(bridgeDevicesFixture)})
+
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/kitchen", payload: []byte(`{"state":"ON","brightness":100,"power_on_behavior":"previous","color_options":{"execute_if_off":true},"linkquality":87}`)})
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/hall sensor", payload: []byte(`{"temperature":21.5,"occupancy":true}`)})
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/double switch", payload: []byte(`{"state_left":"ON","state_right":"OFF"}`)})
+
+	light, _ := getEntity(t, env, "0x00158d0001a2b3c4", "light")
+	if s, ok := light.State.(domain.Light); !ok || !s.Power || s.Brightness != 100 {
+		t.Fatalf("light state = %#v", light.State)
+	}
+	sel, _ := getEntity(t, env, "0x00158d0001a2b3c4", "power_on_behavior")
+	if s, ok := sel.State.(domain.Select); !ok || s.Option != "previous" {
+		t.Fatalf("select state = %#v", sel.State)
+	}
+	opt, _ := getEntity(t, env, "0x00158d0001a2b3c4", "color_options_execute_if_off")
+	if s, ok := opt.State.(domain.Switch); !ok || !s.Power {
+		t.Fatalf("composite switch state = %#v", opt.State)
+	}
+	temp, _ := getEntity(t, env, "0x00124b0022a1b2c3", "temperature")
+	if s, ok := temp.State.(domain.Sensor); !ok || s.Value != 21.5 || s.Unit != "°C" || s.DeviceClass != "temperature" {
+		t.Fatalf("sensor state = %#v", temp.State)
+	}
+	occ, _ := getEntity(t, env, "0x00124b0022a1b2c3", "occupancy")
+	if s, ok := occ.State.(domain.BinarySensor); !ok || !s.On {
+		t.Fatalf("binary sensor state = %#v", occ.State)
+	}
+	left, _ := getEntity(t, env, "0x00124b0022d4e5f6", "switch_left")
+	right, _ := getEntity(t, env, "0x00124b0022d4e5f6", "switch_right")
+	if l, ok := left.State.(domain.Switch); !ok || !l.Power {
+		t.Fatalf("left switch state = %#v", left.State)
+	}
+	if r, ok := right.State.(domain.Switch); !ok || r.Power {
+		t.Fatalf("right switch state = %#v", right.State)
+	}
+}
+
+func TestBridgeDevices_CommandsTargetProperty(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, client := newNativeTestInstance(t, env, discoveryNative)
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/devices", payload: []byte(bridgeDevicesFixture)})
+
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: "0x00158d0001a2b3c4", EntityID: "power_on_behavior"}, domain.SelectOption{Option: "on"})
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: "0x00158d0001a2b3c4", EntityID: "color_options_execute_if_off"}, domain.SwitchTurnOn{})
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: "0x00124b0022d4e5f6", EntityID: "switch_right"}, domain.SwitchTurnOn{})
+
+	want := []struct{ topic, payload string }{
+		{"zigbee2mqtt/kitchen/set", `{"power_on_behavior":"on"}`},
+		{"zigbee2mqtt/kitchen/set", `{"color_options":{"execute_if_off":true}}`},
+		{"zigbee2mqtt/double switch/set", `{"state_right":"ON"}`},
+	}
+	got := client.publishes()
+	if len(got) != len(want) {
+		t.Fatalf("publishes = %+v", got)
+	}
+	for i, w := range want {
+		if got[i].Topic != w.topic || got[i].Payload != w.payload {
+			t.Fatalf("publish %d = %s %s, want %s %s", i, got[i].Topic, got[i].Payload, w.topic, w.payload)
+		}
+	}
+}
+
+func TestBridgeDevices_DropsRemovedDevices(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, _ := newNativeTestInstance(t, env, discoveryNative)
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/devices", payload: []byte(bridgeDevicesFixture)})
+
+	var devices []json.RawMessage
+	if err := json.Unmarshal([]byte(bridgeDevicesFixture), &devices); err != nil {
+		t.Fatalf("fixture: %v", err)
+	}
+	remaining, _ := json.Marshal(devices[:2])
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/devices", payload: remaining})
+
+	if _, ok := getEntity(t, env, "0x00124b0022a1b2c3", "temperature"); ok {
+		t.Fatal("entity of removed device still stored")
+	}
+	if _, ok := p.getDevice("0x00124b0022a1b2c3"); ok {
+		t.Fatal("removed device record still stored")
+	}
+	if _, ok := getEntity(t, env, "0x00158d0001a2b3c4", "light"); !ok {
+		t.Fatal("entity of remaining device removed")
+	}
+}
+
+func TestBridgeDevices_IgnoredInHomeAssistantMode(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, client := newNativeTestInstance(t, env, discoveryHomeAssistant)
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/devices", payload: []byte(bridgeDevicesFixture)})
+
+	if _, ok := getEntity(t, env, "0x00158d0001a2b3c4", "light"); ok {
+		t.Fatal("bridge/devices mapped in homeassistant mode")
+	}
+
+	in.onMQTTConnect(client)
+	if _, ok := client.subscribed["homeassistant/#"]; !ok {
+		t.Fatalf("homeassistant mode did not subscribe to discovery: %v", client.subscribed)
+	}
+}
+
+func TestBridgeDevices_NativeModeSkipsDiscoverySubscription(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, client := newNativeTestInstance(t, env, discoveryNative)
+
+	in.onMQTTConnect(client)
+	if _, ok := client.subscribed["homeassistant/#"]; ok {
+		t.Fatal("native mode subscribed to HA discovery")
+	}
+	if _, ok := client.subscribed["zigbee2mqtt/#"]; !ok {
+		t.Fatalf("native mode did not subscribe to the base topic: %v", client.subscribed)
+	}
+}
+
+func TestBridgeDevices_NativeTakesPrecedenceInBothMode(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, _ := newNativeTestInstance(t, env, discoveryBoth)
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/devices", payload: []byte(bridgeDevicesFixture)})
+
+	ha := []byte(`{"name":"Power-on behavior","state_topic":"zigbee2mqtt/kitchen","command_topic":"zigbee2mqtt/kitchen/set","options":["off","on"]}`)
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/select/0x00158d0001a2b3c4/power_on_behavior/config", payload: ha})
+
+	info, err := p.getTopicInfo(domain.EntityKey{Plugin: PluginID, DeviceID: "0x00158d0001a2b3c4", ID: "power_on_behavior"})
+	if err != nil || !info.Native || info.Property != "power_on_behavior" {
+		t.Fatalf("topic info = %+v, %v", info, err)
+	}
+}
+
+func TestValidateDiscoveryMode(t *testing.T) {
+	for _, mode := range []string{"", discoveryHomeAssistant, discoveryNative, discoveryBoth} {
+		if err := (MQTTConfig{DiscoveryMode: mode}).validateDiscoveryMode(); err != nil {
+			t.Fatalf("mode %q: %v", mode, err)
+		}
+	}
+	if err := (MQTTConfig{DiscoveryMode: "z2m"}).validateDiscoveryMode(); err == nil {
+		t.Fatal("unknown discovery mode accepted")
+	}
+}
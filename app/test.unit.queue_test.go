@@ -0,0 +1,269 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	domain "github.com/slidebolt/sb-domain"
+	messenger "github.com/slidebolt/sb-messenger-sdk"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+func TestCommandQueue_LatestWinsAndBounded(t *testing.T) {
+	keyA := domain.EntityKey{Plugin: PluginID, DeviceID: "0x01", ID: "light"}
+	keyB := domain.EntityKey{Plugin: PluginID, DeviceID: "0x02", ID: "light"}
+	keyC := domain.EntityKey{Plugin: PluginID, DeviceID: "0x03", ID: "light"}
+
+	q := newCommandQueue(2)
+	q.push(queuedCommand{key: keyA, payload: []byte("a1"), prevState: "a-before"})
+	q.push(queuedCommand{key: keyB, payload: []byte("b1")})
+	if dropped := q.push(queuedCommand{key: keyA, payload: []byte("a2"), prevState: "a-after-a1"}); len(dropped) != 0 {
+		t.Fatalf("collapsing dropped %d commands", len(dropped))
+	}
+	dropped := q.push(queuedCommand{key: keyC, payload: []byte("c1")})
+	if len(dropped) != 1 || dropped[0].key != keyB {
+		t.Fatalf("dropped = %+v, want the oldest (b1)", dropped)
+	}
+
+	items := q.take()
+	if len(items) != 2 || string(items[0].payload) != "a2" || string(items[1].payload) != "c1" {
+		t.Fatalf("queue order = %+v", items)
+	}
+	if items[0].prevState != "a-before" {
+		t.Fatalf("collapsed rollback state = %v, want the state before a1", items[0].prevState)
+	}
+}
+
+func TestCommandQueue_Expire(t *testing.T) {
+	now := time.Now()
+	q := newCommandQueue(10)
+	q.push(queuedCommand{key: domain.EntityKey{ID: "old"}, expiresAt: now.Add(-time.Second)})
+	q.push(queuedCommand{key: domain.EntityKey{ID: "new"}, expiresAt: now.Add(time.Minute)})
+
+	expired := q.expire(now)
+	if len(expired) != 1 || expired[0].key.ID != "old" {
+		t.Fatalf("expired = %+v", expired)
+	}
+	if rest := q.take(); len(rest) != 1 || rest[0].key.ID != "new" {
+		t.Fatalf("remaining = %+v", rest)
+	}
+}
+
+// newQueueTestInstance discovers a light on a disconnected instance and
+// reports it as off.
+func newQueueTestInstance(t *testing.T, env *testkit.TestEnv) (*plugin, *instance, *fakeClient) {
+	t.Helper()
+	p := &plugin{msg: env.Messenger(), store: env.Storage()}
+	in := newInstance(p, MQTTConfig{
+		DiscoveryPrefix:   "homeassistant",
+		BaseTopic:         "zigbee2mqtt",
+		CommandQoS:        1,
+		CommandQueueSize:  10,
+		CommandTTLSeconds: 30,
+	})
+	client := newFakeClient()
+	client.connected = false
+	in.mqtt = client
+	p.instances = []*instance{in}
+
+	discovery := []byte(`{"name":"Lamp","state_topic":"zigbee2mqtt/lamp","command_topic":"zigbee2mqtt/lamp/set"}`)
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/light/0x01/config", payload: discovery})
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/lamp", payload: []byte(`{"state":"OFF"}`)})
+	return p, in, client
+}
+
+func lightPower(t *testing.T, env *testkit.TestEnv) bool {
+	t.Helper()
+	raw, err := env.Storage().Get(domain.EntityKey{Plugin: PluginID, DeviceID: "0x01", ID: "light"})
+	if err != nil {
+		t.Fatalf("get light: %v", err)
+	}
+	var entity domain.Entity
+	if err := json.Unmarshal(raw, &entity); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	light, _ := entity.State.(domain.Light)
+	return light.Power
+}
+
+func TestHandleCommand_QueuesWhileDisconnectedAndDrainsOnConnect(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, client := newQueueTestInstance(t, env)
+
+	addr := messenger.Address{Plugin: PluginID, DeviceID: "0x01", EntityID: "light"}
+	p.handleCommand(addr, domain.LightTurnOn{})
+	p.handleCommand(addr, domain.LightTurnOff{})
+	p.handleCommand(addr, domain.LightTurnOn{})
+
+	if got := client.publishes(); len(got) != 0 {
+		t.Fatalf("published while disconnected: %+v", got)
+	}
+	if !lightPower(t, env) {
+		t.Fatal("optimistic state not applied")
+	}
+
+	client.connected = true
+	in.onMQTTConnect(client)
+
+	var sent []fakePublish
+	for _, pub := range client.publishes() {
+		if pub.Topic == "zigbee2mqtt/lamp/set" {
+			sent = append(sent, pub)
+		}
+	}
+	if len(sent) != 1 {
+		t.Fatalf("drained %d commands, want the latest one only: %+v", len(sent), sent)
+	}
+	if sent[0].QoS != 1 || sent[0].Retained {
+		t.Fatalf("drained publish qos=%d retained=%v", sent[0].QoS, sent[0].Retained)
+	}
+}
+
+func TestQueuedCommand_ExpiryRollsBackAndReports(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, client := newQueueTestInstance(t, env)
+
+	events := make(chan CommandFailedEvent, 1)
+	sub, err := env.Messenger().Subscribe(subjectEventPrefix+eventCommandFailed, func(m *messenger.Message) {
+		var ev CommandFailedEvent
+		if err := json.Unmarshal(m.Data, &ev); err == nil {
+			events <- ev
+		}
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: "0x01", EntityID: "light"}, domain.LightTurnOn{})
+	if !lightPower(t, env) {
+		t.Fatal("optimistic state not applied")
+	}
+
+	for _, cmd := range in.queue.expire(time.Now().Add(time.Minute)) {
+		in.p.failCommand(cmd, "expired")
+	}
+	if lightPower(t, env) {
+		t.Fatal("optimistic state not rolled back")
+	}
+
+	select {
+	case ev := <-events:
+		if ev.Entity != PluginID+".0x01.light" || ev.Reason != "expired" {
+			t.Fatalf("event = %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no command_failed event")
+	}
+
+	client.connected = true
+	in.onMQTTConnect(client)
+	for _, pub := range client.publishes() {
+		if pub.Topic == "zigbee2mqtt/lamp/set" {
+			t.Fatalf("expired command was sent: %+v", pub)
+		}
+	}
+}
+
+func TestHandleCommand_FailedPublishSkipsOptimisticStateAndReports(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, _, client := newQueueTestInstance(t, env)
+	client.connected = true
+	client.publishErr = errors.New("not authorized")
+
+	events := make(chan CommandFailedEvent, 1)
+	sub, err := env.Messenger().Subscribe(subjectEventPrefix+eventCommandFailed, func(m *messenger.Message) {
+		var ev CommandFailedEvent
+		if err := json.Unmarshal(m.Data, &ev); err == nil {
+			events <- ev
+		}
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: "0x01", EntityID: "light"}, domain.LightTurnOn{})
+	if got := client.publishes(); len(got) != 1 || got[0].Topic != "zigbee2mqtt/lamp/set" {
+		t.Fatalf("publishes = %+v", got)
+	}
+	if lightPower(t, env) {
+		t.Fatal("optimistic state applied for a failed publish")
+	}
+
+	select {
+	case ev := <-events:
+		if ev.Entity != PluginID+".0x01.light" || ev.Reason != "not authorized" {
+			t.Fatalf("event = %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no command_failed event")
+	}
+}
+
+func TestDrainQueue_UnacknowledgedPublishFails(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, client := newQueueTestInstance(t, env)
+
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: "0x01", EntityID: "light"}, domain.LightTurnOn{})
+	if !lightPower(t, env) {
+		t.Fatal("optimistic state not applied")
+	}
+
+	client.connected = true
+	client.publishTimeout = true
+	in.drainQueue(client)
+	if lightPower(t, env) {
+		t.Fatal("optimistic state kept for an unacknowledged publish")
+	}
+}
+
+func TestHandleCommand_UnsendableCommandLeavesStateAlone(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, _ := newQueueTestInstance(t, env)
+
+	events := make(chan CommandFailedEvent, 2)
+	sub, err := env.Messenger().Subscribe(subjectEventPrefix+eventCommandFailed, func(m *messenger.Message) {
+		var ev CommandFailedEvent
+		if err := json.Unmarshal(m.Data, &ev); err == nil {
+			events <- ev
+		}
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	// An instance without a client, then an entity without a command topic.
+	in.mqtt = nil
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: "0x01", EntityID: "light"}, domain.LightTurnOn{})
+	in.mqtt = newFakeClient()
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/light/0x01/config", payload: []byte(`{"name":"Lamp","state_topic":"zigbee2mqtt/lamp"}`)})
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: "0x01", EntityID: "light"}, domain.LightTurnOn{})
+
+	if lightPower(t, env) {
+		t.Fatal("optimistic state applied for a command that was never sent")
+	}
+	for _, want := range []string{"MQTT not connected", "no command topic"} {
+		select {
+		case ev := <-events:
+			if ev.Reason != want {
+				t.Fatalf("event = %+v, want reason %q", ev, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no command_failed event for %q", want)
+		}
+	}
+}
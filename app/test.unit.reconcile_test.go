@@ -0,0 +1,100 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	domain "github.com/slidebolt/sb-domain"
+	messenger "github.com/slidebolt/sb-messenger-sdk"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+func discoverLight(in *instance, deviceID string) {
+	in.handleDiscoveryMessage(nil, &fakeMessage{
+		topic:   "homeassistant/light/" + deviceID + "/config",
+		payload: []byte(`{"name":"Lamp ` + deviceID + `","state_topic":"zigbee2mqtt/` + deviceID + `","command_topic":"zigbee2mqtt/` + deviceID + `/set"}`),
+	})
+}
+
+func TestReconcile_MarksOrDeletesEntitiesNotRediscovered(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p := &plugin{msg: env.Messenger(), store: env.Storage()}
+	in := newInstance(p, MQTTConfig{Name: "north", DiscoveryPrefix: "homeassistant", BaseTopic: "zigbee2mqtt"})
+	p.instances = []*instance{in}
+
+	reports := make(chan ReconcileReport, 2)
+	sub, err := env.Messenger().Subscribe(subjectEventPrefix+eventReconcileReport, func(m *messenger.Message) {
+		var r ReconcileReport
+		if err := json.Unmarshal(m.Data, &r); err == nil {
+			reports <- r
+		}
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	// Previous run: two lamps. After reconnecting only one is replayed.
+	discoverLight(in, "0x01")
+	discoverLight(in, "0x02")
+	in.scheduleReconcile()
+	discoverLight(in, "0x01")
+	in.reconcile()
+
+	kept := domain.EntityKey{Plugin: PluginID, DeviceID: "north_0x01", ID: "light"}
+	gone := domain.EntityKey{Plugin: PluginID, DeviceID: "north_0x02", ID: "light"}
+	if info, _ := p.getTopicInfo(kept); info.OrphanedAt != nil {
+		t.Fatal("rediscovered entity marked orphaned")
+	}
+	if info, _ := p.getTopicInfo(gone); info.OrphanedAt == nil {
+		t.Fatal("stale entity not marked orphaned")
+	}
+	select {
+	case r := <-reports:
+		if r.Action != orphanMark || r.Discovered != 1 || len(r.Orphaned) != 1 || r.Orphaned[0] != gone.Key() {
+			t.Fatalf("report = %+v", r)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reconcile report")
+	}
+
+	in.cfg.OrphanAction = orphanDelete
+	in.reconcile()
+	if _, err := env.Storage().Get(gone); err == nil {
+		t.Fatal("stale entity not deleted")
+	}
+	if _, err := env.Storage().Get(kept); err != nil {
+		t.Fatalf("rediscovered entity deleted: %v", err)
+	}
+}
+
+func TestReconcile_SkipsWithoutDiscovery(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("storage")
+	p := &plugin{store: env.Storage()}
+	in := newInstance(p, MQTTConfig{DiscoveryPrefix: "homeassistant", BaseTopic: "zigbee2mqtt", OrphanAction: orphanDelete})
+	p.instances = []*instance{in}
+
+	discoverLight(in, "0x01")
+	in.scheduleReconcile()
+	in.reconcile()
+
+	if _, err := env.Storage().Get(domain.EntityKey{Plugin: PluginID, DeviceID: "0x01", ID: "light"}); err != nil {
+		t.Fatalf("entity deleted after an empty discovery replay: %v", err)
+	}
+}
+
+func TestValidateReconcile(t *testing.T) {
+	if err := (MQTTConfig{OrphanAction: "archive"}).validateReconcile(); err == nil {
+		t.Fatal("unknown orphan action accepted")
+	}
+	if err := (MQTTConfig{ReconcileAfterSeconds: -1}).validateReconcile(); err == nil {
+		t.Fatal("negative settle window accepted")
+	}
+	if err := (MQTTConfig{OrphanAction: orphanDelete, ReconcileAfterSeconds: 30}).validateReconcile(); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	domain "github.com/slidebolt/sb-domain"
+	messenger "github.com/slidebolt/sb-messenger-sdk"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+func TestDiscovery_EmptyPayloadRemovesEntity(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p := &plugin{msg: env.Messenger(), store: env.Storage()}
+	in := newInstance(p, MQTTConfig{Name: "north", DiscoveryPrefix: "homeassistant", BaseTopic: "zigbee2mqtt"})
+
+	events := make(chan EntityRemovedEvent, 1)
+	sub, err := env.Messenger().Subscribe(subjectEventPrefix+eventEntityRemoved, func(m *messenger.Message) {
+		var ev EntityRemovedEvent
+		if err := json.Unmarshal(m.Data, &ev); err == nil {
+			events <- ev
+		}
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	topic := "homeassistant/light/0x01/config"
+	discovery := []byte(`{"name":"Lamp","state_topic":"zigbee2mqtt/lamp","command_topic":"zigbee2mqtt/lamp/set"}`)
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: topic, payload: discovery, retained: true})
+	key := domain.EntityKey{Plugin: PluginID, DeviceID: "north_0x01", ID: "light"}
+	if _, err := env.Storage().Get(key); err != nil {
+		t.Fatalf("entity not discovered: %v", err)
+	}
+
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: topic, payload: nil, retained: true})
+
+	if _, err := env.Storage().Get(key); err == nil {
+		t.Fatal("entity still stored")
+	}
+	if _, err := p.getTopicInfo(key); err == nil {
+		t.Fatal("topic info still stored")
+	}
+	if got := in.stateTopicIndex["zigbee2mqtt/lamp"]; len(got) != 0 {
+		t.Fatalf("state topic index = %v", got)
+	}
+	select {
+	case ev := <-events:
+		if ev.Entity != key.Key() || ev.Instance != "north" {
+			t.Fatalf("event = %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no entity_removed event")
+	}
+
+	// A second clear for an entity that no longer exists is a no-op.
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: topic, payload: []byte(""), retained: true})
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event for unknown entity: %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
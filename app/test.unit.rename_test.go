@@ -0,0 +1,273 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	domain "github.com/slidebolt/sb-domain"
+	messenger "github.com/slidebolt/sb-messenger-sdk"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+const renameIEEE = "0x00158d0001a2b3c4"
+
+// discoverLamp discovers a light and its linkquality sensor on the state
+// topic zigbee2mqtt/lamp and reports the light as on.
+func discoverLamp(in *instance) {
+	dev := `"device":{"name":"lamp","identifiers":["zigbee2mqtt_` + renameIEEE + `"]}`
+	light := []byte(`{"name":"lamp","state_topic":"zigbee2mqtt/lamp","command_topic":"zigbee2mqtt/lamp/set",` + dev + `}`)
+	lqi := []byte(`{"name":"lamp Linkquality","state_topic":"zigbee2mqtt/lamp","value_template":"{{ value_json.linkquality }}",` + dev + `}`)
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/light/" + renameIEEE + "/light/config", payload: light})
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: "homeassistant/sensor/" + renameIEEE + "/linkquality/config", payload: lqi})
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/lamp", payload: []byte(`{"state":"ON","brightness":200,"linkquality":90}`)})
+}
+
+func TestRenameResponse_MovesEntitiesInPlace(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, client := newNativeTestInstance(t, env, discoveryHomeAssistant)
+	discoverLamp(in)
+
+	// The user renamed the sensor; that name must survive.
+	lqi, _ := getEntity(t, env, renameIEEE, "linkquality")
+	lqi.Name = "Lamp signal"
+	if err := env.Storage().Save(lqi); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	events := make(chan DeviceRenamedEvent, 1)
+	sub, err := env.Messenger().Subscribe(subjectEventPrefix+eventDeviceRenamed, func(m *messenger.Message) {
+		var ev DeviceRenamedEvent
+		if err := json.Unmarshal(m.Data, &ev); err == nil {
+			events <- ev
+		}
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	in.handleStateMessage(nil, &fakeMessage{
+		topic:   "zigbee2mqtt/bridge/response/device/rename",
+		payload: []byte(`{"data":{"from":"lamp","to":"kitchen/lamp","homeassistant_rename":false},"status":"ok"}`),
+	})
+
+	if got := in.stateTopicIndex["zigbee2mqtt/lamp"]; len(got) != 0 {
+		t.Fatalf("old topic still indexed: %v", got)
+	}
+	if got := in.stateTopicIndex["zigbee2mqtt/kitchen/lamp"]; len(got) != 2 {
+		t.Fatalf("new topic index = %v", got)
+	}
+
+	light, _ := getEntity(t, env, renameIEEE, "light")
+	if light.Name != "kitchen/lamp" {
+		t.Fatalf("generated name = %q, want it renamed", light.Name)
+	}
+	if s, ok := light.State.(domain.Light); !ok || !s.Power || s.Brightness != 200 {
+		t.Fatalf("state lost on rename: %#v", light.State)
+	}
+	lqi, _ = getEntity(t, env, renameIEEE, "linkquality")
+	if lqi.Name != "Lamp signal" {
+		t.Fatalf("custom name = %q, want it kept", lqi.Name)
+	}
+	if dev, ok := p.getDevice(renameIEEE); !ok || dev.Name != "kitchen/lamp" {
+		t.Fatalf("device = %+v", dev)
+	}
+
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/kitchen/lamp", payload: []byte(`{"state":"OFF","linkquality":40}`)})
+	light, _ = getEntity(t, env, renameIEEE, "light")
+	if s, ok := light.State.(domain.Light); !ok || s.Power {
+		t.Fatalf("state update on the new topic not applied: %#v", light.State)
+	}
+
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: renameIEEE, EntityID: "light"}, domain.LightTurnOn{})
+	pubs := client.publishes()
+	if len(pubs) != 1 || pubs[0].Topic != "zigbee2mqtt/kitchen/lamp/set" {
+		t.Fatalf("publishes = %+v", pubs)
+	}
+
+	select {
+	case ev := <-events:
+		if ev.From != "lamp" || ev.To != "kitchen/lamp" || len(ev.Entities) != 2 {
+			t.Fatalf("event = %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no device_renamed event")
+	}
+}
+
+func TestBridgeDevices_AppliesMissedRename(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+	discoverLamp(in)
+
+	devices := `[{"ieee_address":"` + renameIEEE + `","type":"Router","friendly_name":"porch"}]`
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/bridge/devices", payload: []byte(devices)})
+
+	info, err := in.p.getTopicInfo(domain.EntityKey{Plugin: PluginID, DeviceID: renameIEEE, ID: "light"})
+	if err != nil || info.StateTopic != "zigbee2mqtt/porch" || info.CommandTopic != "zigbee2mqtt/porch/set" {
+		t.Fatalf("topic info = %+v, %v", info, err)
+	}
+	var discovery DiscoveryPayload
+	if err := json.Unmarshal(info.Discovery, &discovery); err != nil || discovery.CommandTopic != "zigbee2mqtt/porch/set" {
+		t.Fatalf("stored discovery = %s", info.Discovery)
+	}
+}
+
+func TestDiscovery_KeysDevicesOnIEEEAddress(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+
+	// Node ID is the friendly name, as with some Z2M settings.
+	topic := "homeassistant/light/lamp/light/config"
+	payload := []byte(`{"name":"lamp","state_topic":"zigbee2mqtt/lamp","command_topic":"zigbee2mqtt/lamp/set","device":{"identifiers":["zigbee2mqtt_` + renameIEEE + `"]}}`)
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: topic, payload: payload})
+
+	if _, ok := getEntity(t, env, renameIEEE, "light"); !ok {
+		t.Fatal("entity not keyed on the IEEE address")
+	}
+	if _, ok := getEntity(t, env, "lamp", "light"); ok {
+		t.Fatal("entity keyed on the node ID")
+	}
+
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: topic, payload: nil})
+	if _, ok := getEntity(t, env, renameIEEE, "light"); ok {
+		t.Fatal("cleared config did not remove the IEEE-keyed entity")
+	}
+}
+
+func TestDiscovery_KeepsCustomName(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	_, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+	discoverLamp(in)
+
+	light, _ := getEntity(t, env, renameIEEE, "light")
+	light.Name = "Reading lamp"
+	if err := env.Storage().Save(light); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	discoverLamp(in)
+
+	light, _ = getEntity(t, env, renameIEEE, "light")
+	if light.Name != "Reading lamp" {
+		t.Fatalf("rediscovery overwrote custom name: %q", light.Name)
+	}
+}
+
+func TestDiscovery_MigratesNodeKeyedEntityToIEEE(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+
+	// Stored before the config carried a device block: keyed on the node ID.
+	topic := "homeassistant/light/lamp/light/config"
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: topic, payload: []byte(`{"name":"lamp","state_topic":"zigbee2mqtt/lamp","command_topic":"zigbee2mqtt/lamp/set"}`)})
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/lamp", payload: []byte(`{"state":"ON","brightness":200}`)})
+	light, ok := getEntity(t, env, "lamp", "light")
+	if !ok {
+		t.Fatal("node-keyed entity not stored")
+	}
+	light.Name = "Reading lamp"
+	if err := env.Storage().Save(light); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	in.handleDiscoveryMessage(nil, &fakeMessage{topic: topic, payload: []byte(`{"name":"lamp","state_topic":"zigbee2mqtt/lamp","command_topic":"zigbee2mqtt/lamp/set","device":{"name":"lamp","identifiers":["zigbee2mqtt_` + renameIEEE + `"]}}`)})
+
+	if _, ok := getEntity(t, env, "lamp", "light"); ok {
+		t.Fatal("node-keyed entity kept")
+	}
+	light, ok = getEntity(t, env, renameIEEE, "light")
+	if !ok {
+		t.Fatal("entity not moved to the IEEE key")
+	}
+	if light.Name != "Reading lamp" {
+		t.Fatalf("custom name = %q, want it kept", light.Name)
+	}
+	if s, ok := light.State.(domain.Light); !ok || !s.Power || s.Brightness != 200 {
+		t.Fatalf("state lost on migration: %#v", light.State)
+	}
+	if _, ok := p.getDevice("lamp"); ok {
+		t.Fatal("node-keyed device record kept")
+	}
+	if dev, ok := p.getDevice(renameIEEE); !ok || len(dev.Entities) != 1 || dev.Entities[0] != "light" {
+		t.Fatalf("device = %+v", dev)
+	}
+	if got := in.stateTopicIndex["zigbee2mqtt/lamp"]; len(got) != 1 || got[0].DeviceID != renameIEEE {
+		t.Fatalf("state topic index = %v", got)
+	}
+
+	// A replaced instance still resolves the node of a cleared config.
+	next := newInstance(p, in.cfg)
+	next.adopt(in)
+	if got := next.nodeDevice("lamp"); got != renameIEEE {
+		t.Fatalf("adopted node = %q", got)
+	}
+}
+
+func TestRenameGeneratedName(t *testing.T) {
+	tests := []struct {
+		name, from, to, want string
+	}{
+		{"lamp", "lamp", "kitchen/lamp", "kitchen/lamp"},
+		{"lamp Linkquality", "lamp", "desk", "desk Linkquality"},
+		{"lamp l2", "lamp", "desk", "desk l2"},
+		// Only a whole leading friendly name is generated from it.
+		{"lampshade", "lamp", "desk", "lampshade"},
+		{"Floor lamp", "lamp", "desk", "Floor lamp"},
+		{"lamp", "la", "hall", "lamp"},
+	}
+	for _, tc := range tests {
+		if got := renameGeneratedName(tc.name, tc.from, tc.to); got != tc.want {
+			t.Errorf("renameGeneratedName(%q, %q, %q) = %q, want %q", tc.name, tc.from, tc.to, got, tc.want)
+		}
+	}
+}
+
+func TestRenameDiscoveryTopics_Nested(t *testing.T) {
+	raw := json.RawMessage(`{
+		"~":"zigbee2mqtt/lamp",
+		"stat_t":"~",
+		"cmd_t":"zigbee2mqtt/lamp/set",
+		"avty":[{"t":"zigbee2mqtt/bridge/state"},{"t":"zigbee2mqtt/lamp/availability"}],
+		"availability":[{"topic":"zigbee2mqtt/lamp/availability","value_template":"{{ value_json.state }}"}],
+		"dev":{"name":"lamp","via_device":"zigbee2mqtt_bridge"}
+	}`)
+	var got struct {
+		Base         string `json:"~"`
+		StateTopic   string `json:"stat_t"`
+		CommandTopic string `json:"cmd_t"`
+		Avty         []struct {
+			Topic string `json:"t"`
+		} `json:"avty"`
+		Availability []struct {
+			Topic         string `json:"topic"`
+			ValueTemplate string `json:"value_template"`
+		} `json:"availability"`
+		Device map[string]string `json:"dev"`
+	}
+	if err := json.Unmarshal(renameDiscoveryTopics(raw, "zigbee2mqtt/lamp", "zigbee2mqtt/desk"), &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got.Base != "zigbee2mqtt/desk" || got.StateTopic != "~" || got.CommandTopic != "zigbee2mqtt/desk/set" {
+		t.Fatalf("top-level topics = %+v", got)
+	}
+	if len(got.Avty) != 2 || got.Avty[0].Topic != "zigbee2mqtt/bridge/state" || got.Avty[1].Topic != "zigbee2mqtt/desk/availability" {
+		t.Fatalf("avty = %+v", got.Avty)
+	}
+	if len(got.Availability) != 1 || got.Availability[0].Topic != "zigbee2mqtt/desk/availability" || got.Availability[0].ValueTemplate != "{{ value_json.state }}" {
+		t.Fatalf("availability = %+v", got.Availability)
+	}
+	if got.Device["name"] != "lamp" || got.Device["via_device"] != "zigbee2mqtt_bridge" {
+		t.Fatalf("device block = %+v", got.Device)
+	}
+}
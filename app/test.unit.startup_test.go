@@ -0,0 +1,101 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	domain "github.com/slidebolt/sb-domain"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+var demoLightKey = domain.EntityKey{Plugin: PluginID, DeviceID: demoDeviceID, ID: "demo_light"}
+
+func TestApplyConfig_ReturnsWithoutWaitingForBroker(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("storage")
+	p := &plugin{store: env.Storage()}
+
+	start := time.Now()
+	// Nothing listens on port 1, so paho keeps retrying in the background.
+	p.applyConfig(Config{Instances: []MQTTConfig{{Broker: "tcp://127.0.0.1:1", ClientID: "startup-test"}}})
+	defer func() {
+		for _, in := range p.runningInstances() {
+			in.disconnect()
+		}
+	}()
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("applyConfig blocked for %s", elapsed)
+	}
+	if got := bridgeConnection(t, env, "bridge"); got.Connected {
+		t.Fatalf("bridge connection = %+v, want disconnected", got)
+	}
+	if _, err := env.Storage().Get(demoLightKey); err == nil {
+		t.Fatal("demo device seeded without demo mode")
+	}
+}
+
+func TestConnect_UnreachableBrokerReportsBridgeDown(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("storage")
+	in := newInstance(&plugin{store: env.Storage()}, MQTTConfig{Broker: "tcp://127.0.0.1:1", ClientID: "cold-start-test"})
+	if err := in.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer in.disconnect()
+
+	// Down from the start, before any attempt has failed.
+	if !in.bridgeDown() {
+		t.Fatal("bridge up before the broker was ever reached")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for bridgeConnection(t, env, "bridge").LastError == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("failed connect attempts never recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := bridgeConnection(t, env, "bridge"); got.Connected || !in.bridgeDown() {
+		t.Fatalf("bridge connection = %+v, down = %v", got, in.bridgeDown())
+	}
+}
+
+func TestDemoMode_SeedsAndRemoves(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("storage")
+	p := &plugin{store: env.Storage()}
+
+	p.applyDemo(true)
+	if _, err := env.Storage().Get(demoLightKey); err != nil {
+		t.Fatalf("demo light not seeded: %v", err)
+	}
+	p.applyDemo(false)
+	if _, err := env.Storage().Get(demoLightKey); err == nil {
+		t.Fatal("demo light kept with demo mode off")
+	}
+
+	p.applyDemo(true)
+	in := newInstance(p, MQTTConfig{DiscoveryPrefix: "homeassistant", BaseTopic: "zigbee2mqtt"})
+	in.onMQTTConnect(newFakeClient())
+	if _, err := env.Storage().Get(demoLightKey); err == nil {
+		t.Fatal("demo light kept after a broker connected")
+	}
+
+	// A later demo config doesn't bring it back while connected.
+	in.mqtt = newFakeClient()
+	p.instances = []*instance{in}
+	p.applyDemo(true)
+	if _, err := env.Storage().Get(demoLightKey); err == nil {
+		t.Fatal("demo light seeded while a broker is connected")
+	}
+}
+
+func TestDecodeConfig_Demo(t *testing.T) {
+	cfg, err := decodeConfig([]byte(`{"instances":[{}],"demo":true}`), MQTTConfig{})
+	if err != nil {
+		t.Fatalf("decodeConfig: %v", err)
+	}
+	if !cfg.Demo {
+		t.Fatal("demo flag not decoded")
+	}
+}
@@ -0,0 +1,41 @@
+package app
+
+import "testing"
+
+func TestStatus_BirthOnConnectAndOfflineOnShutdown(t *testing.T) {
+	client := newFakeClient()
+	p := &plugin{}
+	in := newInstance(p, MQTTConfig{
+		DiscoveryPrefix: "homeassistant",
+		BaseTopic:       "zigbee2mqtt",
+		StatusTopic:     "slidebolt/plugin-zigbee2mqtt/status",
+	})
+	in.mqtt = client
+	p.instances = []*instance{in}
+
+	in.onMQTTConnect(client)
+	if err := p.OnShutdown(); err != nil {
+		t.Fatalf("OnShutdown: %v", err)
+	}
+
+	got := client.publishes()
+	if len(got) != 2 {
+		t.Fatalf("publishes = %+v, want birth and offline", got)
+	}
+	for i, want := range []string{statusOnline, statusOffline} {
+		if got[i].Topic != in.cfg.StatusTopic || got[i].Payload != want || !got[i].Retained {
+			t.Fatalf("publish[%d] = %+v, want retained %q on %s", i, got[i], want, in.cfg.StatusTopic)
+		}
+	}
+}
+
+func TestStatus_EmptyTopicDisablesPublishing(t *testing.T) {
+	client := newFakeClient()
+	in := newInstance(&plugin{}, MQTTConfig{BaseTopic: "zigbee2mqtt"})
+	in.mqtt = client
+
+	in.onMQTTConnect(client)
+	if got := client.publishes(); len(got) != 0 {
+		t.Fatalf("publishes = %+v, want none", got)
+	}
+}
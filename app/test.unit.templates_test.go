@@ -0,0 +1,133 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+
+	domain "github.com/slidebolt/sb-domain"
+	messenger "github.com/slidebolt/sb-messenger-sdk"
+	testkit "github.com/slidebolt/sb-testkit"
+)
+
+// discoverTemplated announces one entity of the test device with cfg, a
+// discovery config without the device block.
+func discoverTemplated(in *instance, component, objectID, cfg string) {
+	payload := cfg[:len(cfg)-1] + `,"dev":{"ids":["zigbee2mqtt_` + renameIEEE + `"]}}`
+	in.handleDiscoveryMessage(nil, &fakeMessage{
+		topic:   "homeassistant/" + component + "/" + renameIEEE + "/" + objectID + "/config",
+		payload: []byte(payload),
+	})
+}
+
+func TestTemplates_StateMessages(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, _ := newNativeTestInstance(t, env, discoveryHomeAssistant)
+
+	discoverTemplated(in, "sensor", "temperature", `{"name":"temperature","state_topic":"zigbee2mqtt/hall",
+		"value_template":"{{ value_json.temperature | round(1) }}","unit_of_measurement":"°C"}`)
+	discoverTemplated(in, "switch", "switch_l1", `{"name":"l1","state_topic":"zigbee2mqtt/hall",
+		"command_topic":"zigbee2mqtt/hall/set","value_template":"{{ value_json.state_l1 }}"}`)
+	discoverTemplated(in, "binary_sensor", "door", `{"name":"door","state_topic":"zigbee2mqtt/hall",
+		"value_template":"{{ 'open' if not value_json.contact else 'closed' }}","payload_on":"open","payload_off":"closed"}`)
+	discoverTemplated(in, "cover", "blind", `{"name":"blind","state_topic":"zigbee2mqtt/hall",
+		"position_template":"{{ 100 - value_json.position }}"}`)
+
+	in.handleStateMessage(nil, &fakeMessage{
+		topic:   "zigbee2mqtt/hall",
+		payload: []byte(`{"temperature":21.456,"state_l1":"OFF","contact":false,"position":42}`),
+	})
+
+	temp, _ := getEntity(t, env, renameIEEE, "temperature")
+	if s, ok := temp.State.(domain.Sensor); !ok || s.Value != 21.5 || s.Unit != "°C" {
+		t.Fatalf("sensor state = %#v", temp.State)
+	}
+	sw, _ := getEntity(t, env, renameIEEE, "switch_l1")
+	if s, ok := sw.State.(domain.Switch); !ok || s.Power {
+		t.Fatalf("switch state = %#v", sw.State)
+	}
+	door, _ := getEntity(t, env, renameIEEE, "door")
+	if s, ok := door.State.(domain.BinarySensor); !ok || !s.On {
+		t.Fatalf("binary sensor state = %#v", door.State)
+	}
+	blind, _ := getEntity(t, env, renameIEEE, "blind")
+	if s, ok := blind.State.(domain.Cover); !ok || s.Position != 58 {
+		t.Fatalf("cover state = %#v", blind.State)
+	}
+
+	// A result matching neither payload leaves the state alone.
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/hall", payload: []byte(`{"state_l1":"TOGGLE"}`)})
+	sw, _ = getEntity(t, env, renameIEEE, "switch_l1")
+	if s, ok := sw.State.(domain.Switch); !ok || s.Power {
+		t.Fatalf("switch state after an unknown value = %#v", sw.State)
+	}
+
+	// Templates are parsed once and dropped when the config changes.
+	key := domain.EntityKey{Plugin: pluginID, DeviceID: renameIEEE, ID: "temperature"}
+	p.templates.mu.Lock()
+	cached := len(p.templates.entries[key])
+	p.templates.mu.Unlock()
+	if cached != 1 {
+		t.Fatalf("cached templates = %d, want 1", cached)
+	}
+	discoverTemplated(in, "sensor", "temperature", `{"name":"temperature","state_topic":"zigbee2mqtt/hall",
+		"value_template":"{{ value_json.temperature | int }}"}`)
+	p.templates.mu.Lock()
+	cached = len(p.templates.entries[key])
+	p.templates.mu.Unlock()
+	if cached != 0 {
+		t.Fatalf("stale templates kept after rediscovery: %d", cached)
+	}
+}
+
+func TestTemplates_CommandTemplate(t *testing.T) {
+	env := testkit.NewTestEnv(t)
+	env.Start("messenger")
+	env.Start("storage")
+	p, in, client := newNativeTestInstance(t, env, discoveryHomeAssistant)
+
+	discoverTemplated(in, "number", "brightness_l1", `{"name":"brightness","state_topic":"zigbee2mqtt/hall",
+		"command_topic":"zigbee2mqtt/hall/set","value_template":"{{ value_json.brightness_l1 }}",
+		"command_template":"{\"brightness_l1\": {{ value | int }}}"}`)
+	discoverTemplated(in, "number", "broken", `{"name":"broken","state_topic":"zigbee2mqtt/hall",
+		"command_topic":"zigbee2mqtt/hall/set","command_template":"{{ value | nosuchfilter }}"}`)
+	discoverTemplated(in, "select", "raw", `{"name":"raw","state_topic":"zigbee2mqtt/hall",
+		"command_topic":"zigbee2mqtt/hall/set","options":["on","off"],"command_template":"{{ value | upper }}"}`)
+	discoverTemplated(in, "switch", "switch_l1", `{"name":"switch l1","state_topic":"zigbee2mqtt/hall",
+		"command_topic":"zigbee2mqtt/hall/set","payload_on":"1","payload_off":"0",
+		"command_template":"{\"state_l1\": \"{{ value }}\"}"}`)
+	discoverTemplated(in, "light", "light", `{"name":"light","state_topic":"zigbee2mqtt/hall",
+		"command_topic":"zigbee2mqtt/hall/set","command_template":"{\"state_l1\": \"{{ value }}\"}"}`)
+
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: renameIEEE, EntityID: "brightness_l1"}, domain.NumberSetValue{Value: 42.7})
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: renameIEEE, EntityID: "broken"}, domain.NumberSetValue{Value: 1})
+	// A template need not render JSON; the text is published as is.
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: renameIEEE, EntityID: "raw"}, domain.SelectOption{Option: "on"})
+	// Switches render their payload_on and payload_off, as in HA.
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: renameIEEE, EntityID: "switch_l1"}, domain.SwitchTurnOn{})
+	// Light commands carry several fields and have no single value to
+	// render, so they are published as encoded.
+	p.handleCommand(messenger.Address{Plugin: PluginID, DeviceID: renameIEEE, EntityID: "light"}, domain.LightSetBrightness{Brightness: 128})
+
+	got := client.publishes()
+	want := []string{`{"brightness_l1": 42}`, `ON`, `{"state_l1": "1"}`}
+	if len(got) != len(want)+1 {
+		t.Fatalf("publishes = %+v", got)
+	}
+	for i, w := range want {
+		if got[i].Topic != "zigbee2mqtt/hall/set" || got[i].Payload != w {
+			t.Fatalf("publish %d = %+v, want %s", i, got[i], w)
+		}
+	}
+	var light map[string]any
+	if err := json.Unmarshal([]byte(got[3].Payload), &light); err != nil || light["brightness"] != float64(128) || light["state_l1"] != nil {
+		t.Fatalf("light publish = %s, want the encoded brightness command", got[3].Payload)
+	}
+
+	in.handleStateMessage(nil, &fakeMessage{topic: "zigbee2mqtt/hall", payload: []byte(`{"brightness_l1":42}`)})
+	num, _ := getEntity(t, env, renameIEEE, "brightness_l1")
+	if s, ok := num.State.(domain.Number); !ok || s.Value != 42 {
+		t.Fatalf("number state = %#v", num.State)
+	}
+}
@@ -0,0 +1,129 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a throwaway self-signed certificate and key as PEM
+// files under dir and returns their paths.
+func writeSelfSigned(t *testing.T, dir string) (certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "broker.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return certPath, keyPath
+}
+
+func TestBuildTLSConfig_PlaintextBrokerReturnsNil(t *testing.T) {
+	got, err := buildTLSConfig(MQTTConfig{Broker: "tcp://localhost:1883"})
+	if err != nil {
+		t.Fatalf("buildTLSConfig: %v", err)
+	}
+	if got != nil {
+		t.Fatalf("tls config = %+v, want nil", got)
+	}
+}
+
+func TestBuildTLSConfig_MutualTLS(t *testing.T) {
+	certPath, keyPath := writeSelfSigned(t, t.TempDir())
+
+	got, err := buildTLSConfig(MQTTConfig{
+		Broker:     "mqtts://broker.lan:8883",
+		CACert:     certPath,
+		ClientCert: certPath,
+		ClientKey:  keyPath,
+		ServerName: "broker.test",
+	})
+	if err != nil {
+		t.Fatalf("buildTLSConfig: %v", err)
+	}
+	if got == nil {
+		t.Fatal("tls config is nil")
+	}
+	if got.RootCAs == nil {
+		t.Fatal("RootCAs not set from CA bundle")
+	}
+	if len(got.Certificates) != 1 {
+		t.Fatalf("client certificates = %d, want 1", len(got.Certificates))
+	}
+	if got.ServerName != "broker.test" || got.InsecureSkipVerify {
+		t.Fatalf("server name = %q insecure = %v", got.ServerName, got.InsecureSkipVerify)
+	}
+}
+
+func TestBuildTLSConfig_Errors(t *testing.T) {
+	certPath, _ := writeSelfSigned(t, t.TempDir())
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("write garbage: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  MQTTConfig
+	}{
+		{name: "missing CA file", cfg: MQTTConfig{Broker: "ssl://b:8883", CACert: "/nonexistent/ca.pem"}},
+		{name: "CA file without PEM blocks", cfg: MQTTConfig{Broker: "ssl://b:8883", CACert: garbage}},
+		{name: "cert without key", cfg: MQTTConfig{Broker: "ssl://b:8883", ClientCert: certPath}},
+		{name: "CA on tcp broker", cfg: MQTTConfig{Broker: "tcp://b:1883", CACert: certPath}},
+		{name: "insecure on mqtt broker", cfg: MQTTConfig{Broker: "mqtt://b:1883", InsecureSkipVerify: true}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := buildTLSConfig(tc.cfg); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestValidateForApply_RejectsTLSOnPlaintextBroker(t *testing.T) {
+	cfg, err := decodeConfig([]byte(`{"instances":[{"broker":"tcp://h:1883","ca_cert":"/etc/ssl/ca.pem"}]}`), MQTTConfig{})
+	if err != nil {
+		t.Fatalf("decodeConfig: %v", err)
+	}
+	if err := validateForApply(cfg); err == nil {
+		t.Fatal("TLS options accepted on a tcp:// broker")
+	}
+	cfg.Instances[0].Broker = "mqtts://h:8883"
+	if err := cfg.Instances[0].validateTLS(); err != nil {
+		t.Fatalf("validateTLS on mqtts://: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestBrokerURL_WebsocketPath(t *testing.T) {
+	for _, path := range []string{"/mqtt", "mqtt"} {
+		got, err := MQTTConfig{Broker: "wss://broker.lan:443", WebsocketPath: path}.brokerURL()
+		if err != nil {
+			t.Fatalf("brokerURL(%q): %v", path, err)
+		}
+		if got != "wss://broker.lan:443/mqtt" {
+			t.Fatalf("brokerURL(%q) = %q", path, got)
+		}
+	}
+}
+
+func TestValidateWebsocket_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  MQTTConfig
+	}{
+		{name: "path on tcp broker", cfg: MQTTConfig{Broker: "tcp://b:1883", WebsocketPath: "/mqtt"}},
+		{name: "headers on tcp broker", cfg: MQTTConfig{Broker: "tcp://b:1883", HTTPHeaders: map[string]string{"Authorization": "Bearer t"}}},
+		{name: "bad header name", cfg: MQTTConfig{Broker: "ws://b", HTTPHeaders: map[string]string{"X Bad": "v"}}},
+		{name: "unsupported proxy scheme", cfg: MQTTConfig{Broker: "ws://b", ProxyURL: "ftp://proxy:21"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.cfg.validateWebsocket(); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+// dialOnce attempts a single connection with the instance's options, without
+// paho's retry loop, and returns once the handshake has failed or succeeded.
+func dialOnce(t *testing.T, cfg MQTTConfig) {
+	t.Helper()
+	opts, err := newInstance(&plugin{}, cfg).clientOptions()
+	if err != nil {
+		t.Fatalf("clientOptions: %v", err)
+	}
+	opts.SetConnectRetry(false).SetAutoReconnect(false).SetConnectTimeout(2 * time.Second)
+	client := mqtt.NewClient(opts)
+	client.Connect().WaitTimeout(5 * time.Second)
+	client.Disconnect(0)
+}
+
+func TestWebsocketHandshake_SendsPathAndHeaders(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- r:
+		default:
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	dialOnce(t, MQTTConfig{
+		Broker:        "ws://" + strings.TrimPrefix(srv.URL, "http://"),
+		ClientID:      "ws-test",
+		WebsocketPath: "/mqtt",
+		HTTPHeaders:   map[string]string{"Authorization": "Bearer secret"},
+	})
+
+	select {
+	case r := <-requests:
+		if r.URL.Path != "/mqtt" {
+			t.Fatalf("path = %q, want /mqtt", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Fatalf("authorization = %q", got)
+		}
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			t.Fatalf("upgrade = %q", r.Header.Get("Upgrade"))
+		}
+	default:
+		t.Fatal("broker saw no handshake")
+	}
+}
+
+func TestWebsocketHandshake_UsesProxy(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- r:
+		default:
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer proxy.Close()
+
+	dialOnce(t, MQTTConfig{
+		Broker:   "ws://broker.invalid:8080",
+		ClientID: "ws-test",
+		ProxyURL: proxy.URL,
+	})
+
+	select {
+	case r := <-requests:
+		if r.Method != http.MethodConnect || r.Host != "broker.invalid:8080" {
+			t.Fatalf("proxy request = %s %s", r.Method, r.Host)
+		}
+	default:
+		t.Fatal("proxy saw no request")
+	}
+}
+
+func TestWebsocketHandshake_MQTT5SendsPathAndHeaders(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- r:
+		default:
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	client, err := newInstance(&plugin{}, MQTTConfig{
+		Broker:          "ws://" + strings.TrimPrefix(srv.URL, "http://"),
+		ClientID:        "ws-test",
+		ProtocolVersion: "5",
+		CleanSession:    true,
+		WebsocketPath:   "/mqtt",
+		HTTPHeaders:     map[string]string{"Authorization": "Bearer secret"},
+	}).newV5Client()
+	if err != nil {
+		t.Fatalf("newV5Client: %v", err)
+	}
+	client.Connect()
+	defer client.Disconnect(0)
+
+	select {
+	case r := <-requests:
+		if r.URL.Path != "/mqtt" {
+			t.Fatalf("path = %q, want /mqtt", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Fatalf("authorization = %q", got)
+		}
+		if got := r.Header.Get("Sec-WebSocket-Protocol"); got != "mqtt" {
+			t.Fatalf("subprotocol = %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker saw no handshake")
+	}
+}
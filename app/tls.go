@@ -0,0 +1,87 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// TLS — builds the tls.Config handed to paho for ssl://, mqtts:// and wss://
+// ---------------------------------------------------------------------------
+
+// tlsSchemes are the broker URL schemes paho dials through crypto/tls.
+var tlsSchemes = map[string]bool{
+	"ssl":      true,
+	"tls":      true,
+	"mqtts":    true,
+	"mqtt+ssl": true,
+	"tcps":     true,
+	"wss":      true,
+}
+
+// usesTLS reports whether the broker URL scheme asks for an encrypted
+// connection.
+func (c MQTTConfig) usesTLS() bool {
+	u, err := url.Parse(c.Broker)
+	return err == nil && tlsSchemes[strings.ToLower(u.Scheme)]
+}
+
+// validateTLS rejects TLS settings on a plaintext broker, where paho would
+// silently ignore them and connect unencrypted.
+func (c MQTTConfig) validateTLS() error {
+	if c.usesTLS() {
+		return nil
+	}
+	if c.CACert != "" || c.ClientCert != "" || c.ClientKey != "" || c.ServerName != "" || c.InsecureSkipVerify {
+		return fmt.Errorf("ca_cert, client_cert, client_key, server_name and insecure_skip_verify need a TLS broker (ssl://, mqtts:// or wss://)")
+	}
+	return nil
+}
+
+// buildTLSConfig assembles a tls.Config from the TLS fields of MQTTConfig.
+// Returns (nil, nil) for a plaintext broker, so paho keeps its default
+// behaviour; TLS options set on one are an error.
+func buildTLSConfig(cfg MQTTConfig) (*tls.Config, error) {
+	if err := cfg.validateTLS(); err != nil {
+		return nil, err
+	}
+	if !cfg.usesTLS() {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle %s: %w", cfg.CACert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s contains no PEM certificates", cfg.CACert)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	// Mutual TLS needs both halves of the key pair.
+	if (cfg.ClientCert == "") != (cfg.ClientKey == "") {
+		return nil, fmt.Errorf("client certificate and key must be set together")
+	}
+	if cfg.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
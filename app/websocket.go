@@ -0,0 +1,136 @@
+package app
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
+)
+
+// ---------------------------------------------------------------------------
+// WebSocket transport — ws:// and wss:// brokers behind an HTTP reverse proxy
+// ---------------------------------------------------------------------------
+
+// usesWebsocket reports whether the broker URL asks for MQTT over WebSocket.
+func (c MQTTConfig) usesWebsocket() bool {
+	u, err := url.Parse(c.Broker)
+	if err != nil {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return scheme == "ws" || scheme == "wss"
+}
+
+// brokerURL returns the broker URL handed to paho, with WebsocketPath
+// replacing the path of a ws:// or wss:// broker.
+func (c MQTTConfig) brokerURL() (string, error) {
+	if err := c.validateWebsocket(); err != nil {
+		return "", err
+	}
+	if c.WebsocketPath == "" {
+		return c.Broker, nil
+	}
+	u, err := url.Parse(c.Broker)
+	if err != nil {
+		return "", fmt.Errorf("parse broker URL: %w", err)
+	}
+	u.Path = "/" + strings.TrimPrefix(c.WebsocketPath, "/")
+	return u.String(), nil
+}
+
+// validateWebsocket rejects WebSocket-only settings on a non-WebSocket broker,
+// where paho would silently ignore them, and malformed headers or proxy URLs.
+func (c MQTTConfig) validateWebsocket() error {
+	if !c.usesWebsocket() {
+		if c.WebsocketPath != "" || len(c.HTTPHeaders) > 0 || c.ProxyURL != "" {
+			return fmt.Errorf("websocket_path, http_headers and proxy_url need a ws:// or wss:// broker")
+		}
+		return nil
+	}
+	for name := range c.HTTPHeaders {
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, " :\r\n") {
+			return fmt.Errorf("invalid HTTP header name %q", name)
+		}
+	}
+	if c.ProxyURL != "" {
+		u, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("parse proxy_url: %w", err)
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("proxy_url scheme %q not supported (http, https or socks5)", u.Scheme)
+		}
+	}
+	return nil
+}
+
+// applyWebsocketOptions sets the handshake headers and proxy of a ws:// or
+// wss:// broker. Without ProxyURL, paho falls back to HTTP(S)_PROXY.
+func applyWebsocketOptions(opts *mqtt.ClientOptions, cfg MQTTConfig) error {
+	if err := cfg.validateWebsocket(); err != nil {
+		return err
+	}
+	if !cfg.usesWebsocket() {
+		return nil
+	}
+
+	headers := make(http.Header, len(cfg.HTTPHeaders))
+	for name, value := range cfg.HTTPHeaders {
+		headers.Set(name, value)
+	}
+	opts.SetHTTPHeaders(headers)
+
+	wsOpts := &mqtt.WebsocketOptions{}
+	if cfg.ProxyURL != "" {
+		proxy, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("parse proxy_url: %w", err)
+		}
+		wsOpts.Proxy = http.ProxyURL(proxy)
+	}
+	opts.SetWebsocketOptions(wsOpts)
+	return nil
+}
+
+// websocketV5Config is applyWebsocketOptions for the MQTT 5 client: the
+// same handshake headers and proxy, with HTTP(S)_PROXY as the fallback.
+func websocketV5Config(cfg MQTTConfig) (*autopaho.WebSocketConfig, error) {
+	if err := cfg.validateWebsocket(); err != nil {
+		return nil, err
+	}
+	if !cfg.usesWebsocket() {
+		return nil, nil
+	}
+
+	headers := make(http.Header, len(cfg.HTTPHeaders))
+	for name, value := range cfg.HTTPHeaders {
+		headers.Set(name, value)
+	}
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		u, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("parse proxy_url: %w", err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	return &autopaho.WebSocketConfig{
+		Dialer: func(_ *url.URL, tlsCfg *tls.Config) *websocket.Dialer {
+			return &websocket.Dialer{
+				Proxy:            proxy,
+				TLSClientConfig:  tlsCfg,
+				HandshakeTimeout: 10 * time.Second,
+				Subprotocols:     []string{"mqtt"},
+			}
+		},
+		Header: func(*url.URL, *tls.Config) http.Header { return headers.Clone() },
+	}, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+// template_test.go — tests for the discovery template engine.
+//
+// The render table pins the Jinja behaviour discovery templates rely on;
+// the fuzz target checks that no input, template or payload, can make the
+// engine panic or run away.
+
+import (
+	"strings"
+	"testing"
+
+	template "github.com/slidebolt/plugin-zigbee2mqtt/internal/template"
+)
+
+const templatePayload = `{"state":"ON","state_l1":"OFF","color":{"x":0.3127,"y":0.329},"temperature":21.456,"position":42,"occupancy":true,"tags":["a","b"]}`
+
+func TestTemplate_RenderValue(t *testing.T) {
+	cases := []struct {
+		tmpl string
+		want string
+	}{
+		{"{{ value_json.state }}", "ON"},
+		{"{{ value_json.state_l1 }}", "OFF"},
+		{"{{ value_json.color.x }}", "0.3127"},
+		{"{{ value_json['color']['y'] }}", "0.329"},
+		{"{{ value_json.temperature | round(1) }}", "21.5"},
+		{"{{ value_json.temperature | round(0, 'floor') }}", "21.0"},
+		{"{{ value_json.temperature | int }}", "21"},
+		{"{{ value_json.position | float }}", "42.0"},
+		{"{{ 100 - value_json.position }}", "58"},
+		{"{{ value_json.position / 4 }}", "10.5"},
+		{"{{ value_json.missing | default('unknown') }}", "unknown"},
+		{"{{ value_json.missing | default }}", ""},
+		{"{{ value_json.missing | int(0) }}", "0"},
+		{"{{ value_json.occupancy }}", "True"},
+		{"{{ value_json.tags | join(',') }}", "a,b"},
+		{"{{ value_json.tags | length }}", "2"},
+		{"{{ value_json.color | tojson }}", `{"x":0.3127,"y":0.329}`},
+		{"{{ value_json.state | lower }}", "on"},
+		{"{{ value_json.state.lower() }}", "on"},
+		{"{{ 'open' if value_json.position > 0 else 'closed' }}", "open"},
+		{"{% if value_json.state == 'ON' %}1{% elif value_json.state == 'OFF' %}0{% else %}?{% endif %}", "1"},
+		{"{% if value_json.missing is defined %}yes{% else %}no{% endif %}", "no"},
+		{"{% if 'a' in value_json.tags and value_json.state_l1 != 'ON' %}ok{% endif %}", "ok"},
+		{"{% set t = value_json.temperature %}{{ (t * 9 / 5 + 32) | round(1) }}", "70.6"},
+		{"{%- for tag in value_json.tags -%}{{ tag | upper }}{{ '-' if not loop.last }}{%- endfor %}", "A-B"},
+		{"{{ value_json.occupancy | iif('detected', 'clear') }}", "detected"},
+		{"  {{ value }}  ", templatePayload},
+		{"{# ignored #}{{ value_json.position ~ '%' }}", "42%"},
+	}
+	for _, c := range cases {
+		tmpl, err := template.Parse(c.tmpl)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", c.tmpl, err)
+			continue
+		}
+		got, err := tmpl.RenderValue([]byte(templatePayload))
+		if err != nil {
+			t.Errorf("RenderValue(%q): %v", c.tmpl, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("RenderValue(%q) = %q, want %q", c.tmpl, got, c.want)
+		}
+	}
+}
+
+func TestTemplate_NonJSONPayload(t *testing.T) {
+	tmpl, err := template.Parse("{{ value_json.state | default(value) }}")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got, err := tmpl.RenderValue([]byte("online")); err != nil || got != "online" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestTemplate_RenderCommand(t *testing.T) {
+	cases := []struct {
+		tmpl  string
+		value any
+		want  string
+	}{
+		{`{"brightness": {{ value }}}`, 128, `{"brightness": 128}`},
+		{`{"speed": "{{ value | lower }}"}`, "HIGH", `{"speed": "high"}`},
+		{`{{ (value * 2.55) | round | int }}`, 100.0, "255"},
+		{`{{ {"position": value} | tojson }}`, 30, `{"position":30}`},
+	}
+	for _, c := range cases {
+		tmpl, err := template.Parse(c.tmpl)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", c.tmpl, err)
+		}
+		got, err := tmpl.RenderCommand(c.value)
+		if err != nil || got != c.want {
+			t.Errorf("RenderCommand(%q, %v) = %q, %v; want %q", c.tmpl, c.value, got, err, c.want)
+		}
+	}
+}
+
+func TestTemplate_Errors(t *testing.T) {
+	parseErrors := []string{
+		"{{ value_json.state",
+		"{% if value %}never closed",
+		"{% endif %}",
+		"{{ 1 + }}",
+		"{% unknown %}",
+		"{{ 'unterminated }}",
+		"{# comment",
+		"{{ " + strings.Repeat("(", 200) + "1" + strings.Repeat(")", 200) + " }}",
+	}
+	for _, src := range parseErrors {
+		if _, err := template.Parse(src); err == nil {
+			t.Errorf("Parse(%q) succeeded", src)
+		}
+	}
+
+	renderErrors := []string{
+		"{{ value_json.missing | int }}",
+		"{{ value_json.state | float }}",
+		"{{ 1 / 0 }}",
+		"{{ value_json.state - 1 }}",
+		"{{ value_json.state | nosuchfilter }}",
+		"{{ 'x' * 100000000 }}",
+		"{% for i in range(100000) %}{% for j in range(100000) %}{% endfor %}{% endfor %}",
+	}
+	for _, src := range renderErrors {
+		tmpl, err := template.Parse(src)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", src, err)
+			continue
+		}
+		if got, err := tmpl.RenderValue([]byte(templatePayload)); err == nil {
+			t.Errorf("RenderValue(%q) = %q, want an error", src, got)
+		}
+	}
+}
+
+func FuzzTemplate(f *testing.F) {
+	seeds := []string{
+		"{{ value_json.state }}",
+		"{{ value_json.color.x | round(2) }}",
+		"{{ value_json.temperature | float(0) * 1.8 + 32 }}",
+		"{% if value_json.state == 'ON' %}on{% elif value %}?{% else %}off{% endif %}",
+		"{%- for k, v in value_json.items() -%}{{ k }}={{ v }};{%- endfor %}",
+		"{{ value_json | tojson }}",
+		"{{ value_json.tags[1:] | join('|') }}",
+		"{{ {'a': [1, 2.5, none, true]} }}",
+		"{{ range(5) | sum }}{{ -2 ** 63 // -1 }}",
+		"{% set x = value | length %}{{ x is divisibleby 2 }}",
+	}
+	for _, s := range seeds {
+		f.Add(s, templatePayload)
+	}
+	f.Add("{{ value }}", "not json")
+	f.Fuzz(func(t *testing.T, src, payload string) {
+		tmpl, err := template.Parse(src)
+		if err != nil {
+			return
+		}
+		out, err := tmpl.RenderValue([]byte(payload))
+		if err == nil && len(out) > 1<<20 {
+			t.Fatalf("output of %d bytes", len(out))
+		}
+		// A template that parsed must parse again the same way.
+		if _, err := template.Parse(tmpl.Source()); err != nil {
+			t.Fatalf("reparse: %v", err)
+		}
+	})
+}
@@ -14,6 +14,7 @@ package main
 
 import (
 	"encoding/json"
+	"reflect"
 	"testing"
 
 	translate "github.com/slidebolt/plugin-zigbee2mqtt/internal/translate"
@@ -64,6 +65,185 @@ func TestDiscoveryPayload_UnmarshalAliases(t *testing.T) {
 	}
 }
 
+func TestDiscoveryPayload_EntityMetadata(t *testing.T) {
+	long := `{"unique_id":"0x01_battery_z2m","object_id":"hall_battery","entity_category":"diagnostic",
+		"enabled_by_default":false,"icon":"mdi:battery","json_attributes_topic":"zigbee2mqtt/hall",
+		"suggested_display_precision":1}`
+	short := `{"uniq_id":"0x01_battery_z2m","obj_id":"hall_battery","ent_cat":"diagnostic",
+		"en":false,"ic":"mdi:battery","json_attr_t":"zigbee2mqtt/hall","sug_dsp_prc":1}`
+
+	for name, raw := range map[string]string{"long": long, "short": short} {
+		var got translate.DiscoveryPayload
+		if err := json.Unmarshal([]byte(raw), &got); err != nil {
+			t.Fatalf("%s: unmarshal: %v", name, err)
+		}
+		if got.UniqueID != "0x01_battery_z2m" || got.ObjectID != "hall_battery" {
+			t.Fatalf("%s: ids: got %q, %q", name, got.UniqueID, got.ObjectID)
+		}
+		if got.EntityCategory != "diagnostic" || got.Icon != "mdi:battery" || got.JSONAttributesTopic != "zigbee2mqtt/hall" {
+			t.Fatalf("%s: got %+v", name, got)
+		}
+		if got.EnabledByDefault == nil || *got.EnabledByDefault {
+			t.Fatalf("%s: EnabledByDefault: got %v", name, got.EnabledByDefault)
+		}
+		if got.SuggestedDisplayPrecision == nil || *got.SuggestedDisplayPrecision != 1 {
+			t.Fatalf("%s: SuggestedDisplayPrecision: got %v", name, got.SuggestedDisplayPrecision)
+		}
+	}
+
+	var none translate.DiscoveryPayload
+	if err := json.Unmarshal([]byte(`{"name":"x"}`), &none); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if none.EnabledByDefault != nil || none.SuggestedDisplayPrecision != nil {
+		t.Fatal("unset metadata decoded as set")
+	}
+}
+
+func TestDiscoveryPayload_TopicBase(t *testing.T) {
+	raw := []byte(`{
+		"~":"zigbee2mqtt/lamp",
+		"stat_t":"~",
+		"cmd_t":"~/set",
+		"json_attr_t":"~",
+		"avty":[{"t":"~/availability","pl_avail":"online","pl_not_avail":"offline","val_tpl":"{{ value_json.state }}"},{"t":"bridge/~"}],
+		"avty_mode":"all",
+		"val_tpl":"{{ value_json.state }}"
+	}`)
+
+	var got translate.DiscoveryPayload
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got.StateTopic != "zigbee2mqtt/lamp" || got.CommandTopic != "zigbee2mqtt/lamp/set" || got.JSONAttributesTopic != "zigbee2mqtt/lamp" {
+		t.Fatalf("topics: %q %q %q", got.StateTopic, got.CommandTopic, got.JSONAttributesTopic)
+	}
+	if got.AvailabilityMode != "all" || len(got.Availability) != 2 {
+		t.Fatalf("availability: %+v", got.Availability)
+	}
+	avty := got.Availability[0]
+	if avty.Topic != "zigbee2mqtt/lamp/availability" || avty.ValueTemplate != "{{ value_json.state }}" {
+		t.Fatalf("availability[0]: %+v", avty)
+	}
+	if got.GetPayloadString(avty.PayloadAvailable) != "online" || got.GetPayloadString(avty.PayloadNotAvailable) != "offline" {
+		t.Fatalf("availability payloads: %s %s", avty.PayloadAvailable, avty.PayloadNotAvailable)
+	}
+	if got.Availability[1].Topic != "bridge/zigbee2mqtt/lamp" {
+		t.Fatalf("trailing ~: %q", got.Availability[1].Topic)
+	}
+	// ~ only applies to topics.
+	if got.ValueTemplate != "{{ value_json.state }}" {
+		t.Fatalf("ValueTemplate: %q", got.ValueTemplate)
+	}
+}
+
+func TestDiscoveryPayload_AbbreviationTable(t *testing.T) {
+	cases := []struct {
+		name  string
+		raw   string
+		check func(translate.DiscoveryPayload) bool
+	}{
+		{"precision", `{"precision":0.5,"temp_step":1}`, func(d translate.DiscoveryPayload) bool {
+			return d.Precision == 0.5 && d.TempStep == 1
+		}},
+		{"number range", `{"min":-10,"max":40,"step":0.5}`, func(d translate.DiscoveryPayload) bool {
+			return d.Min == -10 && d.Max == 40 && d.Step == 0.5
+		}},
+		{"text length", `{"min":2,"max":16,"ptrn":"[a-z]+","mode":"text"}`, func(d translate.DiscoveryPayload) bool {
+			return d.TextMin == 2 && d.TextMax == 16 && d.Pattern == "[a-z]+" && d.Mode == "text"
+		}},
+		{"climate", `{"mode_cmd_t":"t/mode","temp_cmd_t":"t/temp","fan_mode_cmd_t":"t/fan","pr_modes":["eco"],"temp_unit":"C"}`, func(d translate.DiscoveryPayload) bool {
+			return d.ModeCommandTopic == "t/mode" && d.TempCommandTopic == "t/temp" && d.FanCommandTopic == "t/fan" &&
+				len(d.PresetModes) == 1 && d.TemperatureUnit == "C"
+		}},
+		{"fan", `{"pct_cmd_t":"f/pct","spd_rng_min":1,"spd_rng_max":6}`, func(d translate.DiscoveryPayload) bool {
+			return d.PercentageCommandTopic == "f/pct" && d.SpeedRangeMin == 1 && d.SpeedRangeMax == 6
+		}},
+		{"light", `{"fx_list":["blink"],"min_mirs":153,"max_mirs":500}`, func(d translate.DiscoveryPayload) bool {
+			return len(d.EffectList) == 1 && d.MinMireds == 153 && d.MaxMireds == 500
+		}},
+		{"long form wins", `{"state_topic":"long","stat_t":"short"}`, func(d translate.DiscoveryPayload) bool {
+			return d.StateTopic == "long"
+		}},
+	}
+	for _, c := range cases {
+		var got translate.DiscoveryPayload
+		if err := json.Unmarshal([]byte(c.raw), &got); err != nil {
+			t.Fatalf("%s: unmarshal: %v", c.name, err)
+		}
+		if !c.check(got) {
+			t.Fatalf("%s: got %+v", c.name, got)
+		}
+	}
+}
+
+func TestDiscoveryPayload_NestedDeviceAbbreviations(t *testing.T) {
+	raw := []byte(`{"stat_t":"x","dev":{"ids":"0x01","mf":"IKEA","mdl":"TRADFRI","mdl_id":"LED1545G12","sw":"2.3","hw":"1","sa":"Hall","sn":"123","cu":"http://z2m"}}`)
+	var got translate.DiscoveryPayload
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	dev, ok := got.DeviceInfo()
+	if !ok {
+		t.Fatal("device block not decoded")
+	}
+	want := translate.DeviceInfo{
+		Manufacturer: "IKEA", Model: "TRADFRI", ModelID: "LED1545G12", SWVersion: "2.3", HWVersion: "1",
+		Identifiers: []string{"0x01"}, SuggestedArea: "Hall",
+	}
+	if !reflect.DeepEqual(dev, want) {
+		t.Fatalf("device: got %+v", dev)
+	}
+}
+
+func TestDeviceComponents(t *testing.T) {
+	raw := []byte(`{
+		"dev":{"ids":["0x01"]},
+		"stat_t":"~",
+		"~":"zigbee2mqtt/plug",
+		"qos":1,
+		"name":"not shared",
+		"cmps":{
+			"switch":{"p":"switch","cmd_t":"~/set"},
+			"power":{"platform":"sensor","state_topic":"other/plug"},
+			"old":{"p":"sensor"}
+		}
+	}`)
+	comps, err := translate.DeviceComponents(raw)
+	if err != nil {
+		t.Fatalf("DeviceComponents: %v", err)
+	}
+	if len(comps) != 3 || comps[0].ID != "old" || comps[1].ID != "power" || comps[2].ID != "switch" {
+		t.Fatalf("components: %+v", comps)
+	}
+	if !comps[0].Removed || comps[0].Platform != "sensor" {
+		t.Fatalf("old: %+v", comps[0])
+	}
+
+	var power, sw translate.DiscoveryPayload
+	if err := json.Unmarshal(comps[1].Config, &power); err != nil {
+		t.Fatalf("unmarshal power: %v", err)
+	}
+	if err := json.Unmarshal(comps[2].Config, &sw); err != nil {
+		t.Fatalf("unmarshal switch: %v", err)
+	}
+	if power.Platform != "sensor" || power.StateTopic != "other/plug" || power.Name != "" {
+		t.Fatalf("power: %+v", power)
+	}
+	if sw.StateTopic != "zigbee2mqtt/plug" || sw.CommandTopic != "zigbee2mqtt/plug/set" {
+		t.Fatalf("switch topics: %q %q", sw.StateTopic, sw.CommandTopic)
+	}
+	if dev, ok := sw.DeviceInfo(); !ok || len(dev.Identifiers) != 1 {
+		t.Fatalf("switch device: %+v", dev)
+	}
+
+	for _, bad := range []string{`{"stat_t":"x"}`, `{"cmps":{"a":{"stat_t":"x"}}}`, `{"cmps":{"a":1}}`} {
+		if _, err := translate.DeviceComponents([]byte(bad)); err == nil {
+			t.Fatalf("DeviceComponents(%s): no error", bad)
+		}
+	}
+}
+
 func TestDiscoveryPayload_DeviceName(t *testing.T) {
 	raw := []byte(`{
 		"dev": {
@@ -81,10 +261,68 @@ func TestDiscoveryPayload_DeviceName(t *testing.T) {
 	}
 }
 
+func TestDiscoveryPayload_DeviceInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{name: "long keys", raw: `{"device":{"name":"Kitchen Pendants","manufacturer":"IKEA","model":"LED1545G12","sw_version":"2.3.087","identifiers":["zigbee2mqtt_0x000b57fffec6a5b2"],"via_device":"zigbee2mqtt_bridge_0x00124b0022b3a1c5","suggested_area":"Kitchen"}}`},
+		{name: "abbreviated keys", raw: `{"dev":{"name":"Kitchen Pendants","mf":"IKEA","mdl":"LED1545G12","sw":"2.3.087","ids":"zigbee2mqtt_0x000b57fffec6a5b2","via_device":"zigbee2mqtt_bridge_0x00124b0022b3a1c5","sa":"Kitchen"}}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var payload translate.DiscoveryPayload
+			if err := json.Unmarshal([]byte(tc.raw), &payload); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			got, ok := payload.DeviceInfo()
+			if !ok {
+				t.Fatal("no device info")
+			}
+			if got.Manufacturer != "IKEA" || got.Model != "LED1545G12" || got.SWVersion != "2.3.087" || got.SuggestedArea != "Kitchen" {
+				t.Fatalf("device info = %+v", got)
+			}
+			if len(got.Identifiers) != 1 || got.Identifiers[0] != "zigbee2mqtt_0x000b57fffec6a5b2" {
+				t.Fatalf("identifiers = %v", got.Identifiers)
+			}
+			if got.ViaDevice != "zigbee2mqtt_bridge_0x00124b0022b3a1c5" {
+				t.Fatalf("via_device = %q", got.ViaDevice)
+			}
+		})
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Decode tests
 // ---------------------------------------------------------------------------
 
+func TestDecodeHealth(t *testing.T) {
+	h, ok := translate.DecodeHealth([]byte(`{"state":"ON","linkquality":300,"battery":87.5,"voltage":3000,"last_seen":1792137600000}`))
+	if !ok {
+		t.Fatal("health not decoded")
+	}
+	if *h.LinkQuality != 255 || *h.Battery != 87.5 || *h.Voltage != 3000 {
+		t.Fatalf("health: %+v", h)
+	}
+	if h.LastSeen == nil || h.LastSeen.UnixMilli() != 1792137600000 {
+		t.Fatalf("epoch last_seen: %v", h.LastSeen)
+	}
+
+	for _, ts := range []string{`"2026-10-16T08:30:00+02:00"`, `"2026-10-16T06:30:00.000Z"`} {
+		h, ok := translate.DecodeHealth([]byte(`{"last_seen":` + ts + `}`))
+		if !ok || h.LastSeen == nil || h.LastSeen.UTC().Hour() != 6 {
+			t.Fatalf("last_seen %s: %v", ts, h.LastSeen)
+		}
+	}
+
+	if _, ok := translate.DecodeHealth([]byte(`{"state":"ON"}`)); ok {
+		t.Fatal("health decoded from a message without any")
+	}
+	if _, ok := translate.DecodeHealth([]byte(`garbage`)); ok {
+		t.Fatal("health decoded from garbage")
+	}
+}
+
 func TestDecode_Light(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -4,7 +4,9 @@ go 1.26.1
 
 require (
 	github.com/cucumber/godog v0.15.1
+	github.com/eclipse/paho.golang v0.23.0
 	github.com/eclipse/paho.mqtt.golang v1.5.1
+	github.com/gorilla/websocket v1.5.3
 	github.com/slidebolt/sb-contract v1.0.6
 	github.com/slidebolt/sb-domain v1.0.12
 	github.com/slidebolt/sb-messenger-sdk v1.0.7
@@ -44,7 +46,6 @@ require (
 	github.com/gofrs/uuid v4.3.1+incompatible // indirect
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/google/go-tpm v0.9.8 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/hashicorp/go-immutable-radix v1.3.1 // indirect
 	github.com/hashicorp/go-memdb v1.3.4 // indirect
 	github.com/hashicorp/golang-lru v0.5.4 // indirect
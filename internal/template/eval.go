@@ -0,0 +1,839 @@
+package template
+
+// eval.go — evaluation of statements and expressions
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Limits that keep a hostile or broken template from running away: nodes
+// evaluated, bytes of output, and work, the bytes and elements of the
+// values filters, calls and operators process.
+const (
+	maxSteps  = 100000
+	maxOutput = 1 << 20
+	maxWork   = 1 << 24
+)
+
+var errLimit = errors.New("template: evaluation limit exceeded")
+
+type scope struct {
+	vars   map[string]any
+	parent *scope
+}
+
+func (s *scope) lookup(name string) (any, bool) {
+	for ; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+type state struct {
+	out   strings.Builder
+	steps int
+	work  int
+	// jsonContainers writes mappings and lists output by {{ }} as JSON.
+	jsonContainers bool
+}
+
+func (st *state) step() error {
+	st.steps++
+	if st.steps > maxSteps {
+		return errLimit
+	}
+	return nil
+}
+
+// charge accounts for processing vs.
+func (st *state) charge(vs ...any) error {
+	for _, v := range vs {
+		st.work += sizeOf(v, maxWork-st.work+1)
+		if st.work > maxWork {
+			return errLimit
+		}
+	}
+	return nil
+}
+
+// chargeResult charges for the value an operation produced.
+func (st *state) chargeResult(v any, err error) (any, error) {
+	if err != nil {
+		return nil, err
+	}
+	if err := st.charge(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// sizeOf counts the bytes of strings and the elements of containers in v,
+// stopping once it exceeds limit.
+func sizeOf(v any, limit int) int {
+	n := 1
+	switch x := v.(type) {
+	case string:
+		n += len(x)
+	case []any:
+		for _, e := range x {
+			if n > limit {
+				break
+			}
+			n += sizeOf(e, limit-n)
+		}
+	case map[string]any:
+		for k, e := range x {
+			if n > limit {
+				break
+			}
+			n += len(k) + sizeOf(e, limit-n)
+		}
+	}
+	return n
+}
+
+func (st *state) write(s string) error {
+	if st.out.Len()+len(s) > maxOutput {
+		return errLimit
+	}
+	st.out.WriteString(s)
+	return nil
+}
+
+// writeValue writes the result of an output expression.
+func (st *state) writeValue(v any) error {
+	if st.jsonContainers {
+		switch v.(type) {
+		case map[string]any, []any:
+			out, err := filterToJSON(v, filterArgs{})
+			if err != nil {
+				return err
+			}
+			return st.write(out.(string))
+		}
+	}
+	return st.write(toString(v))
+}
+
+func (st *state) exec(nodes []node, sc *scope) error {
+	for _, n := range nodes {
+		if err := st.step(); err != nil {
+			return err
+		}
+		switch n := n.(type) {
+		case textNode:
+			if err := st.write(n.text); err != nil {
+				return err
+			}
+		case outputNode:
+			v, err := st.eval(n.x, sc)
+			if err != nil {
+				return err
+			}
+			if err := st.charge(v); err != nil {
+				return err
+			}
+			if err := st.writeValue(v); err != nil {
+				return err
+			}
+		case setNode:
+			v, err := st.eval(n.x, sc)
+			if err != nil {
+				return err
+			}
+			sc.vars[n.name] = v
+		case ifNode:
+			if err := st.execIf(n, sc); err != nil {
+				return err
+			}
+		case forNode:
+			if err := st.execFor(n, sc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (st *state) execIf(n ifNode, sc *scope) error {
+	for _, b := range n.branches {
+		cond, err := st.eval(b.cond, sc)
+		if err != nil {
+			return err
+		}
+		if truthy(cond) {
+			return st.exec(b.body, sc)
+		}
+	}
+	return st.exec(n.orElse, sc)
+}
+
+func (st *state) execFor(n forNode, sc *scope) error {
+	iter, err := st.eval(n.iter, sc)
+	if err != nil {
+		return err
+	}
+	if err := st.charge(iter); err != nil {
+		return err
+	}
+	var items [][2]any
+	switch x := iter.(type) {
+	case []any:
+		for i, v := range x {
+			items = append(items, [2]any{int64(i), v})
+		}
+	case map[string]any:
+		for _, k := range sortedKeys(x) {
+			items = append(items, [2]any{k, x[k]})
+		}
+	case string:
+		for _, r := range x {
+			items = append(items, [2]any{nil, string(r)})
+		}
+	case Undefined, nil:
+	default:
+		return fmt.Errorf("template: %s is not iterable", typeName(iter))
+	}
+	if len(items) == 0 {
+		return st.exec(n.orElse, sc)
+	}
+	for i, item := range items {
+		if err := st.step(); err != nil {
+			return err
+		}
+		inner := &scope{vars: make(map[string]any), parent: sc}
+		switch {
+		case len(n.targets) == 2:
+			if pair, ok := item[1].([]any); ok && len(pair) == 2 {
+				inner.vars[n.targets[0]], inner.vars[n.targets[1]] = pair[0], pair[1]
+			} else if _, isMap := iter.(map[string]any); isMap {
+				inner.vars[n.targets[0]], inner.vars[n.targets[1]] = item[0], item[1]
+			} else {
+				return fmt.Errorf("template: cannot unpack %s into two loop variables", typeName(item[1]))
+			}
+		case isMapValue(iter):
+			inner.vars[n.targets[0]] = item[0]
+		default:
+			inner.vars[n.targets[0]] = item[1]
+		}
+		inner.vars["loop"] = map[string]any{
+			"index":  int64(i + 1),
+			"index0": int64(i),
+			"first":  i == 0,
+			"last":   i == len(items)-1,
+			"length": int64(len(items)),
+		}
+		if err := st.exec(n.body, inner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isMapValue(v any) bool {
+	_, ok := v.(map[string]any)
+	return ok
+}
+
+func (st *state) eval(x expr, sc *scope) (any, error) {
+	if err := st.step(); err != nil {
+		return nil, err
+	}
+	switch x := x.(type) {
+	case literal:
+		return x.v, nil
+	case nameExpr:
+		if v, ok := sc.lookup(x.name); ok {
+			return v, nil
+		}
+		return Undefined{Name: x.name}, nil
+	case attrExpr:
+		obj, err := st.eval(x.x, sc)
+		if err != nil {
+			return nil, err
+		}
+		return getAttr(obj, x.name), nil
+	case indexExpr:
+		obj, err := st.eval(x.x, sc)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := st.eval(x.index, sc)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := obj.(string); ok {
+			if err := st.charge(s); err != nil {
+				return nil, err
+			}
+		}
+		return getItem(obj, idx), nil
+	case sliceExpr:
+		return st.evalSlice(x, sc)
+	case callExpr:
+		return st.evalCall(x, sc)
+	case filterExpr:
+		return st.evalFilter(x, sc)
+	case testExpr:
+		return st.evalTest(x, sc)
+	case unaryExpr:
+		v, err := st.eval(x.x, sc)
+		if err != nil {
+			return nil, err
+		}
+		return unary(x.op, v)
+	case binaryExpr:
+		return st.evalBinary(x, sc)
+	case condExpr:
+		cond, err := st.eval(x.cond, sc)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(cond) {
+			return st.eval(x.then, sc)
+		}
+		if x.orElse == nil {
+			return Undefined{}, nil
+		}
+		return st.eval(x.orElse, sc)
+	case listExpr:
+		out := make([]any, 0, len(x.items))
+		for _, item := range x.items {
+			v, err := st.eval(item, sc)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case dictExpr:
+		out := make(map[string]any, len(x.keys))
+		for i := range x.keys {
+			k, err := st.eval(x.keys[i], sc)
+			if err != nil {
+				return nil, err
+			}
+			v, err := st.eval(x.vals[i], sc)
+			if err != nil {
+				return nil, err
+			}
+			out[toString(k)] = v
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("template: cannot evaluate %T", x)
+}
+
+// getAttr looks up an attribute, which for the value model is a dict key.
+func getAttr(obj any, name string) any {
+	if m, ok := obj.(map[string]any); ok {
+		if v, found := m[name]; found {
+			return v
+		}
+	}
+	return Undefined{Name: name}
+}
+
+func getItem(obj, idx any) any {
+	switch x := obj.(type) {
+	case map[string]any:
+		if v, found := x[toString(idx)]; found {
+			return v
+		}
+	case []any:
+		if i, ok := index(idx, len(x)); ok {
+			return x[i]
+		}
+	case string:
+		r := []rune(x)
+		if i, ok := index(idx, len(r)); ok {
+			return string(r[i])
+		}
+	}
+	return Undefined{Name: toString(idx)}
+}
+
+// index resolves a possibly negative index into a sequence of length n.
+func index(idx any, n int) (int, bool) {
+	i, ok := idx.(int64)
+	if !ok {
+		return 0, false
+	}
+	if i < 0 {
+		i += int64(n)
+	}
+	if i < 0 || i >= int64(n) {
+		return 0, false
+	}
+	return int(i), true
+}
+
+func (st *state) evalSlice(x sliceExpr, sc *scope) (any, error) {
+	obj, err := st.eval(x.x, sc)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.charge(obj); err != nil {
+		return nil, err
+	}
+	bound := func(e expr, n int, def int) (int, error) {
+		if e == nil {
+			return def, nil
+		}
+		v, err := st.eval(e, sc)
+		if err != nil {
+			return 0, err
+		}
+		if v == nil {
+			return def, nil
+		}
+		i, ok := v.(int64)
+		if !ok {
+			return 0, fmt.Errorf("template: slice index must be an integer, not %s", typeName(v))
+		}
+		if i < 0 {
+			i += int64(n)
+		}
+		return int(max(0, min(i, int64(n)))), nil
+	}
+	switch s := obj.(type) {
+	case []any:
+		lo, err := bound(x.lo, len(s), 0)
+		if err != nil {
+			return nil, err
+		}
+		hi, err := bound(x.hi, len(s), len(s))
+		if err != nil {
+			return nil, err
+		}
+		if lo >= hi {
+			return []any{}, nil
+		}
+		return append([]any(nil), s[lo:hi]...), nil
+	case string:
+		r := []rune(s)
+		lo, err := bound(x.lo, len(r), 0)
+		if err != nil {
+			return nil, err
+		}
+		hi, err := bound(x.hi, len(r), len(r))
+		if err != nil {
+			return nil, err
+		}
+		if lo >= hi {
+			return "", nil
+		}
+		return string(r[lo:hi]), nil
+	}
+	return nil, fmt.Errorf("template: %s cannot be sliced", typeName(obj))
+}
+
+func (st *state) evalArgs(args []expr, sc *scope) ([]any, error) {
+	out := make([]any, len(args))
+	for i, a := range args {
+		v, err := st.eval(a, sc)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (st *state) evalCall(x callExpr, sc *scope) (any, error) {
+	if attr, ok := x.fn.(attrExpr); ok {
+		obj, err := st.eval(attr.x, sc)
+		if err != nil {
+			return nil, err
+		}
+		args, err := st.evalArgs(x.args, sc)
+		if err != nil {
+			return nil, err
+		}
+		if err := st.charge(obj, args); err != nil {
+			return nil, err
+		}
+		return st.chargeResult(callMethod(obj, attr.name, args))
+	}
+	name, ok := x.fn.(nameExpr)
+	if !ok {
+		return nil, fmt.Errorf("template: expression is not callable")
+	}
+	if _, shadowed := sc.lookup(name.name); !shadowed {
+		if fn, found := globals[name.name]; found {
+			args, err := st.evalArgs(x.args, sc)
+			if err != nil {
+				return nil, err
+			}
+			if err := st.charge(args); err != nil {
+				return nil, err
+			}
+			return st.chargeResult(fn(args))
+		}
+	}
+	return nil, fmt.Errorf("template: %s is not callable", name.name)
+}
+
+func (st *state) evalFilter(x filterExpr, sc *scope) (any, error) {
+	f, ok := filters[x.name]
+	if !ok {
+		return nil, fmt.Errorf("template: unknown filter %q", x.name)
+	}
+	v, err := st.eval(x.x, sc)
+	if err != nil {
+		return nil, err
+	}
+	args, err := st.evalArgs(x.args, sc)
+	if err != nil {
+		return nil, err
+	}
+	var kwargs map[string]any
+	if len(x.kwargs) > 0 {
+		kwargs = make(map[string]any, len(x.kwargs))
+		for k, e := range x.kwargs {
+			if kwargs[k], err = st.eval(e, sc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := st.charge(v, args); err != nil {
+		return nil, err
+	}
+	return st.chargeResult(f(v, filterArgs{args, kwargs}))
+}
+
+func (st *state) evalTest(x testExpr, sc *scope) (any, error) {
+	t, ok := tests[x.name]
+	if !ok {
+		return nil, fmt.Errorf("template: unknown test %q", x.name)
+	}
+	v, err := st.eval(x.x, sc)
+	if err != nil {
+		return nil, err
+	}
+	args, err := st.evalArgs(x.args, sc)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.charge(v, args); err != nil {
+		return nil, err
+	}
+	result, err := t(v, args)
+	if err != nil {
+		return nil, err
+	}
+	return result != x.negate, nil
+}
+
+func (st *state) evalBinary(x binaryExpr, sc *scope) (any, error) {
+	a, err := st.eval(x.x, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "and":
+		if !truthy(a) {
+			return a, nil
+		}
+		return st.eval(x.y, sc)
+	case "or":
+		if truthy(a) {
+			return a, nil
+		}
+		return st.eval(x.y, sc)
+	}
+	b, err := st.eval(x.y, sc)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.charge(a, b); err != nil {
+		return nil, err
+	}
+	return st.chargeResult(binary(x.op, a, b))
+}
+
+func unary(op string, v any) (any, error) {
+	switch op {
+	case "not":
+		return !truthy(v), nil
+	case "-":
+		switch x := v.(type) {
+		case int64:
+			if x == math.MinInt64 {
+				return -float64(x), nil
+			}
+			return -x, nil
+		case float64:
+			return -x, nil
+		}
+	case "+":
+		if isNumber(v) {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("template: bad operand type for unary %s: %s", op, typeName(v))
+}
+
+func binary(op string, a, b any) (any, error) {
+	switch op {
+	case "==":
+		return equal(a, b), nil
+	case "!=":
+		return !equal(a, b), nil
+	case "<", "<=", ">", ">=":
+		return compare(op, a, b)
+	case "in":
+		return contains(b, a)
+	case "not in":
+		in, err := contains(b, a)
+		return !in, err
+	case "~":
+		return concatStrings(toString(a), toString(b))
+	}
+	return arith(op, a, b)
+}
+
+func concatStrings(a, b string) (any, error) {
+	if len(a)+len(b) > maxOutput {
+		return nil, errLimit
+	}
+	return a + b, nil
+}
+
+func compare(op string, a, b any) (any, error) {
+	var c int
+	an, aNum := numeric(a)
+	bn, bNum := numeric(b)
+	as, aStr := a.(string)
+	bs, bStr := b.(string)
+	switch {
+	case aNum && bNum:
+		if math.IsNaN(an) || math.IsNaN(bn) {
+			return false, nil
+		}
+		c = cmpOrdered(an, bn)
+	case aStr && bStr:
+		c = strings.Compare(as, bs)
+	default:
+		return nil, fmt.Errorf("template: %s not supported between %s and %s", op, typeName(a), typeName(b))
+	}
+	switch op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+func cmpOrdered(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func contains(container, item any) (bool, error) {
+	switch c := container.(type) {
+	case string:
+		s, ok := item.(string)
+		if !ok {
+			return false, fmt.Errorf("template: 'in <string>' requires string as left operand, not %s", typeName(item))
+		}
+		return strings.Contains(c, s), nil
+	case []any:
+		for _, e := range c {
+			if equal(e, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]any:
+		s, ok := item.(string)
+		if !ok {
+			return false, nil
+		}
+		_, found := c[s]
+		return found, nil
+	case Undefined:
+		return false, nil
+	}
+	return false, fmt.Errorf("template: argument of type %s is not iterable", typeName(container))
+}
+
+func arith(op string, a, b any) (any, error) {
+	if op == "+" {
+		switch x := a.(type) {
+		case string:
+			if y, ok := b.(string); ok {
+				return concatStrings(x, y)
+			}
+		case []any:
+			if y, ok := b.([]any); ok {
+				if len(x)+len(y) > maxSteps {
+					return nil, errLimit
+				}
+				return append(append([]any(nil), x...), y...), nil
+			}
+		}
+	}
+	if op == "*" {
+		if s, n, ok := repeatOperands(a, b); ok {
+			if n <= 0 {
+				return "", nil
+			}
+			if int64(len(s))*n > maxOutput {
+				return nil, errLimit
+			}
+			return strings.Repeat(s, int(n)), nil
+		}
+	}
+	ai, aInt := intOperand(a)
+	bi, bInt := intOperand(b)
+	if aInt && bInt {
+		return intArith(op, ai, bi)
+	}
+	af, aOK := floatOperand(a)
+	bf, bOK := floatOperand(b)
+	if !aOK || !bOK {
+		return nil, fmt.Errorf("template: unsupported operand types for %s: %s and %s", op, typeName(a), typeName(b))
+	}
+	return floatArith(op, af, bf)
+}
+
+func repeatOperands(a, b any) (string, int64, bool) {
+	if s, ok := a.(string); ok {
+		if n, ok := intOperand(b); ok {
+			return s, n, true
+		}
+	}
+	if s, ok := b.(string); ok {
+		if n, ok := intOperand(a); ok {
+			return s, n, true
+		}
+	}
+	return "", 0, false
+}
+
+// intOperand accepts ints and bools, which Python treats as 0 and 1.
+func intOperand(v any) (int64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return x, true
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func floatOperand(v any) (float64, bool) {
+	if i, ok := intOperand(v); ok {
+		return float64(i), true
+	}
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func intArith(op string, a, b int64) (any, error) {
+	switch op {
+	case "+":
+		if s := a + b; (s > a) == (b > 0) {
+			return s, nil
+		}
+	case "-":
+		if d := a - b; (d < a) == (b > 0) {
+			return d, nil
+		}
+	case "*":
+		if a == 0 || b == 0 {
+			return int64(0), nil
+		}
+		if p := a * b; p/b == a && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64) {
+			return p, nil
+		}
+	case "/":
+		return floatArith(op, float64(a), float64(b))
+	case "//":
+		if b == 0 {
+			return nil, errDivZero
+		}
+		if a == math.MinInt64 && b == -1 {
+			break
+		}
+		q := a / b
+		if (a%b != 0) && ((a < 0) != (b < 0)) {
+			q--
+		}
+		return q, nil
+	case "%":
+		if b == 0 {
+			return nil, errDivZero
+		}
+		if b == -1 {
+			return int64(0), nil
+		}
+		m := a % b
+		if m != 0 && (m < 0) != (b < 0) {
+			m += b
+		}
+		return m, nil
+	case "**":
+		if b >= 0 {
+			r := math.Pow(float64(a), float64(b))
+			if math.Abs(r) < 1<<53 {
+				return int64(r), nil
+			}
+		}
+	}
+	// Out of int64 range: Python would switch to big ints, floats are
+	// close enough here.
+	return floatArith(op, float64(a), float64(b))
+}
+
+var errDivZero = errors.New("template: division by zero")
+
+func floatArith(op string, a, b float64) (any, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, errDivZero
+		}
+		return a / b, nil
+	case "//":
+		if b == 0 {
+			return nil, errDivZero
+		}
+		return math.Floor(a / b), nil
+	case "%":
+		if b == 0 {
+			return nil, errDivZero
+		}
+		m := math.Mod(a, b)
+		if m != 0 && (m < 0) != (b < 0) {
+			m += b
+		}
+		return m, nil
+	case "**":
+		return math.Pow(a, b), nil
+	}
+	return nil, fmt.Errorf("template: unknown operator %s", op)
+}
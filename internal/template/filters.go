@@ -0,0 +1,701 @@
+package template
+
+// filters.go — filters, tests, global functions and methods
+//
+// The set covers what discovery templates use in practice: the Jinja
+// built-ins for numbers, strings and lists, plus Home Assistant's
+// float/int with defaults, iif, multiply, from_json and is_defined.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type filterArgs struct {
+	pos []any
+	kw  map[string]any
+}
+
+// arg returns the i-th positional argument or the keyword argument name.
+func (a filterArgs) arg(i int, name string) (any, bool) {
+	if i < len(a.pos) {
+		return a.pos[i], true
+	}
+	v, ok := a.kw[name]
+	return v, ok
+}
+
+type filterFunc func(v any, args filterArgs) (any, error)
+
+var filters = map[string]filterFunc{
+	"abs":        filterAbs,
+	"bool":       filterBool,
+	"capitalize": stringFilter(capitalize),
+	"count":      filterLength,
+	"d":          filterDefault,
+	"default":    filterDefault,
+	"first":      filterFirst,
+	"float":      filterFloat,
+	"from_json":  filterFromJSON,
+	"iif":        filterIif,
+	"int":        filterInt,
+	"is_defined": filterIsDefined,
+	"join":       filterJoin,
+	"last":       filterLast,
+	"length":     filterLength,
+	"list":       filterList,
+	"lower":      stringFilter(strings.ToLower),
+	"max":        extremeFilter(1),
+	"min":        extremeFilter(-1),
+	"multiply":   filterMultiply,
+	"replace":    filterReplace,
+	"round":      filterRound,
+	"sort":       filterSort,
+	"string":     func(v any, _ filterArgs) (any, error) { return toString(v), nil },
+	"sum":        filterSum,
+	"title":      stringFilter(title),
+	"to_json":    filterToJSON,
+	"tojson":     filterToJSON,
+	"trim":       stringFilter(strings.TrimSpace),
+	"upper":      stringFilter(strings.ToUpper),
+}
+
+func stringFilter(fn func(string) string) filterFunc {
+	return func(v any, _ filterArgs) (any, error) { return fn(toString(v)), nil }
+}
+
+func capitalize(s string) string {
+	r := []rune(strings.ToLower(s))
+	if len(r) > 0 {
+		r[0] = unicode.ToUpper(r[0])
+	}
+	return string(r)
+}
+
+func title(s string) string {
+	r := []rune(s)
+	start := true
+	for i, c := range r {
+		if unicode.IsLetter(c) {
+			if start {
+				r[i] = unicode.ToUpper(c)
+			} else {
+				r[i] = unicode.ToLower(c)
+			}
+			start = false
+		} else {
+			start = true
+		}
+	}
+	return string(r)
+}
+
+func filterAbs(v any, _ filterArgs) (any, error) {
+	switch x := v.(type) {
+	case int64:
+		if x < 0 {
+			return unary("-", x)
+		}
+		return x, nil
+	case float64:
+		return math.Abs(x), nil
+	}
+	return nil, fmt.Errorf("template: bad operand type for abs: %s", typeName(v))
+}
+
+func filterBool(v any, args filterArgs) (any, error) {
+	if b, ok := toBool(v); ok {
+		return b, nil
+	}
+	if def, ok := args.arg(0, "default"); ok {
+		return def, nil
+	}
+	return nil, fmt.Errorf("template: cannot convert %q to bool", toString(v))
+}
+
+// toBool converts the values Home Assistant accepts as booleans.
+func toBool(v any) (bool, bool) {
+	switch x := v.(type) {
+	case bool:
+		return x, true
+	case int64:
+		return x != 0, true
+	case float64:
+		return x != 0, true
+	case string:
+		switch strings.ToLower(strings.TrimSpace(x)) {
+		case "true", "yes", "on", "enable", "1":
+			return true, true
+		case "false", "no", "off", "disable", "0":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+func filterDefault(v any, args filterArgs) (any, error) {
+	def, _ := args.arg(0, "default_value")
+	if def == nil {
+		def = ""
+	}
+	boolean, _ := args.arg(1, "boolean")
+	if _, undefined := v.(Undefined); undefined {
+		return def, nil
+	}
+	if truthy(boolean) && !truthy(v) {
+		return def, nil
+	}
+	return v, nil
+}
+
+func filterFirst(v any, _ filterArgs) (any, error) {
+	switch x := v.(type) {
+	case []any:
+		if len(x) > 0 {
+			return x[0], nil
+		}
+	case string:
+		for _, r := range x {
+			return string(r), nil
+		}
+	}
+	return Undefined{Name: "first"}, nil
+}
+
+func filterLast(v any, _ filterArgs) (any, error) {
+	switch x := v.(type) {
+	case []any:
+		if len(x) > 0 {
+			return x[len(x)-1], nil
+		}
+	case string:
+		if r := []rune(x); len(r) > 0 {
+			return string(r[len(r)-1]), nil
+		}
+	}
+	return Undefined{Name: "last"}, nil
+}
+
+// filterFloat converts to a float. Without a default, a value that is not
+// numeric is an error, as in Home Assistant.
+func filterFloat(v any, args filterArgs) (any, error) {
+	if f, ok := toFloat(v); ok {
+		return f, nil
+	}
+	if def, ok := args.arg(0, "default"); ok {
+		return def, nil
+	}
+	return nil, fmt.Errorf("template: cannot convert %q to float", toString(v))
+}
+
+// filterInt converts to an integer, truncating floats and numeric strings.
+func filterInt(v any, args filterArgs) (any, error) {
+	if i, ok := toInt(v); ok {
+		return i, nil
+	}
+	if def, ok := args.arg(0, "default"); ok {
+		return def, nil
+	}
+	return nil, fmt.Errorf("template: cannot convert %q to int", toString(v))
+}
+
+func filterFromJSON(v any, _ filterArgs) (any, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("template: from_json expects a string, not %s", typeName(v))
+	}
+	out := decodeJSON([]byte(s))
+	if _, bad := out.(Undefined); bad {
+		return nil, fmt.Errorf("template: from_json: invalid JSON")
+	}
+	return out, nil
+}
+
+// filterIif is Home Assistant's inline if: value | iif(if_true, if_false,
+// if_none).
+func filterIif(v any, args filterArgs) (any, error) {
+	ifTrue, ok := args.arg(0, "if_true")
+	if !ok {
+		ifTrue = true
+	}
+	ifFalse, ok := args.arg(1, "if_false")
+	if !ok {
+		ifFalse = false
+	}
+	if ifNone, ok := args.arg(2, "if_none"); ok && (v == nil || isUndefined(v)) {
+		return ifNone, nil
+	}
+	if truthy(v) {
+		return ifTrue, nil
+	}
+	return ifFalse, nil
+}
+
+func isUndefined(v any) bool {
+	_, ok := v.(Undefined)
+	return ok
+}
+
+func filterIsDefined(v any, _ filterArgs) (any, error) {
+	if u, ok := v.(Undefined); ok {
+		return nil, fmt.Errorf("template: %q is undefined", u.Name)
+	}
+	return v, nil
+}
+
+func filterJoin(v any, args filterArgs) (any, error) {
+	sep := ""
+	if s, ok := args.arg(0, "d"); ok {
+		sep = toString(s)
+	}
+	items, err := iterate(v)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]string, len(items))
+	size := 0
+	for i, item := range items {
+		parts[i] = toString(item)
+		size += len(parts[i]) + len(sep)
+	}
+	if size > maxOutput {
+		return nil, errLimit
+	}
+	return strings.Join(parts, sep), nil
+}
+
+func filterLength(v any, _ filterArgs) (any, error) {
+	switch x := v.(type) {
+	case string:
+		return int64(len([]rune(x))), nil
+	case []any:
+		return int64(len(x)), nil
+	case map[string]any:
+		return int64(len(x)), nil
+	case Undefined:
+		return int64(0), nil
+	}
+	return nil, fmt.Errorf("template: object of type %s has no length", typeName(v))
+}
+
+func filterList(v any, _ filterArgs) (any, error) {
+	items, err := iterate(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]any{}, items...), nil
+}
+
+// iterate returns the items a for loop would visit: list elements, dict
+// keys or string characters.
+func iterate(v any) ([]any, error) {
+	switch x := v.(type) {
+	case []any:
+		return x, nil
+	case map[string]any:
+		keys := sortedKeys(x)
+		out := make([]any, len(keys))
+		for i, k := range keys {
+			out[i] = k
+		}
+		return out, nil
+	case string:
+		var out []any
+		for _, r := range x {
+			out = append(out, string(r))
+		}
+		return out, nil
+	case Undefined:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("template: %s is not iterable", typeName(v))
+}
+
+// extremeFilter returns min (sign -1) or max (sign 1) of a list.
+func extremeFilter(sign int) filterFunc {
+	return func(v any, _ filterArgs) (any, error) {
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+		return extreme(sign, items)
+	}
+}
+
+func extreme(sign int, items []any) (any, error) {
+	if len(items) == 0 {
+		return Undefined{Name: "min/max of an empty sequence"}, nil
+	}
+	best := items[0]
+	for _, item := range items[1:] {
+		greater, err := compare(">", item, best)
+		if err != nil {
+			return nil, err
+		}
+		if greater.(bool) == (sign > 0) && !equal(item, best) {
+			best = item
+		}
+	}
+	return best, nil
+}
+
+// filterMultiply is Home Assistant's multiply(factor).
+func filterMultiply(v any, args filterArgs) (any, error) {
+	factor, ok := args.arg(0, "ratio")
+	if !ok {
+		return nil, fmt.Errorf("template: multiply needs a factor")
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		if def, ok := args.arg(1, "default"); ok {
+			return def, nil
+		}
+		return nil, fmt.Errorf("template: cannot multiply %q", toString(v))
+	}
+	return arith("*", f, factor)
+}
+
+func filterReplace(v any, args filterArgs) (any, error) {
+	old, ok1 := args.arg(0, "old")
+	repl, ok2 := args.arg(1, "new")
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("template: replace needs old and new")
+	}
+	s, o, r := toString(v), toString(old), toString(repl)
+	n := -1
+	if c, ok := args.arg(2, "count"); ok {
+		if i, ok := c.(int64); ok {
+			n = int(min(i, int64(len(s)+1)))
+		}
+	}
+	if len(s)+strings.Count(s, o)*len(r) > maxOutput {
+		return nil, errLimit
+	}
+	return strings.Replace(s, o, r, n), nil
+}
+
+// filterRound rounds to precision digits with method common (half to
+// even, like Python's round), ceil, floor or half (half away from zero).
+func filterRound(v any, args filterArgs) (any, error) {
+	f, ok := toFloat(v)
+	if !ok {
+		if def, ok := args.arg(2, "default"); ok {
+			return def, nil
+		}
+		return nil, fmt.Errorf("template: cannot round %q", toString(v))
+	}
+	precision := int64(0)
+	if p, ok := args.arg(0, "precision"); ok {
+		if precision, ok = toInt(p); !ok {
+			return nil, fmt.Errorf("template: round precision must be an integer")
+		}
+	}
+	precision = max(-15, min(precision, 15))
+	method := "common"
+	if m, ok := args.arg(1, "method"); ok {
+		method = toString(m)
+	}
+	scale := math.Pow(10, float64(precision))
+	x := f * scale
+	switch method {
+	case "common":
+		x = math.RoundToEven(x)
+	case "ceil":
+		x = math.Ceil(x)
+	case "floor":
+		x = math.Floor(x)
+	case "half":
+		x = math.Round(x)
+	default:
+		return nil, fmt.Errorf("template: unknown round method %q", method)
+	}
+	return x / scale, nil
+}
+
+func filterSort(v any, args filterArgs) (any, error) {
+	items, err := iterate(v)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]any(nil), items...)
+	reverse, _ := args.arg(0, "reverse")
+	var cmpErr error
+	sort.SliceStable(out, func(i, j int) bool {
+		less, err := compare("<", out[i], out[j])
+		if err != nil {
+			cmpErr = err
+			return false
+		}
+		if truthy(reverse) {
+			greater, _ := compare(">", out[i], out[j])
+			return greater.(bool)
+		}
+		return less.(bool)
+	})
+	return out, cmpErr
+}
+
+func filterSum(v any, _ filterArgs) (any, error) {
+	items, err := iterate(v)
+	if err != nil {
+		return nil, err
+	}
+	var total any = int64(0)
+	for _, item := range items {
+		if total, err = arith("+", total, item); err != nil {
+			return nil, err
+		}
+	}
+	return total, nil
+}
+
+func filterToJSON(v any, _ filterArgs) (any, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(jsonValue(v)); err != nil {
+		return nil, fmt.Errorf("template: tojson: %w", err)
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// jsonValue prepares v for encoding/json: Undefined becomes null and
+// non-finite floats, which JSON cannot carry, become null as well.
+func jsonValue(v any) any {
+	switch x := v.(type) {
+	case Undefined:
+		return nil
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return nil
+		}
+	case []any:
+		out := make([]any, len(x))
+		for i, e := range x {
+			out[i] = jsonValue(e)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(x))
+		for k, e := range x {
+			out[k] = jsonValue(e)
+		}
+		return out
+	}
+	return v
+}
+
+// ---------------------------------------------------------------------------
+// Tests
+// ---------------------------------------------------------------------------
+
+type testFunc func(v any, args []any) (bool, error)
+
+var tests = map[string]testFunc{
+	"defined":   func(v any, _ []any) (bool, error) { return !isUndefined(v), nil },
+	"undefined": func(v any, _ []any) (bool, error) { return isUndefined(v), nil },
+	"none":      func(v any, _ []any) (bool, error) { return v == nil, nil },
+	"number":    func(v any, _ []any) (bool, error) { return isNumber(v), nil },
+	"string":    func(v any, _ []any) (bool, error) { _, ok := v.(string); return ok, nil },
+	"boolean":   func(v any, _ []any) (bool, error) { _, ok := v.(bool); return ok, nil },
+	"mapping":   func(v any, _ []any) (bool, error) { return isMapValue(v), nil },
+	"iterable": func(v any, _ []any) (bool, error) {
+		switch v.(type) {
+		case []any, map[string]any, string:
+			return true, nil
+		}
+		return false, nil
+	},
+	"sequence": func(v any, _ []any) (bool, error) {
+		switch v.(type) {
+		case []any, map[string]any, string:
+			return true, nil
+		}
+		return false, nil
+	},
+	"true":  func(v any, _ []any) (bool, error) { return v == true, nil },
+	"false": func(v any, _ []any) (bool, error) { return v == false, nil },
+	"odd": func(v any, _ []any) (bool, error) {
+		i, ok := v.(int64)
+		return ok && i%2 != 0, nil
+	},
+	"even": func(v any, _ []any) (bool, error) {
+		i, ok := v.(int64)
+		return ok && i%2 == 0, nil
+	},
+	"divisibleby": func(v any, args []any) (bool, error) {
+		if len(args) != 1 {
+			return false, fmt.Errorf("template: divisibleby needs one argument")
+		}
+		m, err := arith("%", v, args[0])
+		if err != nil {
+			return false, err
+		}
+		return equal(m, int64(0)), nil
+	},
+	"eq": func(v any, args []any) (bool, error) {
+		if len(args) != 1 {
+			return false, fmt.Errorf("template: eq needs one argument")
+		}
+		return equal(v, args[0]), nil
+	},
+	"in": func(v any, args []any) (bool, error) {
+		if len(args) != 1 {
+			return false, fmt.Errorf("template: in needs one argument")
+		}
+		return contains(args[0], v)
+	},
+}
+
+// ---------------------------------------------------------------------------
+// Global functions and methods
+// ---------------------------------------------------------------------------
+
+type globalFunc func(args []any) (any, error)
+
+var globals = map[string]globalFunc{
+	"float": func(args []any) (any, error) { return callAsFilter(filterFloat, args) },
+	"int":   func(args []any) (any, error) { return callAsFilter(filterInt, args) },
+	"bool":  func(args []any) (any, error) { return callAsFilter(filterBool, args) },
+	"iif":   func(args []any) (any, error) { return callAsFilter(filterIif, args) },
+	"min":   func(args []any) (any, error) { return extremeOf(-1, args) },
+	"max":   func(args []any) (any, error) { return extremeOf(1, args) },
+	"range": rangeOf,
+}
+
+func callAsFilter(f filterFunc, args []any) (any, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("template: missing argument")
+	}
+	return f(args[0], filterArgs{pos: args[1:]})
+}
+
+// extremeOf implements min and max called with one sequence or several
+// values.
+func extremeOf(sign int, args []any) (any, error) {
+	if len(args) == 1 {
+		items, err := iterate(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return extreme(sign, items)
+	}
+	return extreme(sign, args)
+}
+
+func rangeOf(args []any) (any, error) {
+	var bounds [3]int64
+	bounds[2] = 1
+	ints := make([]int64, len(args))
+	for i, a := range args {
+		n, ok := a.(int64)
+		if !ok {
+			return nil, fmt.Errorf("template: range arguments must be integers")
+		}
+		ints[i] = n
+	}
+	switch len(ints) {
+	case 1:
+		bounds[1] = ints[0]
+	case 2, 3:
+		copy(bounds[:], ints)
+	default:
+		return nil, fmt.Errorf("template: range takes 1 to 3 arguments")
+	}
+	start, stop, step := bounds[0], bounds[1], bounds[2]
+	if step == 0 {
+		return nil, fmt.Errorf("template: range step must not be zero")
+	}
+	var out []any
+	for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+		if len(out) >= maxSteps {
+			return nil, errLimit
+		}
+		out = append(out, i)
+		if (step > 0 && i > math.MaxInt64-step) || (step < 0 && i < math.MinInt64-step) {
+			break
+		}
+	}
+	return append([]any{}, out...), nil
+}
+
+// callMethod implements the string and dict methods templates call.
+func callMethod(obj any, name string, args []any) (any, error) {
+	switch x := obj.(type) {
+	case string:
+		switch name {
+		case "lower":
+			return strings.ToLower(x), nil
+		case "upper":
+			return strings.ToUpper(x), nil
+		case "strip":
+			return strings.TrimSpace(x), nil
+		case "lstrip":
+			return strings.TrimLeft(x, whitespace), nil
+		case "rstrip":
+			return strings.TrimRight(x, whitespace), nil
+		case "title":
+			return title(x), nil
+		case "capitalize":
+			return capitalize(x), nil
+		case "startswith", "endswith":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("template: %s needs one argument", name)
+			}
+			if name == "startswith" {
+				return strings.HasPrefix(x, toString(args[0])), nil
+			}
+			return strings.HasSuffix(x, toString(args[0])), nil
+		case "split":
+			var parts []string
+			if len(args) == 0 || args[0] == nil {
+				parts = strings.Fields(x)
+			} else if sep := toString(args[0]); sep != "" {
+				parts = strings.Split(x, sep)
+			} else {
+				return nil, fmt.Errorf("template: empty separator")
+			}
+			out := make([]any, len(parts))
+			for i, p := range parts {
+				out[i] = p
+			}
+			return out, nil
+		case "replace":
+			return filterReplace(x, filterArgs{pos: args})
+		}
+	case map[string]any:
+		switch name {
+		case "get":
+			if len(args) == 0 {
+				return nil, fmt.Errorf("template: get needs a key")
+			}
+			if v, found := x[toString(args[0])]; found {
+				return v, nil
+			}
+			if len(args) > 1 {
+				return args[1], nil
+			}
+			return nil, nil
+		case "keys", "values", "items":
+			keys := sortedKeys(x)
+			out := make([]any, len(keys))
+			for i, k := range keys {
+				switch name {
+				case "keys":
+					out[i] = k
+				case "values":
+					out[i] = x[k]
+				default:
+					out[i] = []any{k, x[k]}
+				}
+			}
+			return out, nil
+		}
+	}
+	return nil, fmt.Errorf("template: %s has no method %s", typeName(obj), name)
+}
@@ -0,0 +1,263 @@
+package template
+
+// lex.go — tokenizer
+//
+// The source is split into text and the tokens of {{ expression }} and
+// {% statement %} tags; {# comments #} are dropped. A dash inside a
+// delimiter ({{- or -%}) trims the whitespace next to the tag.
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokText tokenKind = iota
+	tokExprOpen
+	tokExprClose
+	tokStmtOpen
+	tokStmtClose
+	tokName
+	tokInt
+	tokFloat
+	tokString
+	tokOp
+	tokEOF
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+	pos  int
+}
+
+const whitespace = " \t\r\n"
+
+// operators are tried in order, so two-character operators come first.
+var operators = []string{
+	"**", "//", "==", "!=", "<=", ">=",
+	"(", ")", "[", "]", "{", "}", ".", ",", ":", "|", "~",
+	"+", "-", "*", "/", "%", "<", ">", "=",
+}
+
+type lexer struct {
+	src      string
+	pos      int
+	toks     []token
+	trimNext bool
+}
+
+func lex(src string) ([]token, error) {
+	l := &lexer{src: src}
+	for l.pos < len(src) {
+		start := l.pos
+		tag := nextTag(src, start)
+		end := tag
+		if tag < 0 {
+			end = len(src)
+		}
+		text := src[start:end]
+		if l.trimNext {
+			text = strings.TrimLeft(text, whitespace)
+			l.trimNext = false
+		}
+		if tag >= 0 && tag+2 < len(src) && src[tag+2] == '-' {
+			text = strings.TrimRight(text, whitespace)
+		}
+		if text != "" {
+			l.emit(tokText, text, start)
+		}
+		if tag < 0 {
+			break
+		}
+
+		l.pos = tag + 2
+		if l.pos < len(src) && src[l.pos] == '-' {
+			l.pos++
+		}
+		var err error
+		switch src[tag+1] {
+		case '#':
+			err = l.comment(tag)
+		case '{':
+			l.emit(tokExprOpen, "{{", tag)
+			err = l.inside("}}", tokExprClose)
+		case '%':
+			l.emit(tokStmtOpen, "{%", tag)
+			err = l.inside("%}", tokStmtClose)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.emit(tokEOF, "", len(src))
+	return l.toks, nil
+}
+
+// nextTag returns the offset of the next tag opening at or after from, or -1.
+func nextTag(src string, from int) int {
+	for i := from; i+1 < len(src); i++ {
+		if src[i] == '{' {
+			switch src[i+1] {
+			case '{', '%', '#':
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func (l *lexer) emit(kind tokenKind, val string, pos int) {
+	l.toks = append(l.toks, token{kind: kind, val: val, pos: pos})
+}
+
+func (l *lexer) comment(open int) error {
+	end := strings.Index(l.src[l.pos:], "#}")
+	if end < 0 {
+		return fmt.Errorf("template: unclosed comment at %d", open)
+	}
+	end += l.pos
+	if end > l.pos && l.src[end-1] == '-' {
+		l.trimNext = true
+	}
+	l.pos = end + 2
+	return nil
+}
+
+// inside tokenizes the contents of a tag up to its closer. Brackets are
+// balanced, so a dict literal's "}}" does not end an expression tag.
+func (l *lexer) inside(closer string, closeKind tokenKind) error {
+	depth := 0
+	for {
+		for l.pos < len(l.src) && strings.IndexByte(whitespace, l.src[l.pos]) >= 0 {
+			l.pos++
+		}
+		if l.pos >= len(l.src) {
+			return fmt.Errorf("template: unclosed tag, expected %q", closer)
+		}
+		rest := l.src[l.pos:]
+		if depth == 0 {
+			if strings.HasPrefix(rest, "-"+closer) {
+				l.trimNext = true
+				l.emit(closeKind, closer, l.pos)
+				l.pos += 3
+				return nil
+			}
+			if strings.HasPrefix(rest, closer) {
+				l.emit(closeKind, closer, l.pos)
+				l.pos += 2
+				return nil
+			}
+		}
+
+		c := l.src[l.pos]
+		switch {
+		case isNameStart(c):
+			start := l.pos
+			for l.pos < len(l.src) && isNameChar(l.src[l.pos]) {
+				l.pos++
+			}
+			l.emit(tokName, l.src[start:l.pos], start)
+		case isDigit(c):
+			l.number()
+		case c == '\'' || c == '"':
+			if err := l.string(c); err != nil {
+				return err
+			}
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(rest, o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return fmt.Errorf("template: unexpected character %q at %d", c, l.pos)
+			}
+			switch op {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				if depth > 0 {
+					depth--
+				}
+			}
+			l.emit(tokOp, op, l.pos)
+			l.pos += len(op)
+		}
+	}
+}
+
+func (l *lexer) number() {
+	start := l.pos
+	kind := tokInt
+	l.digits()
+	if l.pos+1 < len(l.src) && l.src[l.pos] == '.' && isDigit(l.src[l.pos+1]) {
+		kind = tokFloat
+		l.pos++
+		l.digits()
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		exp := l.pos + 1
+		if exp < len(l.src) && (l.src[exp] == '+' || l.src[exp] == '-') {
+			exp++
+		}
+		if exp < len(l.src) && isDigit(l.src[exp]) {
+			kind = tokFloat
+			l.pos = exp
+			l.digits()
+		}
+	}
+	l.emit(kind, strings.ReplaceAll(l.src[start:l.pos], "_", ""), start)
+}
+
+func (l *lexer) digits() {
+	for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || l.src[l.pos] == '_') {
+		l.pos++
+	}
+}
+
+func (l *lexer) string(quote byte) error {
+	start := l.pos
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == quote:
+			l.pos++
+			l.emit(tokString, b.String(), start)
+			return nil
+		case c == '\\' && l.pos+1 < len(l.src):
+			l.pos++
+			switch e := l.src[l.pos]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '\'', '"':
+				b.WriteByte(e)
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+		l.pos++
+	}
+	return fmt.Errorf("template: unterminated string at %d", start)
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isNameChar(c byte) bool { return isNameStart(c) || isDigit(c) }
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
@@ -0,0 +1,769 @@
+package template
+
+// parse.go — recursive-descent parser
+//
+// Statements: if/elif/else/endif, for/else/endfor and set. Expression
+// precedence follows Jinja, loosest first: conditional expressions, or,
+// and, not, comparisons (including in and is), ~, + and -, * / // and %,
+// **, unary signs, then postfix attribute, item, call, filter and test.
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// maxDepth bounds the nesting of statements and expressions.
+const maxDepth = 64
+
+type node interface{}
+
+type textNode struct{ text string }
+
+type outputNode struct{ x expr }
+
+type ifBranch struct {
+	cond expr
+	body []node
+}
+
+type ifNode struct {
+	branches []ifBranch
+	orElse   []node
+}
+
+type forNode struct {
+	targets []string
+	iter    expr
+	body    []node
+	orElse  []node
+}
+
+type setNode struct {
+	name string
+	x    expr
+}
+
+type expr interface{}
+
+type literal struct{ v any }
+
+type nameExpr struct{ name string }
+
+type attrExpr struct {
+	x    expr
+	name string
+}
+
+type indexExpr struct{ x, index expr }
+
+type sliceExpr struct{ x, lo, hi expr }
+
+type callExpr struct {
+	fn   expr
+	args []expr
+}
+
+type filterExpr struct {
+	x      expr
+	name   string
+	args   []expr
+	kwargs map[string]expr
+}
+
+type testExpr struct {
+	x      expr
+	name   string
+	args   []expr
+	negate bool
+}
+
+type unaryExpr struct {
+	op string
+	x  expr
+}
+
+type binaryExpr struct {
+	op   string
+	x, y expr
+}
+
+type condExpr struct{ cond, then, orElse expr }
+
+type listExpr struct{ items []expr }
+
+type dictExpr struct{ keys, vals []expr }
+
+type parser struct {
+	toks  []token
+	pos   int
+	depth int
+}
+
+func parse(toks []token) ([]node, error) {
+	p := &parser{toks: toks}
+	body, end, err := p.body()
+	if err != nil {
+		return nil, err
+	}
+	if end != "" {
+		return nil, p.errorf("unexpected %q", end)
+	}
+	return body, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("template: %s at %d", fmt.Sprintf(format, args...), p.peek().pos)
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.val == op
+}
+
+func (p *parser) isName(name string) bool {
+	t := p.peek()
+	return t.kind == tokName && t.val == name
+}
+
+func (p *parser) accept(op string) bool {
+	if p.isOp(op) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) acceptName(name string) bool {
+	if p.isName(name) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		return p.errorf("expected %q", op)
+	}
+	return nil
+}
+
+func (p *parser) expectKind(kind tokenKind, what string) (token, error) {
+	if p.peek().kind != kind {
+		return token{}, p.errorf("expected %s", what)
+	}
+	return p.next(), nil
+}
+
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxDepth {
+		return p.errorf("nested too deeply")
+	}
+	return nil
+}
+
+func (p *parser) leave() { p.depth-- }
+
+// body parses nodes up to EOF or a statement that closes a block, whose
+// keyword it returns with the parser positioned after it.
+func (p *parser) body() ([]node, string, error) {
+	if err := p.enter(); err != nil {
+		return nil, "", err
+	}
+	defer p.leave()
+	var nodes []node
+	for {
+		t := p.next()
+		switch t.kind {
+		case tokEOF:
+			return nodes, "", nil
+		case tokText:
+			nodes = append(nodes, textNode{t.val})
+		case tokExprOpen:
+			x, err := p.expr()
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err := p.expectKind(tokExprClose, `"}}"`); err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, outputNode{x})
+		case tokStmtOpen:
+			kw, err := p.expectKind(tokName, "statement")
+			if err != nil {
+				return nil, "", err
+			}
+			switch kw.val {
+			case "if":
+				n, err := p.ifStmt()
+				if err != nil {
+					return nil, "", err
+				}
+				nodes = append(nodes, n)
+			case "for":
+				n, err := p.forStmt()
+				if err != nil {
+					return nil, "", err
+				}
+				nodes = append(nodes, n)
+			case "set":
+				n, err := p.setStmt()
+				if err != nil {
+					return nil, "", err
+				}
+				nodes = append(nodes, n)
+			case "elif", "else", "endif", "endfor":
+				return nodes, kw.val, nil
+			default:
+				return nil, "", fmt.Errorf("template: unknown statement %q at %d", kw.val, kw.pos)
+			}
+		default:
+			return nil, "", p.errorf("unexpected token %q", t.val)
+		}
+	}
+}
+
+func (p *parser) closeStmt() error {
+	_, err := p.expectKind(tokStmtClose, `"%}"`)
+	return err
+}
+
+func (p *parser) ifStmt() (node, error) {
+	var n ifNode
+	for {
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.closeStmt(); err != nil {
+			return nil, err
+		}
+		body, end, err := p.body()
+		if err != nil {
+			return nil, err
+		}
+		n.branches = append(n.branches, ifBranch{cond, body})
+		switch end {
+		case "elif":
+			continue
+		case "else":
+			if err := p.closeStmt(); err != nil {
+				return nil, err
+			}
+			n.orElse, end, err = p.body()
+			if err != nil {
+				return nil, err
+			}
+			if end != "endif" {
+				return nil, p.errorf("expected endif")
+			}
+			return n, p.closeStmt()
+		case "endif":
+			return n, p.closeStmt()
+		default:
+			return nil, p.errorf("expected endif")
+		}
+	}
+}
+
+func (p *parser) forStmt() (node, error) {
+	var n forNode
+	for {
+		t, err := p.expectKind(tokName, "loop variable")
+		if err != nil {
+			return nil, err
+		}
+		n.targets = append(n.targets, t.val)
+		if !p.accept(",") {
+			break
+		}
+	}
+	if len(n.targets) > 2 {
+		return nil, p.errorf("too many loop variables")
+	}
+	if !p.acceptName("in") {
+		return nil, p.errorf("expected in")
+	}
+	iter, err := p.condition()
+	if err != nil {
+		return nil, err
+	}
+	n.iter = iter
+	if err := p.closeStmt(); err != nil {
+		return nil, err
+	}
+	body, end, err := p.body()
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+	if end == "else" {
+		if err := p.closeStmt(); err != nil {
+			return nil, err
+		}
+		if n.orElse, end, err = p.body(); err != nil {
+			return nil, err
+		}
+	}
+	if end != "endfor" {
+		return nil, p.errorf("expected endfor")
+	}
+	return n, p.closeStmt()
+}
+
+func (p *parser) setStmt() (node, error) {
+	t, err := p.expectKind(tokName, "variable name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+	x, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return setNode{t.val, x}, p.closeStmt()
+}
+
+// expr parses a full expression, including "a if cond else b".
+func (p *parser) expr() (expr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	x, err := p.condition()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptName("if") {
+		cond, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		var orElse expr
+		if p.acceptName("else") {
+			if orElse, err = p.condition(); err != nil {
+				return nil, err
+			}
+		}
+		x = condExpr{cond, x, orElse}
+	}
+	return x, nil
+}
+
+// condition parses an expression without a trailing conditional.
+func (p *parser) condition() (expr, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptName("or") {
+		y, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{"or", x, y}
+	}
+	return x, nil
+}
+
+func (p *parser) and() (expr, error) {
+	x, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptName("and") {
+		y, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{"and", x, y}
+	}
+	return x, nil
+}
+
+func (p *parser) not() (expr, error) {
+	if p.acceptName("not") {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{"not", x}, nil
+	}
+	return p.compare()
+}
+
+var comparisons = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// compare parses comparison chains; a < b < c means a < b and b < c.
+func (p *parser) compare() (expr, error) {
+	x, err := p.concat()
+	if err != nil {
+		return nil, err
+	}
+	var result expr
+	for {
+		op := ""
+		t := p.peek()
+		switch {
+		case t.kind == tokOp && comparisons[t.val]:
+			op = t.val
+			p.pos++
+		case p.isName("in"):
+			op = "in"
+			p.pos++
+		case p.isName("not") && p.toks[p.pos+1].kind == tokName && p.toks[p.pos+1].val == "in":
+			op = "not in"
+			p.pos += 2
+		}
+		if op == "" {
+			break
+		}
+		y, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		var cmp expr = binaryExpr{op, x, y}
+		if result == nil {
+			result = cmp
+		} else {
+			result = binaryExpr{"and", result, cmp}
+		}
+		x = y
+	}
+	if result == nil {
+		return x, nil
+	}
+	return result, nil
+}
+
+func (p *parser) concat() (expr, error) {
+	x, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("~") {
+		y, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{"~", x, y}
+	}
+	return x, nil
+}
+
+func (p *parser) sum() (expr, error) {
+	x, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+") || p.isOp("-") {
+		op := p.next().val
+		y, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op, x, y}
+	}
+	return x, nil
+}
+
+func (p *parser) product() (expr, error) {
+	x, err := p.power()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*") || p.isOp("/") || p.isOp("//") || p.isOp("%") {
+		op := p.next().val
+		y, err := p.power()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op, x, y}
+	}
+	return x, nil
+}
+
+func (p *parser) power() (expr, error) {
+	x, err := p.unary(true)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("**") {
+		y, err := p.unary(true)
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{"**", x, y}
+	}
+	return x, nil
+}
+
+// unary parses signs and a postfix expression. As in Jinja, filters and
+// tests apply to the signed value: -x|abs is (-x)|abs.
+func (p *parser) unary(withFilter bool) (expr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	var x expr
+	if p.isOp("-") || p.isOp("+") {
+		op := p.next().val
+		operand, err := p.unary(false)
+		if err != nil {
+			return nil, err
+		}
+		x = unaryExpr{op, operand}
+	} else {
+		var err error
+		if x, err = p.postfix(); err != nil {
+			return nil, err
+		}
+	}
+	if !withFilter {
+		return x, nil
+	}
+	return p.filters(x)
+}
+
+func (p *parser) filters(x expr) (expr, error) {
+	for {
+		switch {
+		case p.accept("|"):
+			t, err := p.expectKind(tokName, "filter name")
+			if err != nil {
+				return nil, err
+			}
+			f := filterExpr{x: x, name: t.val}
+			if p.accept("(") {
+				if f.args, f.kwargs, err = p.arguments(); err != nil {
+					return nil, err
+				}
+			}
+			x = f
+		case p.acceptName("is"):
+			test := testExpr{x: x, negate: p.acceptName("not")}
+			t, err := p.expectKind(tokName, "test name")
+			if err != nil {
+				return nil, err
+			}
+			test.name = t.val
+			if p.accept("(") {
+				if test.args, _, err = p.arguments(); err != nil {
+					return nil, err
+				}
+			} else if k := p.peek().kind; k == tokInt || k == tokFloat || k == tokString {
+				arg, err := p.primary()
+				if err != nil {
+					return nil, err
+				}
+				test.args = []expr{arg}
+			}
+			x = test
+		default:
+			return x, nil
+		}
+	}
+}
+
+// arguments parses a call's arguments after its opening parenthesis.
+func (p *parser) arguments() ([]expr, map[string]expr, error) {
+	var args []expr
+	var kwargs map[string]expr
+	for !p.accept(")") {
+		if len(args)+len(kwargs) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, nil, err
+			}
+			if p.accept(")") {
+				break
+			}
+		}
+		if t := p.peek(); t.kind == tokName && p.toks[p.pos+1].kind == tokOp && p.toks[p.pos+1].val == "=" {
+			p.pos += 2
+			v, err := p.expr()
+			if err != nil {
+				return nil, nil, err
+			}
+			if kwargs == nil {
+				kwargs = make(map[string]expr)
+			}
+			kwargs[t.val] = v
+			continue
+		}
+		if len(kwargs) > 0 {
+			return nil, nil, p.errorf("positional argument after keyword argument")
+		}
+		v, err := p.expr()
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, v)
+	}
+	return args, kwargs, nil
+}
+
+func (p *parser) postfix() (expr, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			switch t.kind {
+			case tokName:
+				x = attrExpr{x, t.val}
+			case tokInt:
+				n, _ := strconv.ParseInt(t.val, 10, 64)
+				x = indexExpr{x, literal{n}}
+			default:
+				return nil, p.errorf("expected attribute name")
+			}
+		case p.accept("["):
+			var lo, hi expr
+			if !p.isOp(":") {
+				if lo, err = p.expr(); err != nil {
+					return nil, err
+				}
+			}
+			if p.accept(":") {
+				if !p.isOp("]") {
+					if hi, err = p.expr(); err != nil {
+						return nil, err
+					}
+				}
+				x = sliceExpr{x, lo, hi}
+			} else {
+				if lo == nil {
+					return nil, p.errorf("expected index")
+				}
+				x = indexExpr{x, lo}
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		case p.accept("("):
+			args, kwargs, err := p.arguments()
+			if err != nil {
+				return nil, err
+			}
+			if len(kwargs) > 0 {
+				return nil, p.errorf("keyword arguments are only supported for filters")
+			}
+			x = callExpr{x, args}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokInt:
+		n, err := strconv.ParseInt(t.val, 10, 64)
+		if err != nil {
+			f, _ := strconv.ParseFloat(t.val, 64)
+			return literal{f}, nil
+		}
+		return literal{n}, nil
+	case tokFloat:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("template: bad number %q at %d", t.val, t.pos)
+		}
+		return literal{f}, nil
+	case tokString:
+		s := t.val
+		// Adjacent string literals concatenate.
+		for p.peek().kind == tokString {
+			s += p.next().val
+		}
+		return literal{s}, nil
+	case tokName:
+		switch t.val {
+		case "true", "True":
+			return literal{true}, nil
+		case "false", "False":
+			return literal{false}, nil
+		case "none", "None":
+			return literal{nil}, nil
+		}
+		return nameExpr{t.val}, nil
+	case tokOp:
+		switch t.val {
+		case "(":
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			var l listExpr
+			for !p.accept("]") {
+				if len(l.items) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+					if p.accept("]") {
+						break
+					}
+				}
+				item, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				l.items = append(l.items, item)
+			}
+			return l, nil
+		case "{":
+			var d dictExpr
+			for !p.accept("}") {
+				if len(d.keys) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+					if p.accept("}") {
+						break
+					}
+				}
+				k, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				v, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				d.keys = append(d.keys, k)
+				d.vals = append(d.vals, v)
+			}
+			return d, nil
+		}
+	}
+	if t.kind == tokEOF {
+		return nil, fmt.Errorf("template: unexpected end of template")
+	}
+	return nil, fmt.Errorf("template: unexpected %q at %d", t.val, t.pos)
+}
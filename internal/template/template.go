@@ -0,0 +1,83 @@
+// Package template evaluates the subset of Jinja that Home Assistant MQTT
+// discovery configs use in value_template, state_value_template,
+// position_template, command_template and availability_template.
+//
+// Supported: {{ }} output, {% if/elif/else %}, {% for %} and {% set %},
+// {# comments #}, whitespace control, literals, list and dict literals,
+// attribute and item access, slices, arithmetic, comparisons, in, is tests,
+// inline if, the common filters and Home Assistant's float/int/iif
+// extensions. Anything else is a parse or render error, never a panic.
+package template
+
+import "strings"
+
+// Template is a parsed template; it is safe for concurrent use.
+type Template struct {
+	src  string
+	body []node
+}
+
+// Parse parses src.
+func Parse(src string) (*Template, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	body, err := parse(toks)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{src: src, body: body}, nil
+}
+
+// Source returns the text the template was parsed from.
+func (t *Template) Source() string { return t.src }
+
+// Execute renders the template with vars, which are normalized first.
+func (t *Template) Execute(vars map[string]any) (string, error) {
+	return t.execute(vars, false)
+}
+
+func (t *Template) execute(vars map[string]any, jsonContainers bool) (string, error) {
+	sc := &scope{vars: make(map[string]any, len(vars))}
+	for k, v := range vars {
+		sc.vars[k] = Normalize(v)
+	}
+	root := &scope{vars: make(map[string]any), parent: sc}
+	st := state{jsonContainers: jsonContainers}
+	if err := st.exec(t.body, root); err != nil {
+		return "", err
+	}
+	return st.out.String(), nil
+}
+
+// RenderValue renders a template for an incoming message the way Home
+// Assistant does: value is the payload and value_json its JSON decoding,
+// undefined when the payload is not JSON. Surrounding whitespace is
+// trimmed from the result.
+func (t *Template) RenderValue(payload []byte) (string, error) {
+	out, err := t.Execute(map[string]any{
+		"value":      string(payload),
+		"value_json": decodeJSON(payload),
+	})
+	return strings.TrimSpace(out), err
+}
+
+// RenderJSON renders a template whose result is read as JSON, such as a
+// json_attributes_template. It is RenderValue, except that a mapping or list
+// output by {{ }} is written as JSON rather than in Python's notation, as
+// Home Assistant reads a complex result back as the object itself.
+func (t *Template) RenderJSON(payload []byte) (string, error) {
+	out, err := t.execute(map[string]any{
+		"value":      string(payload),
+		"value_json": decodeJSON(payload),
+	}, true)
+	return strings.TrimSpace(out), err
+}
+
+// RenderCommand renders a command_template, with value set to the
+// commanded value.
+func (t *Template) RenderCommand(value any) (string, error) {
+	out, err := t.Execute(map[string]any{"value": value})
+	return strings.TrimSpace(out), err
+}
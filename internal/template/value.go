@@ -0,0 +1,379 @@
+package template
+
+// value.go — the value model
+//
+// Values are nil (none), bool, int64, float64, string, []any and
+// map[string]any, the shapes of decoded JSON, plus Undefined for names and
+// keys that do not exist. Undefined renders as an empty string and is
+// replaced by the default filter; using it in arithmetic is an error.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Undefined is the value of a missing variable, attribute or key.
+type Undefined struct{ Name string }
+
+func (u Undefined) String() string { return "" }
+
+// Normalize converts a Go value into the template value model: integers
+// become int64, floats float64, json.Number either of them, and slices
+// and string-keyed maps are converted element by element. Other values
+// are rendered with fmt.
+func Normalize(v any) any {
+	switch x := v.(type) {
+	case nil, bool, int64, float64, string, Undefined:
+		return x
+	case int:
+		return int64(x)
+	case int8:
+		return int64(x)
+	case int16:
+		return int64(x)
+	case int32:
+		return int64(x)
+	case uint:
+		return uintValue(uint64(x))
+	case uint8:
+		return int64(x)
+	case uint16:
+		return int64(x)
+	case uint32:
+		return int64(x)
+	case uint64:
+		return uintValue(x)
+	case float32:
+		return float64(x)
+	case json.Number:
+		if n, err := x.Int64(); err == nil {
+			return n
+		}
+		f, _ := x.Float64()
+		return f
+	case json.RawMessage:
+		return decodeJSON(x)
+	case []any:
+		out := make([]any, len(x))
+		for i, e := range x {
+			out[i] = Normalize(e)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(x))
+		for k, e := range x {
+			out[k] = Normalize(e)
+		}
+		return out
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		out := make([]any, rv.Len())
+		for i := range out {
+			out[i] = Normalize(rv.Index(i).Interface())
+		}
+		return out
+	case reflect.Map:
+		if rv.Type().Key().Kind() == reflect.String {
+			out := make(map[string]any, rv.Len())
+			iter := rv.MapRange()
+			for iter.Next() {
+				out[iter.Key().String()] = Normalize(iter.Value().Interface())
+			}
+			return out
+		}
+	case reflect.String:
+		return rv.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func uintValue(u uint64) any {
+	if u > math.MaxInt64 {
+		return float64(u)
+	}
+	return int64(u)
+}
+
+// decodeJSON decodes data into the value model, or returns Undefined when
+// it is not JSON.
+func decodeJSON(data []byte) any {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return Undefined{Name: "value_json"}
+	}
+	if _, err := dec.Token(); err == nil {
+		return Undefined{Name: "value_json"}
+	}
+	return Normalize(v)
+}
+
+// truthy applies Python's truth rules.
+func truthy(v any) bool {
+	switch x := v.(type) {
+	case nil, Undefined:
+		return false
+	case bool:
+		return x
+	case int64:
+		return x != 0
+	case float64:
+		return x != 0
+	case string:
+		return x != ""
+	case []any:
+		return len(x) > 0
+	case map[string]any:
+		return len(x) > 0
+	}
+	return true
+}
+
+// toString renders v as Jinja does.
+func toString(v any) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case Undefined:
+		return ""
+	}
+	var b strings.Builder
+	writeRepr(&b, v, false)
+	return b.String()
+}
+
+// writeRepr writes v in Python's notation; quote is set inside containers,
+// where strings are quoted.
+func writeRepr(b *strings.Builder, v any, quote bool) {
+	switch x := v.(type) {
+	case nil:
+		b.WriteString("None")
+	case Undefined:
+		if quote {
+			b.WriteString("None")
+		}
+	case bool:
+		if x {
+			b.WriteString("True")
+		} else {
+			b.WriteString("False")
+		}
+	case int64:
+		b.WriteString(strconv.FormatInt(x, 10))
+	case float64:
+		b.WriteString(formatFloat(x))
+	case string:
+		if quote {
+			b.WriteString(quoteString(x))
+		} else {
+			b.WriteString(x)
+		}
+	case []any:
+		b.WriteByte('[')
+		for i, e := range x {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeRepr(b, e, true)
+		}
+		b.WriteByte(']')
+	case map[string]any:
+		b.WriteByte('{')
+		for i, k := range sortedKeys(x) {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(quoteString(k))
+			b.WriteString(": ")
+			writeRepr(b, x[k], true)
+		}
+		b.WriteByte('}')
+	default:
+		fmt.Fprint(b, x)
+	}
+}
+
+// formatFloat formats like Python's repr of a float: integral values keep
+// a ".0".
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-4 || abs >= 1e16) {
+		return s
+	}
+	s = strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.ContainsAny(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+func quoteString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\t", `\t`, "\r", `\r`)
+	return "'" + r.Replace(s) + "'"
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// toNumber converts numbers, bools and numeric strings to int64 or
+// float64.
+func toNumber(v any) (any, bool) {
+	switch x := v.(type) {
+	case int64, float64:
+		return x, true
+	case bool:
+		if x {
+			return int64(1), true
+		}
+		return int64(0), true
+	case string:
+		s := strings.TrimSpace(x)
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, true
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+func toFloat(v any) (float64, bool) {
+	n, ok := toNumber(v)
+	if !ok {
+		return 0, false
+	}
+	if i, isInt := n.(int64); isInt {
+		return float64(i), true
+	}
+	return n.(float64), true
+}
+
+func toInt(v any) (int64, bool) {
+	n, ok := toNumber(v)
+	if !ok {
+		return 0, false
+	}
+	if i, isInt := n.(int64); isInt {
+		return i, true
+	}
+	f := n.(float64)
+	if math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// isNumber reports whether v is an int64 or float64; bools are not numbers
+// for arithmetic.
+func isNumber(v any) bool {
+	switch v.(type) {
+	case int64, float64:
+		return true
+	}
+	return false
+}
+
+// equal compares values with Python semantics: 1 == 1.0 and containers
+// compare element-wise.
+func equal(a, b any) bool {
+	if _, ok := a.(Undefined); ok {
+		a = nil
+	}
+	if _, ok := b.(Undefined); ok {
+		b = nil
+	}
+	an, aNum := numeric(a)
+	bn, bNum := numeric(b)
+	if aNum || bNum {
+		return aNum && bNum && an == bn
+	}
+	switch x := a.(type) {
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, found := y[k]
+			if !found || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// numeric returns numbers and bools as float64 for comparisons, where
+// Python treats True as 1.
+func numeric(v any) (float64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "none"
+	case Undefined:
+		return "undefined"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "str"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "dict"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,105 @@
+package translate
+
+// components.go — device-based discovery (homeassistant/device/<id>/config)
+//
+// A device-based config describes every entity of a device in one payload:
+// a cmps map of per-component configs next to options the components share,
+// such as the device, origin and availability blocks. DeviceComponents
+// splits it into one regular config per component.
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// sharedOptions are the keys of a device-based config its components
+// inherit unless they set them themselves.
+var sharedOptions = []string{
+	topicBase,
+	"availability",
+	"availability_mode",
+	"availability_template",
+	"availability_topic",
+	"command_topic",
+	"device",
+	"encoding",
+	"origin",
+	"payload_available",
+	"payload_not_available",
+	"qos",
+	"state_topic",
+}
+
+// Component is one entry of the cmps map of a device-based config.
+type Component struct {
+	ID       string
+	Platform string
+	// Config is the component's config merged with the shared options, in
+	// the same form as a single-entity discovery config.
+	Config json.RawMessage
+	// Removed is set for a component that carries only its platform, which
+	// is how a publisher removes a component from the device.
+	Removed bool
+}
+
+// DeviceComponents splits a device-based discovery config into its
+// components, sorted by ID.
+func DeviceComponents(data []byte) ([]Component, error) {
+	var cfg map[string]json.RawMessage
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	expandKeys(cfg, abbreviations)
+
+	var cmps map[string]json.RawMessage
+	if raw, ok := cfg["components"]; ok {
+		if err := json.Unmarshal(raw, &cmps); err != nil {
+			return nil, fmt.Errorf("components: %w", err)
+		}
+	}
+	if len(cmps) == 0 {
+		return nil, fmt.Errorf("device config has no components")
+	}
+
+	ids := make([]string, 0, len(cmps))
+	for id := range cmps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	components := make([]Component, 0, len(ids))
+	for _, id := range ids {
+		var comp map[string]json.RawMessage
+		if err := json.Unmarshal(cmps[id], &comp); err != nil || comp == nil {
+			return nil, fmt.Errorf("component %q: not an object", id)
+		}
+		expandKeys(comp, abbreviations)
+		c := Component{ID: id}
+		if raw, ok := comp["platform"]; ok {
+			_ = json.Unmarshal(raw, &c.Platform)
+		}
+		if c.Platform == "" {
+			return nil, fmt.Errorf("component %q: no platform", id)
+		}
+		if len(comp) == 1 {
+			c.Removed = true
+			components = append(components, c)
+			continue
+		}
+		for _, k := range sharedOptions {
+			if _, set := comp[k]; !set {
+				if v, ok := cfg[k]; ok {
+					comp[k] = v
+				}
+			}
+		}
+		merged, err := json.Marshal(comp)
+		if err != nil {
+			return nil, fmt.Errorf("component %q: %w", id, err)
+		}
+		c.Config = merged
+		components = append(components, c)
+	}
+	return components, nil
+}
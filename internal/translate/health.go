@@ -0,0 +1,78 @@
+package translate
+
+// health.go — device-health fields Z2M adds to every state message
+//
+// Z2M reports linkquality on each message of a device, and battery, voltage
+// and last_seen when the device or Z2M's configuration provides them. They
+// describe the device rather than one of its entities.
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+)
+
+// Health is the device-health part of a Z2M state message. Fields the
+// message does not carry are nil.
+type Health struct {
+	LinkQuality *int
+	// Battery is the remaining charge in percent.
+	Battery *float64
+	// Voltage is the battery or supply voltage in millivolts.
+	Voltage  *float64
+	LastSeen *time.Time
+}
+
+// DecodeHealth extracts the device-health fields of a state message. ok is
+// false when it has none.
+func DecodeHealth(payload []byte) (h Health, ok bool) {
+	var z2m struct {
+		LinkQuality *float64        `json:"linkquality"`
+		Battery     *float64        `json:"battery"`
+		Voltage     *float64        `json:"voltage"`
+		LastSeen    json.RawMessage `json:"last_seen"`
+	}
+	if err := json.Unmarshal(payload, &z2m); err != nil {
+		return Health{}, false
+	}
+	if z2m.LinkQuality != nil {
+		lqi := int(clampFloat(*z2m.LinkQuality, 0, 255))
+		h.LinkQuality = &lqi
+	}
+	if z2m.Battery != nil {
+		battery := clampFloat(*z2m.Battery, 0, 100)
+		h.Battery = &battery
+	}
+	h.Voltage = z2m.Voltage
+	h.LastSeen = decodeLastSeen(z2m.LastSeen)
+	ok = h.LinkQuality != nil || h.Battery != nil || h.Voltage != nil || h.LastSeen != nil
+	return h, ok
+}
+
+// decodeLastSeen parses last_seen in any of Z2M's formats: epoch
+// milliseconds, or ISO 8601 with or without a zone offset.
+func decodeLastSeen(raw json.RawMessage) *time.Time {
+	if len(raw) == 0 {
+		return nil
+	}
+	var ms float64
+	if err := json.Unmarshal(raw, &ms); err == nil {
+		t := time.UnixMilli(int64(ms)).UTC()
+		return &t
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil || strings.TrimSpace(s) == "" {
+		return nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+func clampFloat(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
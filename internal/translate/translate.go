@@ -37,10 +37,21 @@ import (
 type DiscoveryPayload struct {
 	// Common fields
 	Name              string          `json:"name"`
+	Platform          string          `json:"platform"` // Entity type of a device-based config component
 	StateTopic        string          `json:"state_topic"`
 	CommandTopic      string          `json:"command_topic"`
 	AvailabilityTopic string          `json:"availability_topic"`
-	Device            json.RawMessage `json:"dev,omitempty"` // Device info for debugging
+	EntityCategory    string          `json:"entity_category"`  // "config" or "diagnostic"
+	Device            json.RawMessage `json:"device,omitempty"` // Device block, see DeviceInfo
+
+	// Availability — availability_topic with its payloads and template, or
+	// a list of topics combined according to the mode ("all", "any" or
+	// "latest")
+	PayloadAvailable     json.RawMessage `json:"payload_available"`
+	PayloadNotAvailable  json.RawMessage `json:"payload_not_available"`
+	AvailabilityTemplate string          `json:"availability_template"`
+	Availability         []Availability  `json:"availability"`
+	AvailabilityMode     string          `json:"availability_mode"`
 
 	// Light specific
 	Brightness      bool     `json:"brightness"`
@@ -70,6 +81,11 @@ type DiscoveryPayload struct {
 	UnitOfMeasurement string `json:"unit_of_measurement"`
 	DeviceClass       string `json:"device_class"`
 
+	// Templates besides value_template, evaluated by internal/template
+	StateValueTemplate string `json:"state_value_template"`
+	PositionTemplate   string `json:"position_template"`
+	CommandTemplate    string `json:"command_template"`
+
 	// Climate
 	Modes            []string `json:"modes"`
 	FanModes         []string `json:"fan_modes"`
@@ -94,8 +110,8 @@ type DiscoveryPayload struct {
 	// Text
 	Pattern string `json:"pattern"`
 	Mode    string `json:"mode"`
-	TextMin int    `json:"min"`
-	TextMax int    `json:"max"`
+	TextMin int    `json:"-"` // min, as a length
+	TextMax int    `json:"-"` // max, as a length
 
 	// Fan
 	PercentageCommandTopic string `json:"percentage_command_topic"`
@@ -104,6 +120,23 @@ type DiscoveryPayload struct {
 
 	// Button
 	PayloadPress json.RawMessage `json:"payload_press"`
+
+	// Entity metadata
+	UniqueID                  string `json:"unique_id"`
+	ObjectID                  string `json:"object_id"`
+	EnabledByDefault          *bool  `json:"enabled_by_default"`
+	Icon                      string `json:"icon"`
+	JSONAttributesTopic       string `json:"json_attributes_topic"`
+	JSONAttributesTemplate    string `json:"json_attributes_template"`
+	SuggestedDisplayPrecision *int   `json:"suggested_display_precision"`
+}
+
+// Availability is one entry of the availability list of a discovery config.
+type Availability struct {
+	Topic               string          `json:"topic"`
+	PayloadAvailable    json.RawMessage `json:"payload_available"`
+	PayloadNotAvailable json.RawMessage `json:"payload_not_available"`
+	ValueTemplate       string          `json:"value_template"`
 }
 
 type discoveryDeviceInfo struct {
@@ -112,134 +145,68 @@ type discoveryDeviceInfo struct {
 	Identifiers  []string `json:"identifiers"`
 }
 
-func (d *DiscoveryPayload) UnmarshalJSON(data []byte) error {
-	type rawDiscoveryPayload DiscoveryPayload
+// DeviceInfo is the device block ("dev" or "device") of a discovery config,
+// with the HA abbreviations expanded.
+type DeviceInfo struct {
+	Name          string   `json:"name"`
+	Manufacturer  string   `json:"manufacturer"`
+	Model         string   `json:"model"`
+	ModelID       string   `json:"model_id"`
+	SWVersion     string   `json:"sw_version"`
+	HWVersion     string   `json:"hw_version"`
+	Identifiers   []string `json:"identifiers"`
+	ViaDevice     string   `json:"via_device"`
+	SuggestedArea string   `json:"suggested_area"`
+}
 
+func (d *DeviceInfo) UnmarshalJSON(data []byte) error {
+	type rawDeviceInfo DeviceInfo
 	var aux struct {
-		rawDiscoveryPayload
-		NameAlias                   string          `json:"name"`
-		StateTopicShort             string          `json:"stat_t"`
-		CommandTopicShort           string          `json:"cmd_t"`
-		AvailabilityTopicShort      string          `json:"avty_t"`
-		BrightnessScaleShort        int             `json:"bri_scl"`
-		ColorTempShort              bool            `json:"clr_temp"`
-		MinMiredsShort              int             `json:"min_mirs"`
-		MaxMiredsShort              int             `json:"max_mirs"`
-		EffectListShort             []string        `json:"fx_list"`
-		PayloadOnShort              json.RawMessage `json:"pl_on"`
-		PayloadOffShort             json.RawMessage `json:"pl_off"`
-		PayloadOpenShort            json.RawMessage `json:"pl_open"`
-		PayloadCloseShort           json.RawMessage `json:"pl_cls"`
-		PayloadStopShort            json.RawMessage `json:"pl_stop"`
-		PayloadLockShort            json.RawMessage `json:"pl_lock"`
-		PayloadUnlockShort          json.RawMessage `json:"pl_unlk"`
-		PositionTopicShort          string          `json:"pos_t"`
-		SetPositionTopicShort       string          `json:"set_pos_t"`
-		PositionOpenShort           int             `json:"pos_open"`
-		PositionClosedShort         int             `json:"pos_clsd"`
-		ValueTemplateShort          string          `json:"val_tpl"`
-		UnitOfMeasurementShort      string          `json:"unit_of_meas"`
-		DeviceClassShort            string          `json:"dev_cla"`
-		ModesShort                  []string        `json:"modes"`
-		FanModesShort               []string        `json:"fan_modes"`
-		PresetModesShort            []string        `json:"pr_modes"`
-		ModeCommandTopicShort       string          `json:"mode_cmd_t"`
-		TempCommandTopicShort       string          `json:"temp_cmd_t"`
-		FanCommandTopicShort        string          `json:"fan_mode_cmd_t"`
-		MinTempShort                float64         `json:"min_temp"`
-		MaxTempShort                float64         `json:"max_temp"`
-		TempStepShort               float64         `json:"temp_step"`
-		PrecisionShort              float64         `json:"temp_step"`
-		TemperatureUnitShort        string          `json:"temp_unit"`
-		OptionsShort                []string        `json:"ops"`
-		PatternShort                string          `json:"pattern"`
-		ModeShort                   string          `json:"mode"`
-		TextMinShort                int             `json:"min"`
-		TextMaxShort                int             `json:"max"`
-		PercentageCommandTopicShort string          `json:"pct_cmd_t"`
-		SpeedRangeMinShort          int             `json:"spd_rng_min"`
-		SpeedRangeMaxShort          int             `json:"spd_rng_max"`
-		PayloadPressShort           json.RawMessage `json:"pl_prs"`
-	}
-
-	if err := json.Unmarshal(data, &aux); err != nil {
+		rawDeviceInfo
+		Identifiers json.RawMessage `json:"identifiers"`
+	}
+	if err := json.Unmarshal(expandBlock(data, deviceAbbreviations, ""), &aux); err != nil {
 		return err
 	}
-
-	*d = DiscoveryPayload(aux.rawDiscoveryPayload)
-
-	applyString := func(dst *string, value string) {
-		if *dst == "" && value != "" {
-			*dst = value
+	*d = DeviceInfo(aux.rawDeviceInfo)
+	// HA accepts a single identifier string as well as a list.
+	if len(aux.Identifiers) > 0 {
+		var one string
+		if err := json.Unmarshal(aux.Identifiers, &one); err == nil {
+			d.Identifiers = []string{one}
+		} else if err := json.Unmarshal(aux.Identifiers, &d.Identifiers); err != nil {
+			return fmt.Errorf("device identifiers: %w", err)
 		}
 	}
-	applyInt := func(dst *int, value int) {
-		if *dst == 0 && value != 0 {
-			*dst = value
-		}
+	return nil
+}
+
+// DeviceInfo decodes the device block. ok is false when the config has none.
+func (d DiscoveryPayload) DeviceInfo() (info DeviceInfo, ok bool) {
+	if len(d.Device) == 0 {
+		return DeviceInfo{}, false
 	}
-	applyFloat := func(dst *float64, value float64) {
-		if *dst == 0 && value != 0 {
-			*dst = value
-		}
+	if err := json.Unmarshal(d.Device, &info); err != nil {
+		return DeviceInfo{}, false
 	}
-	applyStrings := func(dst *[]string, value []string) {
-		if len(*dst) == 0 && len(value) > 0 {
-			*dst = value
-		}
+	return info, true
+}
+
+func (d *DiscoveryPayload) UnmarshalJSON(data []byte) error {
+	type rawDiscoveryPayload DiscoveryPayload
+
+	expanded, err := expandDiscovery(data)
+	if err != nil {
+		return err
 	}
-	applyRaw := func(dst *json.RawMessage, value json.RawMessage) {
-		if len(*dst) == 0 && len(value) > 0 {
-			*dst = value
-		}
+	var raw rawDiscoveryPayload
+	if err := json.Unmarshal(expanded, &raw); err != nil {
+		return err
 	}
+	*d = DiscoveryPayload(raw)
 
-	applyString(&d.Name, aux.NameAlias)
-	applyString(&d.StateTopic, aux.StateTopicShort)
-	applyString(&d.CommandTopic, aux.CommandTopicShort)
-	applyString(&d.AvailabilityTopic, aux.AvailabilityTopicShort)
-	applyInt(&d.BrightnessScale, aux.BrightnessScaleShort)
-	if !d.ColorTemp && aux.ColorTempShort {
-		d.ColorTemp = true
-	}
-	applyInt(&d.MinMireds, aux.MinMiredsShort)
-	applyInt(&d.MaxMireds, aux.MaxMiredsShort)
-	applyStrings(&d.EffectList, aux.EffectListShort)
-	applyRaw(&d.PayloadOn, aux.PayloadOnShort)
-	applyRaw(&d.PayloadOff, aux.PayloadOffShort)
-	applyRaw(&d.PayloadOpen, aux.PayloadOpenShort)
-	applyRaw(&d.PayloadClose, aux.PayloadCloseShort)
-	applyRaw(&d.PayloadStop, aux.PayloadStopShort)
-	applyRaw(&d.PayloadLock, aux.PayloadLockShort)
-	applyRaw(&d.PayloadUnlock, aux.PayloadUnlockShort)
-	applyString(&d.PositionTopic, aux.PositionTopicShort)
-	applyString(&d.SetPositionTopic, aux.SetPositionTopicShort)
-	applyInt(&d.PositionOpen, aux.PositionOpenShort)
-	applyInt(&d.PositionClosed, aux.PositionClosedShort)
-	applyString(&d.ValueTemplate, aux.ValueTemplateShort)
-	applyString(&d.UnitOfMeasurement, aux.UnitOfMeasurementShort)
-	applyString(&d.DeviceClass, aux.DeviceClassShort)
-	applyStrings(&d.Modes, aux.ModesShort)
-	applyStrings(&d.FanModes, aux.FanModesShort)
-	applyStrings(&d.PresetModes, aux.PresetModesShort)
-	applyString(&d.ModeCommandTopic, aux.ModeCommandTopicShort)
-	applyString(&d.TempCommandTopic, aux.TempCommandTopicShort)
-	applyString(&d.FanCommandTopic, aux.FanCommandTopicShort)
-	applyFloat(&d.MinTemp, aux.MinTempShort)
-	applyFloat(&d.MaxTemp, aux.MaxTempShort)
-	applyFloat(&d.TempStep, aux.TempStepShort)
-	applyFloat(&d.Precision, aux.PrecisionShort)
-	applyString(&d.TemperatureUnit, aux.TemperatureUnitShort)
-	applyStrings(&d.Options, aux.OptionsShort)
-	applyString(&d.Pattern, aux.PatternShort)
-	applyString(&d.Mode, aux.ModeShort)
-	applyInt(&d.TextMin, aux.TextMinShort)
-	applyInt(&d.TextMax, aux.TextMaxShort)
-	applyString(&d.PercentageCommandTopic, aux.PercentageCommandTopicShort)
-	applyInt(&d.SpeedRangeMin, aux.SpeedRangeMinShort)
-	applyInt(&d.SpeedRangeMax, aux.SpeedRangeMaxShort)
-	applyRaw(&d.PayloadPress, aux.PayloadPressShort)
-
+	// Number and text configs share the min and max keys.
+	d.TextMin, d.TextMax = int(d.Min), int(d.Max)
 	return nil
 }
 